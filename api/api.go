@@ -1,8 +1,12 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/daolinet/daolinet/discovery/kv"
@@ -21,6 +25,15 @@ type (
 		dUrl          string
 		ofcUrl        string
 		fwd           *forward.Forwarder
+		auth          []Authenticator
+		tlsConfig     *tls.Config
+		audit         AuditLog
+		index         *containerIndex
+		jobs          *jobs
+		gcInterval    time.Duration
+		gcDelete      bool
+		// ruleLock serializes the syncs of the rules.
+		ruleLock sync.Mutex
 	}
 
 	ApiConfig struct {
@@ -29,6 +42,16 @@ type (
 		Client        *dockerclient.DockerClient
 		Store         *kv.Discovery
 		AllowInsecure bool
+		// Authenticators of the requests, the api is open if empty.
+		Authenticators []Authenticator
+		// TLSConfig of the listener, it serves plain http if nil.
+		TLSConfig *tls.Config
+		// Audit logs every change made through the api, if not nil.
+		Audit AuditLog
+		// GCInterval is the period between each search of orphan
+		// entries in the store, zero disables it. GCDelete deletes them.
+		GCInterval time.Duration
+		GCDelete   bool
 	}
 )
 
@@ -39,6 +62,11 @@ func NewApi(config ApiConfig) (*Api, error) {
 		client:        config.Client,
 		store:         config.Store,
 		allowInsecure: config.AllowInsecure,
+		auth:          config.Authenticators,
+		tlsConfig:     config.TLSConfig,
+		audit:         config.Audit,
+		gcInterval:    config.GCInterval,
+		gcDelete:      config.GCDelete,
 	}, nil
 }
 
@@ -77,6 +105,23 @@ func (a *Api) Run() error {
 	if err := a.initPath(); err != nil {
 		return err
 	}
+	if err := a.upgradeFirewalls(); err != nil {
+		log.Warnf("error moving the firewalls to their protocol: %v", err)
+	}
+
+	// follow the containers to keep their state bound to them
+	a.index = newContainerIndex(a)
+	go a.index.follow()
+
+	// roll back the migrations interrupted by a restart
+	a.jobs = newJobs(a)
+	if err := a.jobs.recover(); err != nil {
+		log.Warnf("error recovering jobs: %v", err)
+	}
+
+	if a.gcInterval > 0 {
+		go a.runGC(a.gcInterval, a.gcDelete)
+	}
 
 	a.dUrl = fmt.Sprintf("%s%s", scheme, u.Host)
 
@@ -90,39 +135,66 @@ func (a *Api) Run() error {
 
 	mh := map[string]map[string]http.HandlerFunc{
 		"GET": {
+			"/api/openapi.json":            a.openapi,
+			"/api/audit":                   a.auditLog,
+			"/api/watch":                   a.watchEvents,
+			"/api/export":                  a.exportDocument,
+			"/api/gc":                      a.gcReport,
 			"/api/gateways":                a.gateways,
 			"/api/gateways/{id}":           a.gateway,
 			"/api/groups":                  a.groups,
 			"/api/groups/{name}":           a.group,
 			"/api/policy":                  a.policys,
 			"/api/policy/{peer}":           a.policy,
+			"/api/policy/{peer}/effective": a.effectivePolicy,
+			"/api/policy/{peer}/ports":     a.policyPorts,
+			"/api/rules":                   a.policyRules,
+			"/api/rules/{name}":            a.policyRule,
 			"/api/firewalls":               a.firewalls,
 			"/api/firewalls/{name}":        a.firewallByContainer,
 			"/api/firewalls/{node}/{port}": a.firewall,
-			"/api/containers/{id}":         a.showContainer,
+			"/api/firewalls/{node}/{protocol}/{port}": a.firewall,
+			"/api/containers/{id}":                    a.showContainer,
+			"/api/jobs":                               a.listJobs,
+			"/api/jobs/{id}":                          a.getJob,
 		},
 		"POST": {
-			"/api/groups":        a.saveGroup,
-			"/api/groups/{name}": a.saveMember,
-			"/api/policy/{peer}": a.savePolicy,
-			"/api/firewalls":     a.saveFirewall,
+			"/api/apply":                  a.applyDocument,
+			"/api/gc":                     a.gcCollect,
+			"/api/groups":                 a.saveGroup,
+			"/api/groups/{name}":          a.saveMember,
+			"/api/policy/{peer}":          a.savePolicy,
+			"/api/policy/evaluate":        a.evaluatePolicy,
+			"/api/rules":                  a.saveRule,
+			"/api/firewalls":              a.saveFirewall,
+			"/api/jobs/{id}/cancel":       a.cancelJob,
+			"/api/gateways/{id}/drain":    a.drainGateway,
+			"/api/gateways/{id}/cordon":   a.cordonGateway,
+			"/api/gateways/{id}/uncordon": a.uncordonGateway,
 		},
 		"DELETE": {
 			"/api/groups/{name}":          a.deleteGroup,
 			"/api/groups/{name}/{member}": a.deleteMember,
 			"/api/policy/{peer}":          a.deletePolicy,
+			"/api/rules/{name}":           a.deleteRule,
 			"/api/firewalls/{name}":       a.deleteFirewall,
 		},
                 "PUT": {
 			"/api/containers/{id}/reset":    a.resetContainer,
+			"/api/rules/{name}":             a.updateRule,
                 },
 	}
 
 	apiRouter := mux.NewRouter()
 	for method, routes := range mh {
-		for route, fct := range routes {
+		for _, route := range sortedRoutes(routes) {
+			fct := routes[route]
 			localRoute := route
-			localFct := fct
+			role := routeRole(method, route)
+			localFct := a.authorize(role, fct)
+			if method != "GET" && role != RoleReadOnly {
+				localFct = a.audited(method, route, localFct)
+			}
 			wrap := func(w http.ResponseWriter, r *http.Request) {
 				localFct(w, r)
 			}
@@ -192,7 +264,7 @@ func (a *Api) Run() error {
 			"/images/load":                        swarmRedirect,
 			"/images/{name:.*}/push":              swarmRedirect,
 			"/images/{name:.*}/tag":               swarmRedirect,
-			"/containers/create":                  swarmRedirect,
+			"/containers/create":                  a.createContainer,
 			"/containers/{name:.*}/kill":          swarmRedirect,
 			"/containers/{name:.*}/pause":         swarmRedirect,
 			"/containers/{name:.*}/unpause":       swarmRedirect,
@@ -229,7 +301,7 @@ func (a *Api) Run() error {
 	for method, routes := range m {
 		for route, fct := range routes {
 			localRoute := route
-			localFct := fct
+			localFct := a.authorize(routeRole(method, route), fct)
 			wrap := func(w http.ResponseWriter, r *http.Request) {
 				localFct(w, r)
 			}
@@ -263,14 +335,21 @@ func (a *Api) Run() error {
 	globalMux.Handle("/v1.25/", swarmRouter)
 	globalMux.Handle("/v1.26/", swarmRouter)
 
-	log.Infof("controller listening on %s", a.listenAddr)
-
 	s := &http.Server{
 		Addr:    a.listenAddr,
-		Handler: context.ClearHandler(globalMux),
+		Handler: context.ClearHandler(a.authenticate(globalMux)),
+	}
+
+	if a.tlsConfig == nil {
+		log.Infof("controller listening on %s", a.listenAddr)
+		return s.ListenAndServe()
 	}
 
-	var runErr error
-	runErr = s.ListenAndServe()
-	return runErr
+	l, err := net.Listen("tcp", a.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = a.tlsConfig
+	log.Infof("controller listening on %s with tls", a.listenAddr)
+	return s.Serve(tls.NewListener(l, a.tlsConfig))
 }
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/discovery/kv"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/gorilla/context"
+)
+
+const pathAudit = "daolinet/audit"
+
+const auditKey contextKey = 1
+
+// AuditFilter selects audit entries, zero fields match every entry.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	Actor string
+}
+
+func (f AuditFilter) match(e *model.AuditEntry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return f.Actor == "" || f.Actor == e.Actor
+}
+
+// AuditLog is an append-only log of the changes made through the api.
+type AuditLog interface {
+	// Append adds the entry to the log.
+	Append(entry *model.AuditEntry) error
+	// Query returns the entries matching filter, oldest first.
+	Query(filter AuditFilter) ([]model.AuditEntry, error)
+}
+
+// auditPruneInterval is the least time between two prunes of the
+// audit entries of the kv store.
+const auditPruneInterval = time.Hour
+
+// KVAudit stores the audit log in the kv store, one key per entry.
+// Entries older than retention are deleted, zero keeps them forever.
+type KVAudit struct {
+	store     *kv.Discovery
+	retention time.Duration
+
+	lock   sync.Mutex
+	pruned time.Time
+}
+
+func NewKVAudit(store *kv.Discovery, retention time.Duration) *KVAudit {
+	return &KVAudit{store: store, retention: retention}
+}
+
+// prune deletes the entries older than the retention, the keys are
+// the times of the entries.
+func (k *KVAudit) prune() {
+	pairs, err := k.store.List(pathAudit)
+	if err != nil {
+		if err != store.ErrKeyNotFound {
+			log.Warnf("error listing audit entries: %v", err)
+		}
+		return
+	}
+
+	cutoff := time.Now().Add(-k.retention).UnixNano()
+	deleted := 0
+	for _, pair := range pairs {
+		id, err := strconv.ParseInt(path.Base(pair.Key), 10, 64)
+		if err != nil || id >= cutoff {
+			continue
+		}
+		if err := k.store.Delete(path.Join(pathAudit, path.Base(pair.Key))); err != nil && err != store.ErrKeyNotFound {
+			log.Warnf("error deleting audit entry %s: %v", pair.Key, err)
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		log.Infof("deleted %d audit entries older than %s", deleted, k.retention)
+	}
+}
+
+// maybePrune prunes the entries in the background, at most once every
+// auditPruneInterval.
+func (k *KVAudit) maybePrune() {
+	if k.retention <= 0 {
+		return
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if time.Since(k.pruned) < auditPruneInterval {
+		return
+	}
+	k.pruned = time.Now()
+	go k.prune()
+}
+
+func (k *KVAudit) Append(entry *model.AuditEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Keys are ordered by time, an existing entry is never overwritten.
+	id := entry.Time.UnixNano()
+	for {
+		key := path.Join(pathAudit, fmt.Sprintf("%020d", id))
+		_, _, err := k.store.Store().AtomicPut(key, value, nil, nil)
+		if err != store.ErrKeyExists {
+			if err == nil {
+				k.maybePrune()
+			}
+			return err
+		}
+		id++
+	}
+}
+
+func (k *KVAudit) Query(filter AuditFilter) ([]model.AuditEntry, error) {
+	pairs, err := k.store.List(pathAudit)
+	if err == store.ErrKeyNotFound {
+		return []model.AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []model.AuditEntry{}
+	for _, pair := range pairs {
+		var e model.AuditEntry
+		if err := json.Unmarshal(pair.Value, &e); err != nil {
+			log.Warnf("error unmarshal audit entry %s: %v", pair.Key, err)
+			continue
+		}
+		if filter.match(&e) {
+			entries = append(entries, e)
+		}
+	}
+	sortAudit(entries)
+	return entries, nil
+}
+
+// FileAudit appends the audit log to a file, one json entry per line.
+type FileAudit struct {
+	sync.Mutex
+	file string
+	f    *os.File
+}
+
+func NewFileAudit(file string) (*FileAudit, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAudit{file: file, f: f}, nil
+}
+
+func (a *FileAudit) Append(entry *model.AuditEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	_, err = a.f.Write(append(value, '\n'))
+	return err
+}
+
+func (a *FileAudit) Query(filter AuditFilter) ([]model.AuditEntry, error) {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []model.AuditEntry{}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var e model.AuditEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				log.Warnf("error unmarshal audit entry of %s: %v", a.file, err)
+			} else if filter.match(&e) {
+				entries = append(entries, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortAudit(entries)
+	return entries, nil
+}
+
+// auditByTime sorts audit entries oldest first.
+type auditByTime []model.AuditEntry
+
+func (a auditByTime) Len() int           { return len(a) }
+func (a auditByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a auditByTime) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
+
+func sortAudit(entries []model.AuditEntry) {
+	sort.Stable(auditByTime(entries))
+}
+
+// auditWriter records the status and the error body of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status >= http.StatusBadRequest {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// audited wraps h to append an audit entry of every request it serves.
+// Handlers complete the entry with auditContainers and auditChange.
+func (a *Api) audited(method, route string, h http.HandlerFunc) http.HandlerFunc {
+	if a.audit == nil {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &model.AuditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  "anonymous",
+			Remote: r.RemoteAddr,
+			Method: method,
+			Route:  route,
+			Path:   r.URL.Path,
+		}
+		if identity := requestIdentity(r); identity != nil {
+			entry.Actor = identity.Name
+			entry.Role = identity.Role
+		}
+		context.Set(r, auditKey, entry)
+
+		aw := &auditWriter{ResponseWriter: w, status: http.StatusOK}
+		h(aw, r)
+
+		entry.Status = aw.status
+		entry.Result = "success"
+		if aw.status >= http.StatusBadRequest {
+			var e model.Error
+			if err := json.Unmarshal(aw.body.Bytes(), &e); err == nil && e.Message != "" {
+				entry.Result = e.Message
+			} else {
+				entry.Result = http.StatusText(aw.status)
+			}
+		}
+		if err := a.audit.Append(entry); err != nil {
+			log.Errorf("error writing audit entry of %s %s: %v", method, r.URL.Path, err)
+		}
+	}
+}
+
+func requestAudit(r *http.Request) *model.AuditEntry {
+	if entry, ok := context.Get(r, auditKey).(*model.AuditEntry); ok {
+		return entry
+	}
+	return nil
+}
+
+// auditContainers records the ids of the containers a request acts on.
+func auditContainers(r *http.Request, ids ...string) {
+	if entry := requestAudit(r); entry != nil {
+		entry.Containers = append(entry.Containers, ids...)
+	}
+}
+
+// auditChange records the values a request replaces, nil if they did
+// not exist or do not anymore.
+func auditChange(r *http.Request, before, after interface{}) {
+	if entry := requestAudit(r); entry != nil {
+		entry.Before = before
+		entry.After = after
+	}
+}
+
+func parseTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errInvalid("%s should be a RFC 3339 time: %v", name, err)
+	}
+	return t, nil
+}
+
+func (a *Api) auditLog(w http.ResponseWriter, r *http.Request) {
+	if a.audit == nil {
+		httpError(w, errInvalid("audit log is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	var (
+		filter = AuditFilter{Actor: query.Get("actor")}
+		err    error
+	)
+	if filter.Since, err = parseTime("since", query.Get("since")); err != nil {
+		httpError(w, err)
+		return
+	}
+	if filter.Until, err = parseTime("until", query.Get("until")); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	entries, err := a.audit.Query(filter)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	// limit keeps the most recent entries.
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			httpError(w, errInvalid("limit should be a positive integer"))
+			return
+		}
+		if len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		httpError(w, err)
+		return
+	}
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleReadOnly     = "read-only"
+	RoleNetworkAdmin = "network-admin"
+	RoleAdmin        = "admin"
+)
+
+// roleLevel orders the roles, every role is granted the rights of the
+// roles below it.
+var roleLevel = map[string]int{
+	RoleReadOnly:     1,
+	RoleNetworkAdmin: 2,
+	RoleAdmin:        3,
+}
+
+var (
+	ErrUnauthorized = errors.New("authentication required")
+	ErrForbidden    = errors.New("permission denied")
+)
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// Identity is an authenticated user of the api and its role.
+type Identity struct {
+	Name string
+	Role string
+}
+
+// Authenticator authenticates the requests of the controller.
+type Authenticator interface {
+	// Authenticate returns the identity of the request, or nil if the
+	// request carries no credential the authenticator handles.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// readLines returns the fields of the non empty and non comment lines
+// of file.
+func readLines(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines, scanner.Err()
+}
+
+func checkRole(file, role string) error {
+	if _, ok := roleLevel[role]; !ok {
+		return fmt.Errorf("%s: invalid role %q (options: %s, %s, %s)", file, role, RoleReadOnly, RoleNetworkAdmin, RoleAdmin)
+	}
+	return nil
+}
+
+// LoadRoles reads the roles of the users authenticated by a password
+// or a client certificate, one "<name> <role>" per line.
+func LoadRoles(file string) (map[string]string, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := map[string]string{}
+	for _, fields := range lines {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line should be <name> <role>: %s", file, strings.Join(fields, " "))
+		}
+		if err := checkRole(file, fields[1]); err != nil {
+			return nil, err
+		}
+		roles[fields[0]] = fields[1]
+	}
+	return roles, nil
+}
+
+// TokenAuth authenticates static bearer tokens.
+type TokenAuth struct {
+	tokens map[string]Identity
+}
+
+// NewTokenAuth reads the tokens of file, one "<token> <name> <role>"
+// per line.
+func NewTokenAuth(file string) (*TokenAuth, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]Identity{}
+	for _, fields := range lines {
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: line should be <token> <name> <role>", file)
+		}
+		if err := checkRole(file, fields[2]); err != nil {
+			return nil, err
+		}
+		tokens[fields[0]] = Identity{Name: fields[1], Role: fields[2]}
+	}
+	return &TokenAuth{tokens: tokens}, nil
+}
+
+func (t *TokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+
+	for candidate, identity := range t.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+			id := identity
+			return &id, nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+// BasicAuth authenticates http basic credentials against a htpasswd
+// file, with bcrypt (htpasswd -B) or sha1 (htpasswd -s) passwords.
+type BasicAuth struct {
+	users map[string]string
+	roles map[string]string
+}
+
+// NewBasicAuth reads the users of the htpasswd file, roles maps every
+// user name to its role.
+func NewBasicAuth(file string, roles map[string]string) (*BasicAuth, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]string{}
+	for _, fields := range lines {
+		parts := strings.SplitN(strings.Join(fields, ""), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: line should be <user>:<hash>", file)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s: user %s: only bcrypt and sha1 passwords are supported", file, parts[0])
+		}
+		users[parts[0]] = hash
+	}
+	return &BasicAuth{users: users, roles: roles}, nil
+}
+
+func (b *BasicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	hash, ok := b.users[user]
+	if !ok || !checkPassword(hash, password) {
+		return nil, ErrUnauthorized
+	}
+	return &Identity{Name: user, Role: b.roles[user]}, nil
+}
+
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.TrimPrefix(hash, "{SHA}"))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// CertAuth authenticates verified tls client certificates by their
+// common name.
+type CertAuth struct {
+	roles map[string]string
+}
+
+// NewCertAuth returns an authenticator of client certificates, roles
+// maps every common name to its role.
+func NewCertAuth(roles map[string]string) *CertAuth {
+	return &CertAuth{roles: roles}
+}
+
+func (c *CertAuth) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return &Identity{Name: name, Role: c.roles[name]}, nil
+}
+
+// authenticate wraps h to require a valid credential on every request
+// once authenticators are configured, and stores the identity of the
+// request for authorize.
+func (a *Api) authenticate(h http.Handler) http.Handler {
+	if len(a.auth) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, auth := range a.auth {
+			identity, err := auth.Authenticate(r)
+			if err != nil {
+				log.WithField("remote", r.RemoteAddr).Warnf("authentication failed: %v", err)
+				a.unauthorized(w)
+				return
+			}
+			if identity != nil {
+				context.Set(r, identityKey, identity)
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		a.unauthorized(w)
+	})
+}
+
+func (a *Api) unauthorized(w http.ResponseWriter) {
+	for _, auth := range a.auth {
+		if _, ok := auth.(*BasicAuth); ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="daolinet"`)
+			break
+		}
+	}
+	httpError(w, ErrUnauthorized)
+}
+
+// requestIdentity returns the identity of an authenticated request.
+func requestIdentity(r *http.Request) *Identity {
+	if identity, ok := context.Get(r, identityKey).(*Identity); ok {
+		return identity
+	}
+	return nil
+}
+
+// routeRoles are the roles required by routes, by method and route,
+// which differ from the defaults of routeRole.
+var routeRoles = map[string]string{
+	"GET /api/audit":                      RoleAdmin,
+	"POST /api/policy/evaluate":           RoleReadOnly,
+	"PUT /api/containers/{id}/reset":      RoleAdmin,
+	"POST /api/jobs/{id}/cancel":          RoleAdmin,
+	"POST /api/gateways/{id}/drain":       RoleAdmin,
+	"GET /containers/{name:.*}/attach/ws": RoleAdmin,
+	"GET /containers/{name:.*}/export":    RoleAdmin,
+}
+
+// routeRole returns the role required by method on route. Reading
+// is granted to every role, changing the daolinet networks requires
+// network-admin and changing the containers through the docker api
+// requires admin.
+func routeRole(method, route string) string {
+	if role, ok := routeRoles[method+" "+route]; ok {
+		return role
+	}
+	switch {
+	case method == "GET" || method == "OPTIONS":
+		return RoleReadOnly
+	case strings.HasPrefix(route, "/api/"):
+		return RoleNetworkAdmin
+	}
+	return RoleAdmin
+}
+
+// authorize wraps h to require role from the identity of the request.
+func (a *Api) authorize(role string, h http.HandlerFunc) http.HandlerFunc {
+	if len(a.auth) == 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := requestIdentity(r)
+		if identity == nil {
+			a.unauthorized(w)
+			return
+		}
+		if roleLevel[identity.Role] < roleLevel[role] {
+			log.WithFields(log.Fields{"user": identity.Name, "role": identity.Role}).Warnf("%s %s requires role %s", r.Method, r.URL.Path, role)
+			httpError(w, ErrForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -6,213 +6,163 @@ import (
     "io/ioutil"
     "net/http"
     "path"
-    "strconv"
     "strings"
 
     log "github.com/Sirupsen/logrus"
     "github.com/daolinet/daolinet/model"
+    "github.com/docker/libkv/store"
     "github.com/gorilla/mux"
-    "github.com/samalba/dockerclient"
 )
 
 
 func (a *Api) resetContainer(w http.ResponseWriter, r *http.Request) {
     if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request: %v", err))
 		return
     }
 
-    var data = map[string]string{}
+    var data model.ResetRequest
     if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        httpError(w, errInvalid("invalid request body: %v", err))
+        return
+    }
+    if data.Checkpoint && data.CheckpointDir == "" {
+        httpError(w, errInvalid("checkpointDir cannot be empty to checkpoint a container."))
         return
     }
 
-    node, ok := data["node"]
     oldId := mux.Vars(r)["id"]
 
     info, err := a.client.InspectContainer(oldId)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        httpError(w, err)
         return
     }
+    auditContainers(r, info.Id)
 
-    if info.State.Running {
-        err := a.client.StopContainer(info.Id, 5)
+    if err := validateStrategy(data.Strategy); err != nil {
+        httpError(w, err)
+        return
+    }
+    if data.Node != "" {
+        nodes, err := a.cordonedNodes()
         if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
+            httpError(w, err)
             return
         }
+        for _, node := range nodes {
+            if node == data.Node {
+                httpError(w, errInvalid("node %s is cordoned.", data.Node))
+                return
+            }
+        }
     }
 
-    err = a.client.RenameContainer(info.Id, info.Name + "old")
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    if data.Checkpoint && (info.State == nil || !info.State.Running) {
+        httpError(w, errInvalid("container %s is not running, it cannot be checkpointed.", oldId))
         return
     }
 
-    config := &dockerclient.ContainerConfig{}
-    config.Tty = info.Config.Tty
-    config.OpenStdin = info.Config.OpenStdin
-    config.Env = info.Config.Env
-    config.Cmd = info.Config.Cmd
-    config.Image = info.Config.Image
-
-    // Add swarm filters, only constraint node filter.
-    if ok {
-        if config.Env == nil {
-            config.Env = []string{}
-        }
-        swarmNode := fmt.Sprintf("constraint:node==%s", node)
-        config.Env = append(config.Env, swarmNode)
+    job, err := a.jobs.migrate(info, &data, nil)
+    if err != nil {
+        httpError(w, err)
+        return
     }
+    auditChange(r, nil, job)
 
-    netMode := info.HostConfig.NetworkMode
-    net := info.NetworkSettings.Networks[netMode]
-    if net != nil {
-        config.MacAddress = net.MacAddress
-        config.HostConfig = dockerclient.HostConfig{
-            NetworkMode: netMode,
-        }
-        endpointsConfig := map[string]*dockerclient.EndpointSettings {
-            netMode: &dockerclient.EndpointSettings{
-                IPAMConfig: &dockerclient.EndpointIPAMConfig {
-                   IPv4Address: net.IPAddress,
-                },
-                //IPAddress: net.IPAddress,
-                //MacAddress: net.MacAddress,
-            },
-        }
-
-        config.NetworkingConfig = dockerclient.NetworkingConfig{
-            EndpointsConfig: endpointsConfig,
+    // The migration runs as a job, clients accepting json get the job.
+    w.Header().Set("Location", path.Join("/api/jobs", job.Id))
+    if strings.Contains(r.Header.Get("Accept"), "application/json") {
+        w.Header().Set("content-type", "application/json")
+        w.WriteHeader(http.StatusAccepted)
+        if err := json.NewEncoder(w).Encode(job); err != nil {
+            log.Warnf("error encoding job %s: %v", job.Id, err)
         }
+        return
     }
 
-    // data, _ := json.Marshal(config)
-    // log.Warn(string(data))
-    hostConfig := &dockerclient.HostConfig{
-        NetworkMode: netMode,
-    }
-    newId, err := a.client.CreateContainer(config, info.Name, nil)
-    if err != nil {
-        err = a.client.RenameContainer(info.Id, info.Name)
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte(job.Id))
+}
 
-        err = a.client.StartContainer(info.Id, hostConfig)
-        if err != nil {
-           http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
+// resetContainerById moves the firewalls and policies of the container
+// oldId to newId, the moved policies are sent to the openflow
+// controller. It stops at the first error, leaving the entries moved so
+// far on newId.
+func (a *Api) resetContainerById(oldId , newId string) error {
+    // Reset old container firewall to new.
+    firewalls, err := a.store.List(pathNameFirewall)
+    if err != nil && err != store.ErrKeyNotFound {
+        return fmt.Errorf("error to get all firewalls: %v", err)
     }
-
-    go func() {
-        err = a.client.RemoveContainer(info.Id, true, false)
+    for _, fw := range firewalls {
+        var firewall model.Firewall
+        err := json.Unmarshal(fw.Value, &firewall)
         if err != nil {
-            log.Warnf("Remove container: %v", err)
+            log.Errorf("error unmarshal firewall: %v", err)
+            continue
         }
-
-        client := newClientAndScheme(a.client.TLSConfig)
-        url := fmt.Sprintf("%s/v1/containers/%s", a.ofcUrl, info.Id)
-        resp, err := client.Post(url, "application/json", nil)
+        if firewall.Container != oldId {
+            continue
+        }
+        firewall.Container = newId
+        value, err := json.Marshal(firewall)
         if err != nil {
-            log.Warnf("Remove container from openflow controller: %v", err)
+            return err
         }
-
-	if resp != nil && resp.Body != nil {
-            resp.Body.Close()
+        if err := a.store.Put(fw.Key, value, nil); err != nil {
+            return fmt.Errorf("error to update container firewall by name: %v", err)
         }
-    }()
-
-    go a.resetContainerById(info.Id, newId)
-
-    err = a.client.StartContainer(newId, hostConfig)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    w.Write([]byte(newId))
-}
-
-func (a *Api) resetContainerById(oldId , newId string) {
-    // Reset old container firewall to new.
-    firewalls, err := a.store.List(pathNameFirewall)
-    if err != nil {
-        log.Errorf("error to get all firewalls: %v", err)
-    } else {
-        for _, fw := range firewalls {
-            var firewall model.Firewall
-            err := json.Unmarshal(fw.Value, &firewall)
-            if err != nil {
-                log.Errorf("error unmarshal firewall: %v", err)
-                continue
-            }
-            if firewall.Container == oldId {
-                firewall.Container = newId
-                value, err := json.Marshal(firewall)
-                if err != nil {
-                    log.Errorf("json marshal error: %v", err)
-                    continue
-                }
-                if err := a.store.Put(fw.Key, value, nil); err != nil {
-                    log.Errorf("error to update container firewall by name: %v", err)
-                    continue
-                }
-                nodeurl := path.Join(pathNodeFirewall, firewall.DatapathID, strconv.Itoa(firewall.GatewayPort))
-                if err := a.store.Put(nodeurl, value, nil); err != nil {
-                    log.Errorf("error to update container firewall by node: %v", err)
-                    continue
-                }
-            }
+        nodeurl := firewallKey(&firewall)
+        if err := a.store.Put(nodeurl, value, nil); err != nil {
+            return fmt.Errorf("error to update container firewall by node: %v", err)
         }
     }
 
     // Reset old container policy to new.
     policies, err := a.store.List(pathPolicy)
-    if err != nil {
-        log.Errorf("error to get all policies : %v", err)
-    } else {
-        for _, policy := range policies {
-            peer := strings.Split(policy.Key, "/")
-            parts := strings.Split(peer[len(peer)-1], ":")
-            if len(parts) != 2 {
-                log.Error(ErrPolicyFormat.Error())
-                continue
-            }
-            if oldId == parts[0] || oldId == parts[1] {
-                if err := a.store.Delete(policy.Key); err != nil {
-                    log.Warnf("error deleting policy: %v", err)
-                }
-                if oldId == parts[0] {
-                    parts[0] = newId
-                } else {
-                    parts[1] = newId
-                }
-
-                var key string
-                if strings.Compare(parts[0], parts[1]) > 0 {
-                    key = fmt.Sprintf("%s:%s", parts[1], parts[0])
-                } else {
-                    key = fmt.Sprintf("%s:%s", parts[0], parts[1])
-                }
+    if err != nil && err != store.ErrKeyNotFound {
+        return fmt.Errorf("error to get all policies: %v", err)
+    }
+    for _, pair := range policies {
+        parts := strings.Split(path.Base(pair.Key), ":")
+        if len(parts) != 2 {
+            log.Error(ErrPolicyFormat.Error())
+            continue
+        }
+        if oldId != parts[0] && oldId != parts[1] {
+            continue
+        }
+        policy, err := parsePolicyValue(pair.Value)
+        if err != nil {
+            log.Errorf("error parsing policy %s: %v", pair.Key, err)
+            continue
+        }
 
-                if err := a.store.Put(path.Join(pathPolicy, key), policy.Value, nil); err != nil {
-                    log.Errorf("error to save policy: %v", err)
-                }
-            }
+        pid, qid := parts[0], parts[1]
+        if oldId == pid {
+            pid = newId
+        } else {
+            qid = newId
+        }
+        if strings.Compare(pid, qid) > 0 {
+            pid, qid = qid, pid
+        }
+        if err := a.putPolicy(pid, qid, policy); err != nil {
+            return fmt.Errorf("error to save policy: %v", err)
+        }
+        if err := a.removePolicy(parts[0], parts[1]); err != nil {
+            return err
         }
     }
+    return nil
 }
 
 func (a *Api) showContainer(w http.ResponseWriter, r *http.Request) {
     container := mux.Vars(r)["id"]
     info, err := a.client.InspectContainer(container)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        httpError(w, err)
         return
     }
 
@@ -239,25 +189,22 @@ func (a *Api) showContainer(w http.ResponseWriter, r *http.Request) {
         resp.Body.Close()
     }
     closeIdleConnections(client)
-    data := []map[string]string{}
+    data := []model.ContainerNetwork{}
     for key, value := range info.NetworkSettings.Networks {
-        newValue := map[string]string{}
-        newValue["Id"] = info.Id
-        newValue["NetworkName"] = key
-        ipAddress := fmt.Sprintf("%s/%d", value.IPAddress, value.IPPrefixLen)
-        newValue["IPAddress"] = ipAddress
-        newValue["MacAddress"] = value.MacAddress
-        newValue["Gateway"] = value.Gateway
-     
-        var vIP string = ""
+        newValue := model.ContainerNetwork{
+            Id:          info.Id,
+            NetworkName: key,
+            IPAddress:   fmt.Sprintf("%s/%d", value.IPAddress, value.IPPrefixLen),
+            MacAddress:  value.MacAddress,
+            Gateway:     value.Gateway,
+        }
         if value.MacAddress == ofResult["MacAddress"] {
-            vIP = ofResult["VIPAddress"]
+            newValue.VIPAddress = ofResult["VIPAddress"]
         }
-        newValue["VIPAddress"] = vIP
         data = append(data, newValue)
     }
     if err := json.NewEncoder(w).Encode(data); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        httpError(w, err)
         return
     }
 }
@@ -0,0 +1,675 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"gopkg.in/yaml.v2"
+)
+
+// state is the stored state of daolinet, policies are keyed by the
+// ids of their containers and firewalls by name.
+type state struct {
+	groups    map[string]map[string]bool
+	policies  map[string]*model.Policy
+	rules     map[string]model.PolicyRule
+	firewalls map[string]model.Firewall
+}
+
+// listKeys lists the base names of the children of dir, none if it
+// does not exist.
+func (a *Api) listKeys(dir string) ([]string, error) {
+	pairs, err := a.store.List(dir)
+	if err == store.ErrKeyNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, pair := range pairs {
+		if key := path.Base(pair.Key); key != path.Base(dir) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (a *Api) loadState() (*state, error) {
+	s := &state{
+		groups:    map[string]map[string]bool{},
+		policies:  map[string]*model.Policy{},
+		rules:     map[string]model.PolicyRule{},
+		firewalls: map[string]model.Firewall{},
+	}
+
+	groups, err := a.listKeys(pathGroup)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		members, err := a.listKeys(path.Join(pathGroup, group))
+		if err != nil {
+			return nil, err
+		}
+		s.groups[group] = map[string]bool{}
+		for _, member := range members {
+			s.groups[group][member] = true
+		}
+	}
+
+	policies, err := a.store.List(pathPolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	for _, pair := range policies {
+		policy, err := parsePolicyValue(pair.Value)
+		if err != nil {
+			log.Warnf("error parsing policy %s: %v", pair.Key, err)
+			continue
+		}
+		s.policies[path.Base(pair.Key)] = policy
+	}
+
+	rules, err := a.rules()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		s.rules[rule.Name] = rule
+	}
+
+	firewalls, err := a.store.List(pathNameFirewall)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	for _, pair := range firewalls {
+		var fw model.Firewall
+		if err := json.Unmarshal(pair.Value, &fw); err != nil {
+			log.Warnf("error unmarshal firewall %s: %v", pair.Key, err)
+			continue
+		}
+		s.firewalls[fw.Name] = fw
+	}
+	return s, nil
+}
+
+// containerNames returns the names of the containers by id.
+func (a *Api) containerNames() (map[string]string, error) {
+	containers, err := a.client.ListContainers(true, false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	for i := range containers {
+		names[containers[i].Id] = containerName(&containers[i])
+	}
+	return names, nil
+}
+
+// peerName returns the names of the containers of a policy key.
+func peerName(key string, names map[string]string) (string, bool) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 2 {
+		return "", false
+	}
+	p, ok := names[parts[0]]
+	if !ok {
+		return "", false
+	}
+	q, ok := names[parts[1]]
+	if !ok {
+		return "", false
+	}
+	return p + ":" + q, true
+}
+
+// document returns the state as a document, skipping the policies and
+// firewalls of containers which do not exist anymore.
+func (s *state) document(names map[string]string) *model.Document {
+	doc := &model.Document{
+		Version: model.DocumentVersion,
+		Groups:  map[string][]string{},
+	}
+
+	for group, members := range s.groups {
+		doc.Groups[group] = []string{}
+		for member := range members {
+			doc.Groups[group] = append(doc.Groups[group], member)
+		}
+		sort.Strings(doc.Groups[group])
+	}
+
+	for key, policy := range s.policies {
+		peer, ok := peerName(key, names)
+		if !ok {
+			log.Warnf("skipping policy %s of missing containers", key)
+			continue
+		}
+		doc.Policies = append(doc.Policies, model.DocumentPolicy{
+			Peer:   peer,
+			Action: policy.Action,
+			Ports:  policy.Ports,
+		})
+	}
+	sort.Sort(policiesByPeer(doc.Policies))
+
+	for _, rule := range s.rules {
+		doc.Rules = append(doc.Rules, rule)
+	}
+	sort.Sort(rulesByName(doc.Rules))
+
+	for _, fw := range s.firewalls {
+		name, ok := names[fw.Container]
+		if !ok {
+			log.Warnf("skipping firewall %s of missing container %s", fw.Name, fw.Container)
+			continue
+		}
+		fw.Container = name
+		doc.Firewalls = append(doc.Firewalls, fw)
+	}
+	sort.Sort(firewallsByName(doc.Firewalls))
+	return doc
+}
+
+// policiesByPeer sorts document policies by peer.
+type policiesByPeer []model.DocumentPolicy
+
+func (p policiesByPeer) Len() int           { return len(p) }
+func (p policiesByPeer) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p policiesByPeer) Less(i, j int) bool { return p[i].Peer < p[j].Peer }
+
+// firewallsByName sorts firewalls by name.
+type firewallsByName []model.Firewall
+
+func (f firewallsByName) Len() int           { return len(f) }
+func (f firewallsByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f firewallsByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+
+// desiredState resolves the container names of doc and validates it.
+func (a *Api) desiredState(doc *model.Document) (*state, map[string]string, error) {
+	if doc.Version != model.DocumentVersion {
+		return nil, nil, errInvalid("document version should be %s", model.DocumentVersion)
+	}
+
+	s := &state{
+		groups:    map[string]map[string]bool{},
+		policies:  map[string]*model.Policy{},
+		rules:     map[string]model.PolicyRule{},
+		firewalls: map[string]model.Firewall{},
+	}
+	// names of the policies by key, as written in doc.
+	names := map[string]string{}
+
+	for group, members := range doc.Groups {
+		if group == "" || strings.Contains(group, "/") {
+			return nil, nil, errInvalid("group name cannot be empty or contain a /")
+		}
+		s.groups[group] = map[string]bool{}
+		for _, member := range members {
+			if member == "" || strings.Contains(member, "/") {
+				return nil, nil, errInvalid("member of group %s cannot be empty or contain a /", group)
+			}
+			s.groups[group][member] = true
+		}
+	}
+
+	for _, p := range doc.Policies {
+		if p.Action != CONNECTED && p.Action != DISCONNECTED {
+			return nil, nil, errInvalid("action of policy %s should be %s or %s", p.Peer, CONNECTED, DISCONNECTED)
+		}
+		if err := validatePorts(p.Ports); err != nil {
+			return nil, nil, err
+		}
+		pInfo, qInfo, err := a.parsePolicy(strings.Split(p.Peer, ":"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy %s: %v", p.Peer, err)
+		}
+		key := pInfo.Id + ":" + qInfo.Id
+		if _, ok := s.policies[key]; ok {
+			return nil, nil, errInvalid("duplicate policy %s", p.Peer)
+		}
+		s.policies[key] = &model.Policy{Action: p.Action, Ports: p.Ports}
+		names[key] = p.Peer
+	}
+
+	for i := range doc.Rules {
+		rule := doc.Rules[i]
+		if err := validateRule(&rule); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := s.rules[rule.Name]; ok {
+			return nil, nil, errInvalid("duplicate rule %s", rule.Name)
+		}
+		s.rules[rule.Name] = rule
+	}
+
+	for _, fw := range doc.Firewalls {
+		if fw.Name == "" || fw.Container == "" {
+			return nil, nil, errInvalid("name or container of firewall cannot be empty.")
+		}
+		if _, ok := s.firewalls[fw.Name]; ok {
+			return nil, nil, errInvalid("duplicate firewall %s", fw.Name)
+		}
+		if err := validateFirewall(&fw); err != nil {
+			return nil, nil, errInvalid("firewall %s: %s", fw.Name, err)
+		}
+		info, err := a.client.InspectContainer(fw.Container)
+		if err != nil {
+			return nil, nil, fmt.Errorf("firewall %s: %v", fw.Name, err)
+		}
+		fw.Container = info.Id
+		s.firewalls[fw.Name] = fw
+	}
+	return s, names, nil
+}
+
+// applyStep is a change along with the function making it.
+type applyStep struct {
+	change model.Change
+	run    func() error
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]map[string]bool:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]bool:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*model.Policy:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]model.PolicyRule:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]model.Firewall:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// plan returns the steps reconciling current with desired. Resources
+// missing from desired are deleted only if prune is set.
+func (a *Api) plan(current, desired *state, names map[string]string, prune bool) ([]applyStep, error) {
+	steps := []applyStep{}
+	add := func(op, kind, name string, before, after interface{}, run func() error) {
+		steps = append(steps, applyStep{
+			change: model.Change{Op: op, Kind: kind, Name: name, Before: before, After: after},
+			run:    run,
+		})
+	}
+
+	for _, group := range sortedKeys(desired.groups) {
+		group := group
+		if _, ok := current.groups[group]; !ok {
+			add(model.OpCreate, model.KindGroup, group, nil, model.GroupRequest{Name: group}, func() error {
+				return a.store.PutTree(path.Join(pathGroup, group))
+			})
+		}
+		for _, member := range sortedKeys(desired.groups[group]) {
+			member := member
+			if current.groups[group][member] {
+				continue
+			}
+			add(model.OpCreate, model.KindMember, path.Join(group, member), nil, model.MemberRequest{Member: member}, func() error {
+				return a.store.PutTree(path.Join(pathGroup, group, member))
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(desired.rules) {
+		rule := desired.rules[name]
+		old, ok := current.rules[name]
+		switch {
+		case !ok:
+			add(model.OpCreate, model.KindRule, name, nil, rule, func() error {
+				return a.putRule(&rule)
+			})
+		case !equalJSON(old, rule):
+			add(model.OpUpdate, model.KindRule, name, old, rule, func() error {
+				return a.putRule(&rule)
+			})
+		}
+	}
+
+	for _, key := range sortedKeys(desired.policies) {
+		key := key
+		policy := desired.policies[key]
+		parts := strings.Split(key, ":")
+		run := func() error {
+			return a.putPolicy(parts[0], parts[1], policy)
+		}
+		old, ok := current.policies[key]
+		switch {
+		case !ok:
+			add(model.OpCreate, model.KindPolicy, names[key], nil, policy, run)
+		case !equalJSON(old, policy):
+			add(model.OpUpdate, model.KindPolicy, names[key], old, policy, run)
+		}
+	}
+
+	for _, name := range sortedKeys(desired.firewalls) {
+		fw := desired.firewalls[name]
+		old, ok := current.firewalls[name]
+		switch {
+		case !ok:
+			add(model.OpCreate, model.KindFirewall, name, nil, fw, func() error {
+				return a.createFirewall(&fw)
+			})
+		case !sameFirewall(&old, &fw):
+			add(model.OpUpdate, model.KindFirewall, name, old, fw, func() error {
+				// The firewall is replaced only if the new one is valid,
+				// the old one is put back if it cannot be created.
+				check := fw
+				check.Sources = append([]string{}, fw.Sources...)
+				if fw.GatewayPorts != nil {
+					ports := *fw.GatewayPorts
+					check.GatewayPorts = &ports
+				}
+				if fw.ServicePorts != nil {
+					ports := *fw.ServicePorts
+					check.ServicePorts = &ports
+				}
+				if err := validateFirewall(&check); err != nil {
+					return err
+				}
+				if err := a.removeFirewall(&old); err != nil {
+					return err
+				}
+				if err := a.createFirewall(&fw); err != nil {
+					if err := a.restoreFirewall(&old); err != nil {
+						log.Errorf("error restoring firewall %s: %v", old.Name, err)
+					}
+					return err
+				}
+				return nil
+			})
+		}
+	}
+
+	if !prune {
+		return steps, nil
+	}
+
+	for _, name := range sortedKeys(current.firewalls) {
+		fw := current.firewalls[name]
+		if _, ok := desired.firewalls[name]; !ok {
+			add(model.OpDelete, model.KindFirewall, name, fw, nil, func() error {
+				return a.removeFirewall(&fw)
+			})
+		}
+	}
+
+	if len(current.policies) > 0 {
+		containers, err := a.containerNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sortedKeys(current.policies) {
+			key := key
+			if _, ok := desired.policies[key]; ok {
+				continue
+			}
+			name, ok := peerName(key, containers)
+			if !ok {
+				name = key
+			}
+			add(model.OpDelete, model.KindPolicy, name, current.policies[key], nil, func() error {
+				ids := strings.SplitN(key, ":", 2)
+				if len(ids) != 2 {
+					return a.store.Delete(path.Join(pathPolicy, key))
+				}
+				return a.removePolicy(ids[0], ids[1])
+			})
+		}
+	}
+
+	for _, name := range sortedKeys(current.rules) {
+		name := name
+		if _, ok := desired.rules[name]; !ok {
+			add(model.OpDelete, model.KindRule, name, current.rules[name], nil, func() error {
+				return a.store.Delete(path.Join(pathRule, name))
+			})
+		}
+	}
+
+	for _, group := range sortedKeys(current.groups) {
+		group := group
+		members, ok := desired.groups[group]
+		if !ok {
+			add(model.OpDelete, model.KindGroup, group, model.GroupRequest{Name: group}, nil, func() error {
+				return a.store.DeleteTree(path.Join(pathGroup, group))
+			})
+			continue
+		}
+		for _, member := range sortedKeys(current.groups[group]) {
+			member := member
+			if members[member] {
+				continue
+			}
+			add(model.OpDelete, model.KindMember, path.Join(group, member), model.MemberRequest{Member: member}, nil, func() error {
+				return a.store.DeleteTree(path.Join(pathGroup, group, member))
+			})
+		}
+	}
+	return steps, nil
+}
+
+// sameFirewall reports whether two firewalls map the same ports of the
+// same container to the same sources, wherever their gateway.
+func sameFirewall(a, b *model.Firewall) bool {
+	return a.Container == b.Container && firewallProtocol(a) == firewallProtocol(b) &&
+		firewallPorts(a) == firewallPorts(b) && a.ServicePort == b.ServicePort &&
+		equalJSON(a.ServicePorts, b.ServicePorts) && equalJSON(a.Sources, b.Sources)
+}
+
+// equalJSON reports whether a and b encode to the same json.
+func equalJSON(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(x) == string(y)
+}
+
+// yamlToJSON converts a yaml document to json, so that documents
+// decode with the json names of their fields in both formats.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue replaces the maps decoded from yaml by maps of strings.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+func jsonToYAML(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// wantYAML reports whether the request asks for a yaml document, by
+// the format query parameter or else the given header.
+func wantYAML(r *http.Request, header string) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "yaml"
+	}
+	return strings.Contains(r.Header.Get(header), "yaml")
+}
+
+// exportDocument answers the state of daolinet as a document, in json
+// or yaml.
+func (a *Api) exportDocument(w http.ResponseWriter, r *http.Request) {
+	current, err := a.loadState()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	names, err := a.containerNames()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	data, err := json.MarshalIndent(current.document(names), "", "  ")
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	if wantYAML(r, "Accept") {
+		if data, err = jsonToYAML(data); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("content-type", "application/x-yaml")
+	} else {
+		w.Header().Set("content-type", "application/json")
+	}
+	w.Write(data)
+}
+
+func queryBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errInvalid("%s should be a boolean", name)
+	}
+	return b, nil
+}
+
+// applyDocument reconciles the state of daolinet with a json or yaml
+// document. Resources missing from the document are deleted with
+// prune, dryRun answers the changes without making them.
+func (a *Api) applyDocument(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := queryBool(r, "dryRun")
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	prune, err := queryBool(r, "prune")
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+	if wantYAML(r, "Content-Type") {
+		if data, err = yamlToJSON(data); err != nil {
+			httpError(w, errInvalid("invalid yaml document: %v", err))
+			return
+		}
+	}
+	var doc model.Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+
+	desired, names, err := a.desiredState(&doc)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	current, err := a.loadState()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	steps, err := a.plan(current, desired, names, prune)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	result := model.ApplyResult{DryRun: dryRun, Changes: []model.Change{}}
+	if dryRun {
+		for _, s := range steps {
+			result.Changes = append(result.Changes, s.change)
+		}
+	} else {
+		defer func() {
+			auditChange(r, nil, result.Changes)
+		}()
+		defer func() {
+			if len(result.Changes) == 0 {
+				return
+			}
+			if err := a.syncRules(); err != nil {
+				log.Errorf("error sending the rules to the openflow controller: %v", err)
+			}
+		}()
+		for _, s := range steps {
+			if err := s.run(); err != nil {
+				e := toRequestError(err)
+				httpError(w, &RequestError{
+					Status: e.Status,
+					Code:   e.Code,
+					Message: fmt.Sprintf("error applying %s of %s %s, after the %d changes in details: %s",
+						s.change.Op, s.change.Kind, s.change.Name, len(result.Changes), e.Message),
+					Details: result.Changes,
+				})
+				return
+			}
+			result.Changes = append(result.Changes, s.change)
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		httpError(w, err)
+		return
+	}
+}
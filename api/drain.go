@@ -0,0 +1,357 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const pathCordon = "daolinet/cordons"
+
+// networkDriver is the docker network driver of daolinet.
+const networkDriver = "daolinet"
+
+// drainConcurrency is the default number of containers a drain
+// migrates at once.
+const drainConcurrency = 2
+
+// cordons returns the cordoned gateways by datapath id.
+func (a *Api) cordons() (map[string]model.Cordon, error) {
+	pairs, err := a.store.List(pathCordon)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+
+	cordons := map[string]model.Cordon{}
+	for _, pair := range pairs {
+		var c model.Cordon
+		if err := json.Unmarshal(pair.Value, &c); err != nil {
+			log.Warnf("error unmarshal cordon %s: %v", pair.Key, err)
+			continue
+		}
+		cordons[c.Gateway] = c
+	}
+	return cordons, nil
+}
+
+// cordonedNodes returns the swarm nodes of the cordoned gateways.
+func (a *Api) cordonedNodes() ([]string, error) {
+	cordons, err := a.cordons()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, c := range cordons {
+		if c.Node != "" {
+			nodes = append(nodes, c.Node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func (a *Api) getGateway(id string) (*model.Gateway, error) {
+	pair, err := a.store.Get(path.Join(PathGateway, id))
+	if err == store.ErrKeyNotFound {
+		return nil, ErrGatewayDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var g model.Gateway
+	if err := json.Unmarshal(pair.Value, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// swarmNodes returns the names of the swarm nodes by the host of their
+// docker address, as listed in the driver status of the swarm info.
+func (a *Api) swarmNodes() (map[string]string, error) {
+	info, err := a.client.Info()
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[string]string{}
+	for _, status := range info.DriverStatus {
+		if len(status) != 2 {
+			continue
+		}
+		// The details of a node are listed under it, prefixed by └.
+		name := strings.TrimSpace(status[0])
+		if name == "" || strings.HasPrefix(name, "└") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(status[1])
+		if err != nil {
+			continue
+		}
+		nodes[host] = name
+	}
+	return nodes, nil
+}
+
+// nodeName returns the swarm node of a gateway, the node whose docker
+// address is on the address of the gateway, or else the host name of
+// the gateway which swarm names the nodes after by default.
+func (a *Api) nodeName(g *model.Gateway, nodes map[string]string) string {
+	host := g.Node
+	if h, _, err := net.SplitHostPort(g.Node); err == nil {
+		host = h
+	}
+	if name, ok := nodes[host]; ok {
+		return name
+	}
+	return g.HostName
+}
+
+// gatewayNode returns the swarm node of a gateway.
+func (a *Api) gatewayNode(g *model.Gateway) string {
+	nodes, err := a.swarmNodes()
+	if err != nil {
+		log.Warnf("error listing the swarm nodes: %v", err)
+	}
+	return a.nodeName(g, nodes)
+}
+
+// cordon marks the gateway as taking no new container, it keeps the
+// swarm node of the gateway for the constraints of the new containers.
+func (a *Api) cordon(g *model.Gateway) (*model.Cordon, error) {
+	c := &model.Cordon{Gateway: g.DatapathID, Node: a.gatewayNode(g), Time: time.Now().UTC()}
+	value, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.Put(path.Join(pathCordon, g.DatapathID), value, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// daolinetNetworks returns the names of the daolinet networks, with
+// and without the node swarm prefixes them with.
+func (a *Api) daolinetNetworks() (map[string]bool, error) {
+	networks, err := a.client.ListNetworks("")
+	if err != nil {
+		return nil, err
+	}
+	daolinet := map[string]bool{}
+	for _, n := range networks {
+		if n.Driver == networkDriver {
+			daolinet[n.Name] = true
+			daolinet[path.Base(n.Name)] = true
+		}
+	}
+	return daolinet, nil
+}
+
+// nodeContainers returns the containers of node attached to a daolinet
+// network, running or not.
+func (a *Api) nodeContainers(node string) ([]*dockerclient.ContainerInfo, error) {
+	daolinet, err := a.daolinetNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := a.client.ListContainers(true, false, "")
+	if err != nil {
+		return nil, err
+	}
+	infos := []*dockerclient.ContainerInfo{}
+	for i := range containers {
+		c := &containers[i]
+		if containerNode(c) != node {
+			continue
+		}
+		attached := false
+		for name := range c.NetworkSettings.Networks {
+			attached = attached || daolinet[name]
+		}
+		if !attached {
+			continue
+		}
+
+		info, err := a.client.InspectContainer(c.Id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// drainGateway cordons a gateway so that the containers of its node
+// move to other nodes, and starts the jobs migrating those attached to
+// daolinet networks, keeping their address and mac address. It answers
+// the jobs at once, at most Concurrency of them run at a time. Stopped
+// containers move without being started. The gateway stays cordoned
+// once drained.
+func (a *Api) drainGateway(w http.ResponseWriter, r *http.Request) {
+	var data model.DrainRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			httpError(w, errInvalid("invalid request body: %v", err))
+			return
+		}
+	}
+	if data.Concurrency < 0 {
+		httpError(w, errInvalid("concurrency cannot be negative."))
+		return
+	}
+	if data.Concurrency == 0 {
+		data.Concurrency = drainConcurrency
+	}
+	if data.Checkpoint && data.CheckpointDir == "" {
+		httpError(w, errInvalid("checkpointDir cannot be empty to checkpoint the containers."))
+		return
+	}
+	if err := validateStrategy(data.Strategy); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	g, err := a.getGateway(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	c, err := a.cordon(g)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	auditChange(r, nil, c)
+	containers, err := a.nodeContainers(c.Node)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	log.Infof("draining %d containers of gateway %s on node %s", len(containers), g.DatapathID, c.Node)
+
+	running := model.ResetRequest{Strategy: data.Strategy, Checkpoint: data.Checkpoint, CheckpointDir: data.CheckpointDir}
+	// The stopped containers cannot be checkpointed, they move stopped.
+	stopped := model.ResetRequest{Strategy: data.Strategy}
+	result := model.DrainResult{Gateway: g.DatapathID, Node: c.Node, Jobs: []model.Job{}}
+	slots := make(chan struct{}, data.Concurrency)
+	for _, info := range containers {
+		req := running
+		if info.State == nil || !info.State.Running {
+			req = stopped
+		}
+		auditContainers(r, info.Id)
+		job, err := a.jobs.migrate(info, &req, slots)
+		if err != nil {
+			result.Jobs = append(result.Jobs, model.Job{
+				Container: info.Id,
+				Name:      strings.TrimLeft(info.Name, "/"),
+				Request:   req,
+				Status:    model.StatusFailed,
+				Error:     err.Error(),
+			})
+			continue
+		}
+		result.Jobs = append(result.Jobs, *job)
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Warnf("error encoding the drain of gateway %s: %v", g.DatapathID, err)
+	}
+}
+
+// cordonGateway marks a gateway as taking no new container.
+func (a *Api) cordonGateway(w http.ResponseWriter, r *http.Request) {
+	g, err := a.getGateway(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	c, err := a.cordon(g)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	auditChange(r, nil, c)
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// uncordonGateway lets a cordoned gateway take new containers again.
+func (a *Api) uncordonGateway(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	cordons, err := a.cordons()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	c, ok := cordons[id]
+	if !ok {
+		if _, err := a.getGateway(id); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := a.store.Delete(path.Join(pathCordon, id)); err != nil {
+		httpError(w, err)
+		return
+	}
+	auditChange(r, c, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createContainer keeps the containers created through the docker api
+// off the nodes of the cordoned gateways.
+func (a *Api) createContainer(w http.ResponseWriter, r *http.Request) {
+	nodes, err := a.cordonedNodes()
+	if err != nil {
+		log.Warnf("error listing cordoned gateways: %v", err)
+	}
+	if len(nodes) == 0 {
+		a.swarmRedirect(w, r)
+		return
+	}
+
+	var config map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+	env, _ := config["Env"].([]interface{})
+	for _, node := range nodes {
+		env = append(env, "constraint:node!="+node)
+	}
+	config["Env"] = env
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	a.swarmRedirect(w, r)
+}
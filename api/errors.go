@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeInternal       = "internal_error"
+)
+
+// RequestError is an error carrying its own http status and code.
+type RequestError struct {
+	Status  int
+	Code    string
+	Message string
+	Details interface{}
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// errInvalid returns a 400 error for a malformed or invalid request.
+func errInvalid(format string, args ...interface{}) error {
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidRequest,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// sentinel errors of the api and the status they are reported with.
+var errorStatus = map[error]int{
+	ErrPolicyConflict:        http.StatusBadRequest,
+	ErrPolicyFormat:          http.StatusBadRequest,
+	ErrUnauthorized:          http.StatusUnauthorized,
+	ErrForbidden:             http.StatusForbidden,
+	ErrGroupDoesNotExist:     http.StatusNotFound,
+	ErrPolicyDoesNotExist:    http.StatusNotFound,
+	ErrRuleDoesNotExist:      http.StatusNotFound,
+	ErrGatewayDoesNotExist:   http.StatusNotFound,
+	ErrJobDoesNotExist:       http.StatusNotFound,
+	store.ErrKeyNotFound:     http.StatusNotFound,
+	dockerclient.ErrNotFound: http.StatusNotFound,
+	ErrGroupExists:           http.StatusConflict,
+	ErrFirewallNameExists:    http.StatusConflict,
+	ErrFirewallPortExists:    http.StatusConflict,
+	ErrRuleExists:            http.StatusConflict,
+	ErrJobFinished:           http.StatusConflict,
+	ErrNoPlacement:           http.StatusConflict,
+}
+
+var statusCode = map[int]string{
+	http.StatusBadRequest:   CodeInvalidRequest,
+	http.StatusUnauthorized: CodeUnauthorized,
+	http.StatusForbidden:    CodeForbidden,
+	http.StatusNotFound:     CodeNotFound,
+	http.StatusConflict:     CodeConflict,
+}
+
+// toRequestError maps err to the status and code it is reported with.
+func toRequestError(err error) *RequestError {
+	switch e := err.(type) {
+	case *RequestError:
+		return e
+	case dockerclient.Error:
+		// Forward client errors of docker, server errors are ours.
+		if e.StatusCode >= 400 && e.StatusCode < 500 {
+			code, ok := statusCode[e.StatusCode]
+			if !ok {
+				code = CodeInvalidRequest
+			}
+			return &RequestError{Status: e.StatusCode, Code: code, Message: e.Error()}
+		}
+	}
+
+	if status, ok := errorStatus[err]; ok {
+		return &RequestError{Status: status, Code: statusCode[status], Message: err.Error()}
+	}
+	return &RequestError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: err.Error()}
+}
+
+// httpError writes err as a json error body with its http status.
+func httpError(w http.ResponseWriter, err error) {
+	e := toRequestError(err)
+	if e.Status >= http.StatusInternalServerError {
+		log.Error(err)
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(model.Error{
+		Code:    e.Code,
+		Message: e.Message,
+		Details: e.Details,
+	})
+}
+
+// errDocker returns the error for a failed docker response.
+func errDocker(status int, body string) error {
+	if code, ok := statusCode[status]; ok {
+		return &RequestError{Status: status, Code: code, Message: body}
+	}
+	return fmt.Errorf("docker: %d: %s", status, body)
+}
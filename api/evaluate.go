@@ -0,0 +1,298 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/samalba/dockerclient"
+)
+
+// portAction returns the action of the traffic of protocol to port
+// given the ports of a policy, action if none of them matches. Port
+// ranges never match an unknown port.
+func portAction(action string, ports []model.PolicyPort, protocol string, port int) string {
+	if protocol == "" {
+		return action
+	}
+	for _, p := range ports {
+		if p.Protocol != protocol {
+			continue
+		}
+		if len(p.Ports) == 0 {
+			return p.Action
+		}
+		for _, r := range p.Ports {
+			if port != 0 && port >= r.From && port <= r.To {
+				return p.Action
+			}
+		}
+	}
+	return action
+}
+
+// listContainer turns inspected container info into a container as
+// listed by docker, to match it against selectors.
+func listContainer(info *dockerclient.ContainerInfo) *dockerclient.Container {
+	c := &dockerclient.Container{Id: info.Id, Names: []string{info.Name}}
+	if info.Config != nil {
+		c.Labels = info.Config.Labels
+	}
+	c.NetworkSettings.Networks = map[string]dockerclient.EndpointSettings{}
+	for name, endpoint := range info.NetworkSettings.Networks {
+		if endpoint != nil {
+			c.NetworkSettings.Networks[name] = *endpoint
+		}
+	}
+	return c
+}
+
+func subnet(endpoint *dockerclient.EndpointSettings) string {
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", endpoint.IPAddress, endpoint.IPPrefixLen))
+	if err != nil {
+		return endpoint.IPAddress
+	}
+	return ipnet.String()
+}
+
+func sortedNetworks(info *dockerclient.ContainerInfo) []string {
+	networks := []string{}
+	for name := range info.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// evaluate returns the action of the traffic from src to dst along
+// with the steps leading to it. The policy set on the pair of
+// containers overrides the rules, the rules override the groups and the
+// groups connect the containers of different subnets.
+func (a *Api) evaluate(src, dst *dockerclient.ContainerInfo, protocol string, port int) (*model.Evaluation, error) {
+	e := &model.Evaluation{
+		Source:          src.Id,
+		SourceName:      strings.TrimLeft(src.Name, "/"),
+		Destination:     dst.Id,
+		DestinationName: strings.TrimLeft(dst.Name, "/"),
+		Protocol:        protocol,
+		Port:            port,
+		Trace:           []model.EvaluateStep{},
+	}
+	applied := -1
+	step := func(s model.EvaluateStep) int {
+		e.Trace = append(e.Trace, s)
+		return len(e.Trace) - 1
+	}
+
+	// Explicit policy of the pair of containers.
+	pid, qid := src.Id, dst.Id
+	if pid > qid {
+		pid, qid = qid, pid
+	}
+	key := pid + ":" + qid
+	pair, err := a.store.Get(path.Join(pathPolicy, key))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	if err == nil {
+		policy, err := parsePolicyValue(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		applied = step(model.EvaluateStep{
+			Step:   model.StepPolicy,
+			Name:   key,
+			Detail: fmt.Sprintf("policy between %s and %s", e.SourceName, e.DestinationName),
+			Action: portAction(policy.Action, policy.Ports, protocol, port),
+		})
+	}
+
+	// Rules selecting the containers, the one of highest priority wins.
+	rules, err := a.rules()
+	if err != nil {
+		return nil, err
+	}
+	sc, dc := listContainer(src), listContainer(dst)
+	winner := -1
+	for i := range rules {
+		rule := &rules[i]
+		if !matchRule(rule, sc, dc) {
+			continue
+		}
+		s := step(model.EvaluateStep{
+			Step:   model.StepRule,
+			Name:   rule.Name,
+			Detail: fmt.Sprintf("%s rule of priority %d", rule.Direction, rule.Priority),
+			Action: portAction(rule.Action, rule.Ports, protocol, port),
+		})
+		if winner < 0 || rule.Priority > rules[winner].Priority ||
+			(rule.Priority == rules[winner].Priority && rule.Action == DISCONNECTED && rules[winner].Action != DISCONNECTED) {
+			winner = i
+			if applied < 0 || e.Trace[applied].Step == model.StepRule {
+				applied = s
+			}
+		}
+	}
+
+	// Groups connecting a network of each container.
+	groups, err := a.store.List(pathGroup)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	srcNetworks, dstNetworks := sortedNetworks(src), sortedNetworks(dst)
+	for _, group := range groups {
+		name := path.Base(group.Key)
+		members, err := a.store.List(path.Join(pathGroup, name))
+		if err != nil {
+			log.Warnf("error listing members of group %s: %v", name, err)
+			continue
+		}
+		isMember := map[string]bool{}
+		for _, member := range members {
+			isMember[path.Base(member.Key)] = true
+		}
+		for _, sn := range srcNetworks {
+			for _, dn := range dstNetworks {
+				if sn == dn || !isMember[sn] || !isMember[dn] {
+					continue
+				}
+				s := step(model.EvaluateStep{
+					Step:   model.StepGroup,
+					Name:   name,
+					Detail: fmt.Sprintf("networks %s and %s are members of group %s", sn, dn, name),
+					Action: CONNECTED,
+				})
+				if applied < 0 {
+					applied = s
+				}
+			}
+		}
+	}
+
+	// Default of the subnets, only containers of a same subnet connect.
+	same := false
+	for _, sn := range srcNetworks {
+		if _, ok := dst.NetworkSettings.Networks[sn]; !ok {
+			continue
+		}
+		same = true
+		s := step(model.EvaluateStep{
+			Step:   model.StepSubnet,
+			Name:   sn,
+			Detail: fmt.Sprintf("both containers are in subnet %s", subnet(src.NetworkSettings.Networks[sn])),
+			Action: CONNECTED,
+		})
+		if applied < 0 {
+			applied = s
+		}
+	}
+	if !same {
+		s := step(model.EvaluateStep{
+			Step:   model.StepSubnet,
+			Detail: "containers are in different subnets",
+			Action: DISCONNECTED,
+		})
+		if applied < 0 {
+			applied = s
+		}
+	}
+
+	// Firewalls exposing the destination, they do not decide the
+	// traffic between containers.
+	firewalls, err := a.store.List(pathNameFirewall)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	for _, firewall := range firewalls {
+		var fw model.Firewall
+		if err := json.Unmarshal(firewall.Value, &fw); err != nil {
+			continue
+		}
+		if fw.Container != dst.Id || (protocol != "" && firewallProtocol(&fw) != protocol) {
+			continue
+		}
+		service := model.PortRange{From: fw.ServicePort, To: fw.ServicePort}
+		if fw.ServicePorts != nil {
+			service = *fw.ServicePorts
+		}
+		if port != 0 && (port < service.From || port > service.To) {
+			continue
+		}
+		gateway := firewallPorts(&fw)
+		detail := fmt.Sprintf("gateway %s:%d maps to %s port %d of %s", fw.GatewayIP, gateway.From, firewallProtocol(&fw), service.From, e.DestinationName)
+		if gateway.To != gateway.From {
+			detail = fmt.Sprintf("gateway %s:%d-%d maps to %s ports %d-%d of %s", fw.GatewayIP, gateway.From, gateway.To, firewallProtocol(&fw), service.From, service.To, e.DestinationName)
+		}
+		if len(fw.Sources) > 0 {
+			detail += " from " + strings.Join(fw.Sources, ", ")
+		}
+		step(model.EvaluateStep{
+			Step:   model.StepFirewall,
+			Name:   fw.Name,
+			Detail: detail,
+		})
+	}
+
+	e.Trace[applied].Applied = true
+	e.Action = e.Trace[applied].Action
+	return e, nil
+}
+
+// evaluatePolicy answers whether a container can talk to another, with
+// the trace of the policies leading to the decision. Nothing is changed.
+func (a *Api) evaluatePolicy(w http.ResponseWriter, r *http.Request) {
+	var data model.EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+	if data.Source == "" || data.Destination == "" {
+		httpError(w, errInvalid("source or destination cannot be empty."))
+		return
+	}
+	switch data.Protocol {
+	case "", model.ProtocolTCP, model.ProtocolUDP, model.ProtocolICMP:
+	default:
+		httpError(w, errInvalid("protocol should be %s, %s or %s",
+			model.ProtocolTCP, model.ProtocolUDP, model.ProtocolICMP))
+		return
+	}
+	if data.Port < 0 || data.Port > 65535 || (data.Port != 0 && data.Protocol == "") {
+		httpError(w, errInvalid("port should be between 1 and 65535 along with a protocol"))
+		return
+	}
+
+	src, err := a.client.InspectContainer(data.Source)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	dst, err := a.client.InspectContainer(data.Destination)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if src.Id == dst.Id {
+		httpError(w, ErrPolicyConflict)
+		return
+	}
+
+	e, err := a.evaluate(src, dst, data.Protocol, data.Port)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		httpError(w, err)
+		return
+	}
+}
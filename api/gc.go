@@ -0,0 +1,298 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/samalba/dockerclient"
+)
+
+// orphans cross-checks the policies, firewalls and group members of
+// the store against the containers and networks of swarm. The state of
+// the containers waiting to be bound again is not reported.
+func (a *Api) orphans() ([]model.Orphan, error) {
+	containers, err := a.client.ListContainers(true, false, "")
+	if err != nil {
+		return nil, err
+	}
+	networks, err := a.client.ListNetworks("")
+	if err != nil {
+		return nil, err
+	}
+
+	live := map[string]bool{}
+	for _, c := range containers {
+		live[c.Id] = true
+	}
+	gone := func(id string) bool {
+		return !live[id] && (a.index == nil || !a.index.pending(id))
+	}
+	exists := map[string]bool{}
+	for _, n := range networks {
+		exists[n.Name] = true
+		exists[path.Base(n.Name)] = true
+	}
+
+	orphans := []model.Orphan{}
+
+	policies, err := a.store.List(pathPolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	for _, policy := range policies {
+		parts := strings.Split(path.Base(policy.Key), ":")
+		if len(parts) != 2 {
+			orphans = append(orphans, model.Orphan{Kind: model.KindPolicy, Key: policy.Key, Reason: ErrPolicyFormat.Error()})
+			continue
+		}
+		for _, id := range parts {
+			if gone(id) {
+				orphans = append(orphans, model.Orphan{
+					Kind:   model.KindPolicy,
+					Key:    policy.Key,
+					Reason: fmt.Sprintf("container %s does not exist", id),
+				})
+				break
+			}
+		}
+	}
+
+	firewalls, err := a.store.List(pathNameFirewall)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, pair := range firewalls {
+		var fw model.Firewall
+		if err := json.Unmarshal(pair.Value, &fw); err != nil {
+			continue
+		}
+		// The gateway port of an orphan firewall goes along with it.
+		names[fw.Name] = true
+		if gone(fw.Container) {
+			orphans = append(orphans, model.Orphan{
+				Kind:   model.KindFirewall,
+				Key:    pair.Key,
+				Reason: fmt.Sprintf("container %s does not exist", fw.Container),
+			})
+		}
+	}
+
+	nodes, err := a.listKeys(pathNodeFirewall)
+	if err != nil {
+		return nil, err
+	}
+	ports := []*store.KVPair{}
+	for _, node := range nodes {
+		protocols, err := a.listKeys(path.Join(pathNodeFirewall, node))
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			pairs, err := a.store.List(path.Join(pathNodeFirewall, node, protocol))
+			if err != nil && err != store.ErrKeyNotFound {
+				return nil, err
+			}
+			ports = append(ports, pairs...)
+		}
+	}
+	for _, pair := range ports {
+		var fw model.Firewall
+		if err := json.Unmarshal(pair.Value, &fw); err != nil {
+			continue
+		}
+		if !names[fw.Name] {
+			orphans = append(orphans, model.Orphan{
+				Kind:   model.KindFirewall,
+				Key:    pair.Key,
+				Reason: fmt.Sprintf("firewall %s does not exist", fw.Name),
+			})
+		}
+	}
+
+	groups, err := a.listKeys(pathGroup)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		members, err := a.listKeys(path.Join(pathGroup, group))
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if !exists[member] {
+				orphans = append(orphans, model.Orphan{
+					Kind:   model.KindMember,
+					Key:    path.Join(pathGroup, group, member),
+					Reason: fmt.Sprintf("network %s does not exist", member),
+				})
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// errNotOrphan is returned by deleteOrphan when the container, network
+// or firewall of an entry was created after the orphans were listed.
+var errNotOrphan = errors.New("not an orphan anymore")
+
+// containerGone checks again that the container id does not exist
+// before its state is deleted.
+func (a *Api) containerGone(id string) error {
+	if a.index != nil && a.index.pending(id) {
+		return errNotOrphan
+	}
+	_, err := a.client.InspectContainer(id)
+	if err == dockerclient.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errNotOrphan
+}
+
+// deleteOrphan deletes an orphan entry, along with the gateway port of
+// an orphan firewall. The entry is checked again first, so that the
+// state of a container created since the orphans were listed is kept.
+func (a *Api) deleteOrphan(o *model.Orphan) error {
+	switch {
+	case o.Kind == model.KindMember:
+		_, err := a.client.InspectNetwork(path.Base(o.Key))
+		if err == nil {
+			return errNotOrphan
+		}
+		if err != dockerclient.ErrNotFound {
+			return err
+		}
+		return a.store.DeleteTree(o.Key)
+	case o.Kind == model.KindPolicy:
+		ids := strings.Split(path.Base(o.Key), ":")
+		if len(ids) != 2 {
+			return a.store.Delete(o.Key)
+		}
+		err := a.containerGone(ids[0])
+		if err == errNotOrphan {
+			err = a.containerGone(ids[1])
+		}
+		if err != nil {
+			return err
+		}
+		return a.removePolicy(ids[0], ids[1])
+	case o.Kind == model.KindFirewall:
+		pair, err := a.store.Get(o.Key)
+		if err != nil {
+			return err
+		}
+		var fw model.Firewall
+		if err := json.Unmarshal(pair.Value, &fw); err != nil {
+			return a.store.Delete(o.Key)
+		}
+		if strings.HasPrefix(o.Key, pathNameFirewall) {
+			if err := a.containerGone(fw.Container); err != nil {
+				return err
+			}
+			return a.removeFirewall(&fw)
+		}
+		exists, err := a.store.Exists(path.Join(pathNameFirewall, fw.Name))
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errNotOrphan
+		}
+	}
+	return a.store.Delete(o.Key)
+}
+
+// collectGarbage deletes the orphans and returns those deleted.
+func (a *Api) collectGarbage() ([]model.Orphan, error) {
+	orphans, err := a.orphans()
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []model.Orphan{}
+	for i := range orphans {
+		err := a.deleteOrphan(&orphans[i])
+		if err == errNotOrphan {
+			log.Debugf("keeping %s: %v", orphans[i].Key, err)
+			continue
+		}
+		if err != nil && err != store.ErrKeyNotFound {
+			log.Warnf("error deleting orphan %s: %v", orphans[i].Key, err)
+			continue
+		}
+		deleted = append(deleted, orphans[i])
+	}
+	return deleted, nil
+}
+
+// runGC looks for orphans every interval, deleting them if autoDelete
+// is set and only reporting them otherwise.
+func (a *Api) runGC(interval time.Duration, autoDelete bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if autoDelete {
+			deleted, err := a.collectGarbage()
+			if err != nil {
+				log.Errorf("error collecting orphans: %v", err)
+				continue
+			}
+			for _, o := range deleted {
+				log.Infof("deleted orphan %s: %s", o.Key, o.Reason)
+			}
+			continue
+		}
+
+		orphans, err := a.orphans()
+		if err != nil {
+			log.Errorf("error looking for orphans: %v", err)
+			continue
+		}
+		if len(orphans) > 0 {
+			log.Warnf("%d orphan entries in the store, see GET /api/gc", len(orphans))
+		}
+	}
+}
+
+// gcReport answers the orphans without deleting them.
+func (a *Api) gcReport(w http.ResponseWriter, r *http.Request) {
+	orphans, err := a.orphans()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(orphans); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// gcCollect deletes the orphans and answers those deleted.
+func (a *Api) gcCollect(w http.ResponseWriter, r *http.Request) {
+	deleted, err := a.collectGarbage()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	auditChange(r, deleted, nil)
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(deleted); err != nil {
+		httpError(w, err)
+		return
+	}
+}
@@ -16,6 +16,32 @@ import (
 	"github.com/samalba/dockerclient"
 )
 
+// copyTLSConfig returns a copy of the exported settings of c, which
+// can be changed without affecting the connections using c.
+func copyTLSConfig(c *tls.Config) *tls.Config {
+	return &tls.Config{
+		Rand:                     c.Rand,
+		Time:                     c.Time,
+		Certificates:             c.Certificates,
+		NameToCertificate:        c.NameToCertificate,
+		GetCertificate:           c.GetCertificate,
+		RootCAs:                  c.RootCAs,
+		NextProtos:               c.NextProtos,
+		ServerName:               c.ServerName,
+		ClientAuth:               c.ClientAuth,
+		ClientCAs:                c.ClientCAs,
+		InsecureSkipVerify:       c.InsecureSkipVerify,
+		CipherSuites:             c.CipherSuites,
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+		SessionTicketsDisabled:   c.SessionTicketsDisabled,
+		SessionTicketKey:         c.SessionTicketKey,
+		ClientSessionCache:       c.ClientSessionCache,
+		MinVersion:               c.MinVersion,
+		MaxVersion:               c.MaxVersion,
+		CurvePreferences:         c.CurvePreferences,
+	}
+}
+
 func (a *Api) swarmHijack(tlsConfig *tls.Config, addr string, w http.ResponseWriter, r *http.Request) error {
 	if parts := strings.SplitN(addr, "://", 2); len(parts) == 2 {
 		addr = parts[1]
@@ -98,7 +124,8 @@ func (a *Api) hijack(addr, method, path string, setRawTerminal bool, in io.ReadC
 		execTLSConfig = a.client.TLSConfig
 	)
 
-	if a.allowInsecure {
+	if execTLSConfig != nil && a.allowInsecure {
+		execTLSConfig = copyTLSConfig(execTLSConfig)
 		execTLSConfig.InsecureSkipVerify = true
 	}
 
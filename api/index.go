@@ -0,0 +1,331 @@
+package api
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/samalba/dockerclient"
+)
+
+const pathBinding = "daolinet/containers"
+
+// LabelIdentity is the label naming the identity of a container, its
+// name is used if it is not set. The policies and firewalls of a
+// destroyed container are bound to the next container of the same
+// identity.
+const LabelIdentity = "daolinet.identity"
+
+const (
+	// orphanGrace is how long the policies and firewalls of a destroyed
+	// container wait for a container of the same identity.
+	orphanGrace = 5 * time.Minute
+	// eventsRetry is the delay before following the events again once
+	// the stream is broken.
+	eventsRetry = 5 * time.Second
+)
+
+func identityOf(info *dockerclient.ContainerInfo) string {
+	if info.Config != nil {
+		if identity := info.Config.Labels[LabelIdentity]; identity != "" {
+			return identity
+		}
+	}
+	return strings.TrimLeft(info.Name, "/")
+}
+
+// containerIndex maps the identities of the containers, their label or
+// name, to their ids by following the docker events of swarm. It binds
+// the stored state of a destroyed container to the container coming
+// back with the same identity, and deletes it after orphanGrace.
+type containerIndex struct {
+	sync.Mutex
+	a          *Api
+	bindings   map[string]*model.Binding
+	identities map[string]string
+	orphans    map[string]*time.Timer
+	// moving are the destroyed containers whose state is being bound
+	// to another container.
+	moving map[string]bool
+}
+
+func newContainerIndex(a *Api) *containerIndex {
+	return &containerIndex{
+		a:          a,
+		bindings:   map[string]*model.Binding{},
+		identities: map[string]string{},
+		orphans:    map[string]*time.Timer{},
+		moving:     map[string]bool{},
+	}
+}
+
+func (x *containerIndex) save(b *model.Binding) {
+	value, err := json.Marshal(b)
+	if err != nil {
+		log.Errorf("error marshal binding of %s: %v", b.Id, err)
+		return
+	}
+	if err := x.a.store.Put(path.Join(pathBinding, b.Id), value, nil); err != nil {
+		log.Errorf("error saving binding of %s: %v", b.Id, err)
+	}
+}
+
+// pending reports whether the state of the destroyed container id
+// still waits for a container of the same identity, or is being bound
+// to it.
+func (x *containerIndex) pending(id string) bool {
+	x.Lock()
+	defer x.Unlock()
+	_, ok := x.orphans[id]
+	return ok || x.moving[id]
+}
+
+// sync rebuilds the index from the containers of swarm and the stored
+// bindings, the containers destroyed meanwhile become orphans.
+func (x *containerIndex) sync() error {
+	containers, err := x.a.client.ListContainers(true, false, "")
+	if err != nil {
+		return err
+	}
+
+	stored := map[string]*model.Binding{}
+	pairs, err := x.a.store.List(pathBinding)
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	for _, pair := range pairs {
+		var b model.Binding
+		if err := json.Unmarshal(pair.Value, &b); err != nil || b.Id == "" {
+			continue
+		}
+		stored[b.Id] = &b
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	x.identities = map[string]string{}
+	for _, c := range containers {
+		info, err := x.a.client.InspectContainer(c.Id)
+		if err != nil {
+			log.Warnf("error inspecting container %s: %v", c.Id, err)
+			continue
+		}
+		if old, ok := stored[info.Id]; !ok || old.Identity != identityOf(info) || !old.Removed.IsZero() {
+			x.add(info)
+		} else {
+			x.bindings[info.Id] = old
+			x.identities[old.Identity] = info.Id
+		}
+		delete(stored, info.Id)
+	}
+
+	for _, b := range stored {
+		if _, ok := x.bindings[b.Id]; !ok {
+			x.bindings[b.Id] = b
+		}
+		x.remove(b.Id)
+	}
+	return nil
+}
+
+// add indexes a created, started or renamed container and binds to it
+// the state of the destroyed containers of its identity.
+func (x *containerIndex) add(info *dockerclient.ContainerInfo) {
+	b := &model.Binding{
+		Id:       info.Id,
+		Name:     strings.TrimLeft(info.Name, "/"),
+		Identity: identityOf(info),
+	}
+	if old, ok := x.bindings[b.Id]; ok && old.Identity != b.Identity && x.identities[old.Identity] == b.Id {
+		delete(x.identities, old.Identity)
+	}
+	x.bindings[b.Id] = b
+	x.identities[b.Identity] = b.Id
+	x.save(b)
+
+	for id, orphan := range x.bindings {
+		if id != b.Id && !orphan.Removed.IsZero() && orphan.Identity == b.Identity {
+			x.rebind(id, b.Id)
+		}
+	}
+}
+
+// remove marks a container destroyed, its state is bound to the live
+// container of its identity if any, or else waits for one.
+func (x *containerIndex) remove(id string) {
+	b, ok := x.bindings[id]
+	if !ok {
+		return
+	}
+	if b.Removed.IsZero() {
+		b.Removed = time.Now().UTC()
+		x.save(b)
+	}
+	if x.identities[b.Identity] == id {
+		delete(x.identities, b.Identity)
+	}
+
+	if live, ok := x.identities[b.Identity]; ok {
+		x.rebind(id, live)
+		return
+	}
+	if _, ok := x.orphans[id]; !ok {
+		wait := orphanGrace - time.Since(b.Removed)
+		x.orphans[id] = time.AfterFunc(wait, func() {
+			x.collect(id)
+		})
+	}
+}
+
+// rebind moves the policies and firewalls of the destroyed container
+// oldId to newId. They move in the background, the index is not locked
+// while the store and the openflow controller are updated.
+func (x *containerIndex) rebind(oldId, newId string) {
+	log.Infof("binding the state of container %s to %s", oldId, newId)
+	if timer, ok := x.orphans[oldId]; ok {
+		timer.Stop()
+		delete(x.orphans, oldId)
+	}
+	x.forget(oldId)
+	x.moving[oldId] = true
+
+	go func() {
+		if err := x.a.resetContainerById(oldId, newId); err != nil {
+			log.Errorf("error binding the state of container %s to %s: %v", oldId, newId, err)
+		}
+		x.Lock()
+		delete(x.moving, oldId)
+		x.Unlock()
+	}()
+}
+
+func (x *containerIndex) forget(id string) {
+	delete(x.bindings, id)
+	if err := x.a.store.Delete(path.Join(pathBinding, id)); err != nil && err != store.ErrKeyNotFound {
+		log.Warnf("error deleting binding of %s: %v", id, err)
+	}
+}
+
+// collect deletes the state of a container destroyed for orphanGrace.
+func (x *containerIndex) collect(id string) {
+	x.Lock()
+	delete(x.orphans, id)
+	b, ok := x.bindings[id]
+	if !ok || b.Removed.IsZero() {
+		x.Unlock()
+		return
+	}
+	x.forget(id)
+	x.Unlock()
+
+	log.Infof("deleting the state of container %s (%s) destroyed at %s", b.Name, id, b.Removed)
+	x.a.deleteContainerState(id)
+}
+
+// handle updates the index on a container event.
+func (x *containerIndex) handle(e *dockerclient.Event) {
+	if e.Type != "" && e.Type != "container" {
+		return
+	}
+	action, id := e.Action, e.Actor.ID
+	if action == "" {
+		action = e.Status
+	}
+	if id == "" {
+		id = e.ID
+	}
+
+	switch action {
+	case "create", "start", "rename":
+		info, err := x.a.client.InspectContainer(id)
+		if err != nil {
+			log.Warnf("error inspecting container %s: %v", id, err)
+			return
+		}
+		x.Lock()
+		x.add(info)
+		x.Unlock()
+	case "destroy":
+		x.Lock()
+		x.remove(id)
+		x.Unlock()
+	default:
+		return
+	}
+	x.syncRules()
+}
+
+// syncRules sends the policies the rules give to the containers to the
+// openflow controller.
+func (x *containerIndex) syncRules() {
+	if err := x.a.syncRules(); err != nil {
+		log.Errorf("error sending the rules to the openflow controller: %v", err)
+	}
+}
+
+// follow keeps the index up to date with the events of swarm, syncing
+// it again whenever the stream of events breaks.
+func (x *containerIndex) follow() {
+	for {
+		if err := x.sync(); err != nil {
+			log.Errorf("error indexing containers: %v", err)
+			time.Sleep(eventsRetry)
+			continue
+		}
+		x.syncRules()
+
+		events, err := x.a.client.MonitorEvents(nil, nil)
+		if err != nil {
+			log.Errorf("error following swarm events: %v", err)
+			time.Sleep(eventsRetry)
+			continue
+		}
+		for e := range events {
+			if e.Error != nil {
+				log.Warnf("error reading swarm events: %v", e.Error)
+				break
+			}
+			x.handle(&e.Event)
+		}
+		time.Sleep(eventsRetry)
+	}
+}
+
+// deleteContainerState deletes the policies and firewalls of the
+// container id, the openflow controller is told of the policies.
+func (a *Api) deleteContainerState(id string) {
+	policies, err := a.store.List(pathPolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		log.Errorf("error to get all policies: %v", err)
+	}
+	for _, policy := range policies {
+		parts := strings.Split(path.Base(policy.Key), ":")
+		if len(parts) == 2 && (parts[0] == id || parts[1] == id) {
+			if err := a.removePolicy(parts[0], parts[1]); err != nil {
+				log.Warnf("error deleting policy: %v", err)
+			}
+		}
+	}
+
+	firewalls, err := a.store.List(pathNameFirewall)
+	if err != nil && err != store.ErrKeyNotFound {
+		log.Errorf("error to get all firewalls: %v", err)
+	}
+	for _, pair := range firewalls {
+		var fw model.Firewall
+		if err := json.Unmarshal(pair.Value, &fw); err != nil {
+			continue
+		}
+		if fw.Container == id {
+			if err := a.removeFirewall(&fw); err != nil {
+				log.Warnf("error deleting firewall %s: %v", fw.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const pathJob = "daolinet/jobs"
+
+// jobRetention is how long finished jobs are kept in the store.
+const jobRetention = 24 * time.Hour
+
+var (
+	ErrJobDoesNotExist = errors.New("job does not exist")
+	ErrJobFinished     = errors.New("job is already finished")
+	ErrJobCanceled     = errors.New("job canceled")
+)
+
+// jobs runs the container migrations in the background, one at most by
+// container, and keeps their state in the store. The migrations running
+// are known to this controller only, another one sharing the store
+// could migrate the same container at once.
+type jobs struct {
+	sync.Mutex
+	a *Api
+	// containers are the running jobs by container.
+	containers map[string]string
+	cancels    map[string]chan struct{}
+	done       map[string]chan struct{}
+}
+
+func newJobs(a *Api) *jobs {
+	return &jobs{
+		a:          a,
+		containers: map[string]string{},
+		cancels:    map[string]chan struct{}{},
+		done:       map[string]chan struct{}{},
+	}
+}
+
+func (j *jobs) save(job *model.Job) {
+	value, err := json.Marshal(job)
+	if err != nil {
+		log.Errorf("error marshal job %s: %v", job.Id, err)
+		return
+	}
+	if err := j.a.store.Put(path.Join(pathJob, job.Id), value, nil); err != nil {
+		log.Errorf("error saving job %s: %v", job.Id, err)
+	}
+}
+
+// create stores a new job with a unique id, ordered by creation time.
+func (j *jobs) create(job *model.Job) error {
+	id := job.Created.UnixNano()
+	for {
+		job.Id = fmt.Sprintf("%020d", id)
+		value, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		_, _, err = j.a.store.Store().AtomicPut(path.Join(pathJob, job.Id), value, nil, nil)
+		if err != store.ErrKeyExists {
+			return err
+		}
+		id++
+	}
+}
+
+func (j *jobs) get(id string) (*model.Job, error) {
+	pair, err := j.a.store.Get(path.Join(pathJob, id))
+	if err == store.ErrKeyNotFound {
+		return nil, ErrJobDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job model.Job
+	if err := json.Unmarshal(pair.Value, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// list returns the stored jobs, oldest first.
+func (j *jobs) list() ([]model.Job, error) {
+	pairs, err := j.a.store.List(pathJob)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+
+	list := []model.Job{}
+	for _, pair := range pairs {
+		var job model.Job
+		if err := json.Unmarshal(pair.Value, &job); err != nil {
+			log.Warnf("error unmarshal job %s: %v", pair.Key, err)
+			continue
+		}
+		list = append(list, job)
+	}
+	sort.Sort(jobsById(list))
+	return list, nil
+}
+
+// jobsById sorts jobs by id, which orders them by creation time.
+type jobsById []model.Job
+
+func (j jobsById) Len() int           { return len(j) }
+func (j jobsById) Swap(i, k int)      { j[i], j[k] = j[k], j[i] }
+func (j jobsById) Less(i, k int) bool { return j[i].Id < j[k].Id }
+
+// recover ends the jobs a previous run of the controller left pending
+// or running. The migrations it interrupted are rolled back from their
+// report, or finished if their new container was verified up. The jobs
+// are in the store but run by the controller which started them, the
+// store is not meant to be shared by several controllers.
+func (j *jobs) recover() error {
+	list, err := j.list()
+	if err != nil {
+		return err
+	}
+	for i := range list {
+		job := &list[i]
+		if job.Status != model.StatusPending && job.Status != model.StatusRunning {
+			continue
+		}
+		log.Warnf("job %s migrating container %s was interrupted", job.Id, job.Name)
+		job.Status = model.StatusFailed
+		job.Error = "interrupted by a restart of the controller"
+		if job.Migration != nil {
+			err := j.a.recoverMigration(job.Migration, &job.Request, func(m *model.Migration) {
+				j.save(job)
+			})
+			job.Status = job.Migration.Status
+			if job.Status == model.StatusDone {
+				job.Error = ""
+			}
+			if err != nil {
+				job.Error += ", " + err.Error()
+				log.Errorf("job %s migrating container %s: %v", job.Id, job.Name, err)
+			}
+		}
+		job.Finished = time.Now().UTC()
+		j.save(job)
+	}
+	return nil
+}
+
+// prune deletes the jobs finished for jobRetention.
+func (j *jobs) prune() {
+	list, err := j.list()
+	if err != nil {
+		log.Warnf("error listing jobs: %v", err)
+		return
+	}
+	for _, job := range list {
+		if job.Finished.IsZero() || time.Since(job.Finished) < jobRetention {
+			continue
+		}
+		if err := j.a.store.Delete(path.Join(pathJob, job.Id)); err != nil && err != store.ErrKeyNotFound {
+			log.Warnf("error deleting job %s: %v", job.Id, err)
+		}
+	}
+}
+
+// migrate starts a job migrating the container info, unless another
+// job is migrating it. The strategy of data places the new container
+// if data has no node. The job runs at once if slots is nil, or else
+// stays pending until it takes one of slots, its new container is then
+// placed once it runs, after those of the jobs before it.
+func (j *jobs) migrate(info *dockerclient.ContainerInfo, data *model.ResetRequest, slots chan struct{}) (*model.Job, error) {
+	// The anonymous volumes stay with the old container, which is
+	// removed without them, their data would be lost.
+	if paths := anonymousVolumes(info); len(paths) > 0 {
+		return nil, errInvalid("container %s has anonymous volumes at %s, their data cannot be migrated.",
+			strings.TrimLeft(info.Name, "/"), strings.Join(paths, ", "))
+	}
+
+	req := *data
+	var placement *model.Placement
+	if req.Node == "" && req.Strategy != "" && slots == nil {
+		p, err := j.a.place(info, req.Strategy)
+		if err != nil {
+			return nil, err
+		}
+		placement, req.Node = p, p.Node
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	name := strings.TrimLeft(info.Name, "/")
+	if id, ok := j.containers[info.Id]; ok {
+		return nil, &RequestError{
+			Status:  http.StatusConflict,
+			Code:    CodeConflict,
+			Message: fmt.Sprintf("job %s is already migrating container %s", id, name),
+		}
+	}
+
+	job := &model.Job{
+		Container: info.Id,
+		Name:      name,
+		Request:   req,
+		Placement: placement,
+		Status:    model.StatusPending,
+		Created:   time.Now().UTC(),
+	}
+	if err := j.create(job); err != nil {
+		return nil, err
+	}
+	created := *job
+
+	cancel := make(chan struct{})
+	j.containers[info.Id] = job.Id
+	j.cancels[job.Id] = cancel
+	j.done[job.Id] = make(chan struct{})
+	go j.run(job, info, cancel, slots)
+	return &created, nil
+}
+
+func (j *jobs) run(job *model.Job, info *dockerclient.ContainerInfo, cancel, slots chan struct{}) {
+	defer func() {
+		j.Lock()
+		delete(j.containers, job.Container)
+		delete(j.cancels, job.Id)
+		close(j.done[job.Id])
+		delete(j.done, job.Id)
+		j.Unlock()
+		j.prune()
+	}()
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-cancel:
+			job.Status = model.StatusCanceled
+			job.Finished = time.Now().UTC()
+			j.save(job)
+			log.Infof("job %s migrating container %s canceled", job.Id, job.Name)
+			return
+		}
+	}
+	if job.Request.Node == "" && job.Request.Strategy != "" {
+		p, err := j.a.place(info, job.Request.Strategy)
+		if err != nil {
+			job.Status = model.StatusFailed
+			job.Error = err.Error()
+			job.Finished = time.Now().UTC()
+			j.save(job)
+			log.Errorf("job %s migrating container %s: %v", job.Id, job.Name, err)
+			return
+		}
+		job.Placement, job.Request.Node = p, p.Node
+	}
+
+	job.Status = model.StatusRunning
+	job.Started = time.Now().UTC()
+	j.save(job)
+
+	report, err := j.a.migrate(info, &job.Request, cancel, func(m *model.Migration) {
+		job.Migration = m
+		j.save(job)
+	})
+	job.Migration = report
+	job.Status = report.Status
+	job.Finished = time.Now().UTC()
+	switch {
+	case err == ErrJobCanceled && report.Status == model.StatusRolledBack:
+		job.Status = model.StatusCanceled
+		log.Infof("job %s migrating container %s canceled", job.Id, job.Name)
+	case err != nil:
+		job.Error = err.Error()
+		log.Errorf("job %s migrating container %s: %v", job.Id, job.Name, err)
+	default:
+		log.Infof("job %s migrated container %s to %s", job.Id, job.Name, report.NewContainer)
+	}
+	j.save(job)
+}
+
+// cancel cancels a running job, it rolls back in the background.
+func (j *jobs) cancel(id string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	cancel, ok := j.cancels[id]
+	if !ok {
+		if _, err := j.get(id); err != nil {
+			return err
+		}
+		return ErrJobFinished
+	}
+	select {
+	case <-cancel:
+	default:
+		close(cancel)
+	}
+	return nil
+}
+
+func (a *Api) listJobs(w http.ResponseWriter, r *http.Request) {
+	list, err := a.jobs.list()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+func (a *Api) getJob(w http.ResponseWriter, r *http.Request) {
+	job, err := a.jobs.get(mux.Vars(r)["id"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// cancelJob cancels a running job and answers it, the job is canceled
+// once its steps are rolled back.
+func (a *Api) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := a.jobs.cancel(id); err != nil {
+		httpError(w, err)
+		return
+	}
+	job, err := a.jobs.get(id)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	auditContainers(r, job.Container)
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Warnf("error encoding job %s: %v", id, err)
+	}
+}
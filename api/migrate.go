@@ -0,0 +1,606 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/samalba/dockerclient"
+)
+
+// Labels swarm sets on the containers it creates.
+const (
+	swarmIdLabel          = "com.docker.swarm.id"
+	swarmConstraintsLabel = "com.docker.swarm.constraints"
+)
+
+const (
+	// verifyUptime is how long the new container of a migration has to
+	// keep running before the old one is removed.
+	verifyUptime = 3 * time.Second
+	// verifyTimeout bounds the wait for the new container to be up.
+	verifyTimeout  = 30 * time.Second
+	verifyInterval = time.Second
+)
+
+// dockerPost posts in to the docker api of swarm, for the endpoints
+// dockerclient does not cover.
+func (a *Api) dockerPost(uri string, in interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	client := newClientAndScheme(a.client.TLSConfig)
+	defer closeIdleConnections(client)
+	resp, err := client.Post(a.dUrl+uri, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return errDocker(resp.StatusCode, string(data))
+	}
+	return nil
+}
+
+// startContainer starts a container, restoring it from checkpoint in
+// dir if checkpoint is not empty. No host config is sent, it would
+// replace the one the container was created with.
+func (a *Api) startContainer(id, checkpoint, dir string) error {
+	uri := fmt.Sprintf("/containers/%s/start", id)
+	if checkpoint != "" {
+		v := url.Values{}
+		v.Set("checkpoint", checkpoint)
+		v.Set("checkpoint-dir", dir)
+		uri += "?" + v.Encode()
+	}
+	return a.dockerPost(uri, nil)
+}
+
+// checkpointContainer checkpoints the processes of a running container
+// with CRIU into dir, which stops the container.
+func (a *Api) checkpointContainer(id, checkpoint, dir string) error {
+	return a.dockerPost(fmt.Sprintf("/containers/%s/checkpoints", id), map[string]interface{}{
+		"CheckpointID":  checkpoint,
+		"CheckpointDir": dir,
+		"Exit":          true,
+	})
+}
+
+// verifyContainer waits for the container id to keep running for
+// verifyUptime. It fails once the container exits, after verifyTimeout
+// or once cancel is closed.
+func (a *Api) verifyContainer(id string, cancel <-chan struct{}) (string, error) {
+	deadline := time.Now().Add(verifyTimeout)
+	var up time.Time
+	for {
+		info, err := a.client.InspectContainer(id)
+		if err != nil {
+			return "", err
+		}
+		state := info.State
+		switch {
+		case state == nil || state.Restarting:
+			up = time.Time{}
+		case !state.Running:
+			return "", fmt.Errorf("container exited with code %d %s", state.ExitCode, state.Error)
+		case up.IsZero():
+			up = time.Now()
+		case time.Since(up) >= verifyUptime:
+			return fmt.Sprintf("running for %s", verifyUptime), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("container is not up after %s", verifyTimeout)
+		}
+		select {
+		case <-cancel:
+			return "", ErrJobCanceled
+		case <-time.After(verifyInterval):
+		}
+	}
+}
+
+// migrationConfig copies the config of a container for the new one of
+// a migration, constrained to node if it is not empty or else off the
+// avoid nodes. The endpoint of its network keeps its address and mac
+// address, the other networks are connected once it is created.
+func migrationConfig(info *dockerclient.ContainerInfo, node string, avoid []string) *dockerclient.ContainerConfig {
+	config := *info.Config
+	if info.HostConfig != nil {
+		config.HostConfig = *info.HostConfig
+	}
+	// The hostname defaults to the short id of the container.
+	if config.Hostname != "" && strings.HasPrefix(info.Id, config.Hostname) {
+		config.Hostname = ""
+	}
+
+	// Swarm identifies its containers by label and keeps their
+	// constraints in a label once created. The node constraints of the
+	// old container are dropped when the container moves.
+	moves := node != "" || len(avoid) > 0
+	config.Labels = map[string]string{}
+	for k, v := range info.Config.Labels {
+		switch {
+		case k == swarmIdLabel:
+			continue
+		case k == swarmConstraintsLabel && moves:
+			if v = dropNodeConstraints(v); v == "" {
+				continue
+			}
+		}
+		config.Labels[k] = v
+	}
+	config.Env = []string{}
+	for _, env := range info.Config.Env {
+		if moves && strings.HasPrefix(env, "constraint:node==") {
+			continue
+		}
+		config.Env = append(config.Env, env)
+	}
+	if node != "" {
+		config.Env = append(config.Env, fmt.Sprintf("constraint:node==%s", node))
+	} else {
+		for _, n := range avoid {
+			config.Env = append(config.Env, fmt.Sprintf("constraint:node!=%s", n))
+		}
+	}
+
+	netMode := config.HostConfig.NetworkMode
+	config.NetworkingConfig = dockerclient.NetworkingConfig{}
+	if net := info.NetworkSettings.Networks[netMode]; net != nil {
+		config.MacAddress = net.MacAddress
+		config.NetworkingConfig.EndpointsConfig = map[string]*dockerclient.EndpointSettings{
+			netMode: {
+				IPAMConfig: &dockerclient.EndpointIPAMConfig{
+					IPv4Address: net.IPAddress,
+				},
+			},
+		}
+	}
+	return &config
+}
+
+// extraNetworks returns the endpoints to connect the new container of a
+// migration to, those of the networks of the old container but the one
+// of its network mode, with their address and aliases. Docker assigns
+// no chosen address on its default bridge.
+func extraNetworks(info *dockerclient.ContainerInfo) map[string]*dockerclient.EndpointSettings {
+	netMode := ""
+	if info.HostConfig != nil {
+		netMode = info.HostConfig.NetworkMode
+	}
+	endpoints := map[string]*dockerclient.EndpointSettings{}
+	for name, net := range info.NetworkSettings.Networks {
+		if name == netMode || net == nil {
+			continue
+		}
+		endpoint := &dockerclient.EndpointSettings{Aliases: net.Aliases}
+		if name != "bridge" && net.IPAddress != "" {
+			endpoint.IPAMConfig = &dockerclient.EndpointIPAMConfig{IPv4Address: net.IPAddress}
+		}
+		endpoints[name] = endpoint
+	}
+	return endpoints
+}
+
+// connectNetwork connects the container id to the network name with the
+// endpoint config, which dockerclient does not send.
+func (a *Api) connectNetwork(name, id string, endpoint *dockerclient.EndpointSettings) error {
+	return a.dockerPost(fmt.Sprintf("/networks/%s/connect", name), map[string]interface{}{
+		"Container":      id,
+		"EndpointConfig": endpoint,
+	})
+}
+
+// dropNodeConstraints drops the node== constraints of the json list of
+// the swarm constraints label, it returns an empty value if none is
+// left.
+func dropNodeConstraints(value string) string {
+	var constraints []string
+	if err := json.Unmarshal([]byte(value), &constraints); err != nil {
+		return value
+	}
+	kept := []string{}
+	for _, c := range constraints {
+		if !strings.HasPrefix(c, "node==") {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return value
+	}
+	return string(data)
+}
+
+// anonymousVolumes returns the paths of the volumes of a container no
+// bind or named volume backs. Docker creates them for the container
+// alone, a new container would start with empty ones.
+func anonymousVolumes(info *dockerclient.ContainerInfo) []string {
+	if info.Config == nil {
+		return nil
+	}
+	bound := map[string]bool{}
+	if info.HostConfig != nil {
+		for _, bind := range info.HostConfig.Binds {
+			if parts := strings.Split(bind, ":"); len(parts) >= 2 {
+				bound[parts[1]] = true
+			}
+		}
+	}
+	paths := []string{}
+	for p := range info.Config.Volumes {
+		if !bound[p] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// migration records the steps of a container migration along with
+// those to undo when a later one fails or the migration is canceled.
+// progress is called on every change of the report.
+type migration struct {
+	a        *Api
+	info     *dockerclient.ContainerInfo
+	data     *model.ResetRequest
+	report   *model.Migration
+	undo     []undoStep
+	cancel   <-chan struct{}
+	progress func(*model.Migration)
+}
+
+type undoStep struct {
+	step string
+	run  func() error
+}
+
+// record appends a step to the report, returning its index.
+func (m *migration) record(s model.MigrationStep) int {
+	m.report.Steps = append(m.report.Steps, s)
+	m.progress(m.report)
+	return len(m.report.Steps) - 1
+}
+
+// finish sets the status of the step i once it ran.
+func (m *migration) finish(i int, status, detail string) {
+	s := &m.report.Steps[i]
+	s.Status, s.Detail, s.Finished = status, detail, time.Now().UTC()
+	m.progress(m.report)
+}
+
+// step runs and records a step unless the migration is canceled, undo
+// is run on rollback once the step is done.
+func (m *migration) step(name string, run func() (string, error), undo func() error) error {
+	select {
+	case <-m.cancel:
+		return ErrJobCanceled
+	default:
+	}
+
+	i := m.record(model.MigrationStep{Step: name, Status: model.StatusRunning, Started: time.Now().UTC()})
+	detail, err := run()
+	if err != nil {
+		m.finish(i, model.StatusFailed, err.Error())
+	} else {
+		m.finish(i, model.StatusDone, detail)
+	}
+
+	if err == nil && undo != nil {
+		m.undo = append(m.undo, undoStep{step: name, run: undo})
+	}
+	return err
+}
+
+// rollback undoes the steps done, the last one first, and returns the
+// first error undoing them.
+func (m *migration) rollback() error {
+	var failed error
+	for i := len(m.undo) - 1; i >= 0; i-- {
+		u := m.undo[i]
+		s := m.record(model.MigrationStep{Step: u.step, Rollback: true, Status: model.StatusRunning, Started: time.Now().UTC()})
+		if err := u.run(); err != nil {
+			log.Errorf("error rolling back %s of container %s: %v", u.step, m.report.Name, err)
+			m.finish(s, model.StatusFailed, err.Error())
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		m.finish(s, model.StatusRolledBack, "")
+	}
+	m.undo = nil
+	return failed
+}
+
+// undoOf returns the undo of a step, nil if it has none. It only needs
+// the report and the request, so that the steps of a migration a
+// restart interrupted can be undone.
+func (m *migration) undoOf(step string) func() error {
+	a, old, name := m.a, m.report.Container, m.report.Name
+	switch step {
+	case model.MigrationCheckpoint:
+		return func() error {
+			checkpoint := m.report.Checkpoint
+			if err := a.startContainer(old, checkpoint, m.data.CheckpointDir); err != nil {
+				log.Warnf("error restoring container %s from checkpoint %s: %v", name, checkpoint, err)
+				return a.startContainer(old, "", "")
+			}
+			return nil
+		}
+	case model.MigrationStop:
+		return func() error {
+			return a.startContainer(old, "", "")
+		}
+	case model.MigrationRename:
+		return func() error {
+			return a.client.RenameContainer(old, name)
+		}
+	case model.MigrationCreate:
+		return func() error {
+			if m.report.NewContainer == "" {
+				return nil
+			}
+			return a.client.RemoveContainer(m.report.NewContainer, true, false)
+		}
+	case model.MigrationRebind:
+		return func() error {
+			return a.resetContainerById(m.report.NewContainer, old)
+		}
+	}
+	return nil
+}
+
+// run takes the steps moving the container to a new one. The old
+// container is removed once the new one is verified up, the steps are
+// not undone past that point.
+func (m *migration) run() error {
+	a, info, data := m.a, m.info, m.data
+	name := m.report.Name
+
+	// The new container goes to no cordoned node.
+	avoid, err := a.cordonedNodes()
+	if err != nil {
+		return err
+	}
+
+	running := info.State != nil && info.State.Running
+	checkpoint := ""
+	switch {
+	case data.Checkpoint:
+		checkpoint = fmt.Sprintf("migrate-%d", time.Now().Unix())
+		m.report.Checkpoint = checkpoint
+		err := m.step(model.MigrationCheckpoint, func() (string, error) {
+			detail := fmt.Sprintf("checkpoint %s in %s", checkpoint, data.CheckpointDir)
+			return detail, a.checkpointContainer(info.Id, checkpoint, data.CheckpointDir)
+		}, m.undoOf(model.MigrationCheckpoint))
+		if err != nil {
+			return err
+		}
+	case running:
+		err := m.step(model.MigrationStop, func() (string, error) {
+			return "", a.client.StopContainer(info.Id, 5)
+		}, m.undoOf(model.MigrationStop))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.step(model.MigrationRename, func() (string, error) {
+		return fmt.Sprintf("renamed to %sold", name), a.client.RenameContainer(info.Id, name+"old")
+	}, m.undoOf(model.MigrationRename))
+	if err != nil {
+		return err
+	}
+
+	var newId string
+	err = m.step(model.MigrationCreate, func() (string, error) {
+		var err error
+		newId, err = a.client.CreateContainer(migrationConfig(info, data.Node, avoid), name, nil)
+		m.report.NewContainer = newId
+		return newId, err
+	}, m.undoOf(model.MigrationCreate))
+	if err != nil {
+		return err
+	}
+
+	// The networks the old container was connected to besides the one
+	// it was created with. Those connected before a failure go along
+	// with the new container once it is removed.
+	if endpoints := extraNetworks(info); len(endpoints) > 0 {
+		names := []string{}
+		for name := range endpoints {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		err = m.step(model.MigrationConnect, func() (string, error) {
+			for _, name := range names {
+				if err := a.connectNetwork(name, newId, endpoints[name]); err != nil {
+					return "", fmt.Errorf("network %s: %v", name, err)
+				}
+			}
+			return fmt.Sprintf("connected to %s", strings.Join(names, ", ")), nil
+		}, func() error {
+			var failed error
+			for _, name := range names {
+				if err := a.client.DisconnectNetwork(name, newId, true); err != nil && failed == nil {
+					failed = err
+				}
+			}
+			return failed
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The policies and firewalls move before the new container starts
+	// so that its connections are allowed right away. Those moved before
+	// a failure are moved back at once, the step has no undo then.
+	err = m.step(model.MigrationRebind, func() (string, error) {
+		if err := a.resetContainerById(info.Id, newId); err != nil {
+			if err := a.resetContainerById(newId, info.Id); err != nil {
+				log.Errorf("error moving the policies and firewalls of %s back: %v", name, err)
+			}
+			return "", err
+		}
+		return fmt.Sprintf("policies and firewalls of %s moved to %s", info.Id, newId), nil
+	}, m.undoOf(model.MigrationRebind))
+	if err != nil {
+		return err
+	}
+
+	// The new container of a stopped container is left stopped.
+	if checkpoint != "" || running {
+		err = m.step(model.MigrationStart, func() (string, error) {
+			return "", a.startContainer(newId, checkpoint, data.CheckpointDir)
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		err = m.step(model.MigrationVerify, func() (string, error) {
+			return a.verifyContainer(newId, m.cancel)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The new container is in place, the migration cannot be canceled
+	// anymore.
+	m.undo, m.cancel = nil, nil
+	err = m.step(model.MigrationRemove, func() (string, error) {
+		if err := a.client.RemoveContainer(info.Id, true, false); err != nil {
+			return "", err
+		}
+		client := newClientAndScheme(a.client.TLSConfig)
+		defer closeIdleConnections(client)
+		resp, err := client.Post(fmt.Sprintf("%s/v1/containers/%s", a.ofcUrl, info.Id), "application/json", nil)
+		if err != nil {
+			log.Warnf("Remove container from openflow controller: %v", err)
+			return "", nil
+		}
+		resp.Body.Close()
+		return "", nil
+	}, nil)
+	if err != nil {
+		log.Warnf("error removing container %s after its migration: %v", info.Id, err)
+	}
+	return nil
+}
+
+// recoverMigration ends the migration of report a restart of the
+// controller interrupted. It removes the old container if the new one
+// was verified up, or else undoes the steps taken, the step running
+// when it was interrupted included. The new container is removed along
+// with the networks it was connected to.
+func (a *Api) recoverMigration(report *model.Migration, data *model.ResetRequest, progress func(*model.Migration)) error {
+	m := &migration{a: a, data: data, report: report, progress: progress}
+
+	taken, verified := map[string]bool{}, false
+	for i, s := range report.Steps {
+		if s.Rollback {
+			// A rollback was interrupted, the steps it undid are done.
+			switch s.Status {
+			case model.StatusRolledBack:
+				taken[s.Step] = false
+			case model.StatusRunning:
+				m.finish(i, model.StatusFailed, "interrupted by a restart of the controller")
+			}
+			continue
+		}
+		switch s.Status {
+		case model.StatusDone:
+			taken[s.Step] = true
+			verified = verified || s.Step == model.MigrationVerify
+		case model.StatusRunning:
+			taken[s.Step] = true
+			m.finish(i, model.StatusFailed, "interrupted by a restart of the controller")
+		}
+		if s.Step == model.MigrationCreate && report.NewContainer == "" {
+			report.NewContainer = s.Detail
+		}
+	}
+
+	if verified {
+		err := m.step(model.MigrationRemove, func() (string, error) {
+			err := a.client.RemoveContainer(report.Container, true, false)
+			if err == dockerclient.ErrNotFound {
+				return "already removed", nil
+			}
+			return "", err
+		}, nil)
+		if err != nil {
+			report.Status = model.StatusFailed
+			return fmt.Errorf("container %s was migrated to %s, its old container was left: %v", report.Name, report.NewContainer, err)
+		}
+		report.Status = model.StatusDone
+		return nil
+	}
+
+	for _, step := range []string{model.MigrationCheckpoint, model.MigrationStop, model.MigrationRename,
+		model.MigrationCreate, model.MigrationRebind} {
+		if undo := m.undoOf(step); taken[step] && undo != nil {
+			m.undo = append(m.undo, undoStep{step: step, run: undo})
+		}
+	}
+	report.Status = model.StatusRolledBack
+	if err := m.rollback(); err != nil {
+		report.Status = model.StatusFailed
+		return fmt.Errorf("rolling back, container %s may be left renamed %sold or stopped: %v", report.Name, report.Name, err)
+	}
+	return nil
+}
+
+// migrate moves a container to a new one with the same config, on the
+// node of data if any. A failed step or closing cancel rolls back the
+// steps done, the report lists the steps taken either way and is passed
+// to progress on every change.
+func (a *Api) migrate(info *dockerclient.ContainerInfo, data *model.ResetRequest, cancel <-chan struct{}, progress func(*model.Migration)) (*model.Migration, error) {
+	m := &migration{
+		a:        a,
+		info:     info,
+		data:     data,
+		cancel:   cancel,
+		progress: progress,
+		report: &model.Migration{
+			Container: info.Id,
+			Name:      strings.TrimLeft(info.Name, "/"),
+			Node:      data.Node,
+			Steps:     []model.MigrationStep{},
+		},
+	}
+
+	err := m.run()
+	if err == nil {
+		m.report.Status = model.StatusDone
+		return m.report, nil
+	}
+
+	m.report.Error = err.Error()
+	m.report.Status = model.StatusRolledBack
+	if err := m.rollback(); err != nil {
+		m.report.Status = model.StatusFailed
+	}
+	return m.report, err
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samalba/dockerclient"
+)
+
+func TestDropNodeConstraints(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`["node==node1","region==eu"]`, `["region==eu"]`},
+		{`["region==eu","node==node1","node==node2"]`, `["region==eu"]`},
+		{`["node!=node1"]`, `["node!=node1"]`},
+		{`["node==node1"]`, ""},
+		{`[]`, ""},
+		{`node==node1`, `node==node1`},
+	}
+	for _, test := range tests {
+		if value := dropNodeConstraints(test.value); value != test.want {
+			t.Errorf("%s: constraints = %q, want %q", test.value, value, test.want)
+		}
+	}
+}
+
+// migratedContainer returns the info of a container of the swarm node
+// node1 on the network net1 and the default bridge.
+func migratedContainer() *dockerclient.ContainerInfo {
+	info := &dockerclient.ContainerInfo{
+		Id:   "4f1d3c2b1a00e0f1",
+		Name: "/web",
+		Config: &dockerclient.ContainerConfig{
+			Hostname: "4f1d3c2b1a00",
+			Image:    "nginx",
+			Env:      []string{"PORT=80", "constraint:node==node1", "constraint:region==eu"},
+			Labels: map[string]string{
+				swarmIdLabel:          "a1b2",
+				swarmConstraintsLabel: `["node==node1","region==eu"]`,
+				"app":                 "web",
+			},
+		},
+		HostConfig: &dockerclient.HostConfig{NetworkMode: "net1"},
+	}
+	info.NetworkSettings.Networks = map[string]*dockerclient.EndpointSettings{
+		"net1":   {IPAddress: "10.1.0.5", MacAddress: "02:42:0a:01:00:05", Aliases: []string{"web"}},
+		"bridge": {IPAddress: "172.17.0.3"},
+	}
+	return info
+}
+
+func TestMigrationConfig(t *testing.T) {
+	tests := []struct {
+		node   string
+		avoid  []string
+		env    []string
+		labels map[string]string
+	}{
+		{
+			// A restart in place keeps the node constraints.
+			env: []string{"PORT=80", "constraint:node==node1", "constraint:region==eu"},
+			labels: map[string]string{
+				swarmConstraintsLabel: `["node==node1","region==eu"]`,
+				"app":                 "web",
+			},
+		},
+		{
+			node: "node2",
+			env:  []string{"PORT=80", "constraint:region==eu", "constraint:node==node2"},
+			labels: map[string]string{
+				swarmConstraintsLabel: `["region==eu"]`,
+				"app":                 "web",
+			},
+		},
+		{
+			avoid: []string{"node1", "node3"},
+			env:   []string{"PORT=80", "constraint:region==eu", "constraint:node!=node1", "constraint:node!=node3"},
+			labels: map[string]string{
+				swarmConstraintsLabel: `["region==eu"]`,
+				"app":                 "web",
+			},
+		},
+	}
+	for _, test := range tests {
+		info := migratedContainer()
+		config := migrationConfig(info, test.node, test.avoid)
+
+		if !reflect.DeepEqual(config.Env, test.env) {
+			t.Errorf("%q %v: env = %v, want %v", test.node, test.avoid, config.Env, test.env)
+		}
+		if !reflect.DeepEqual(config.Labels, test.labels) {
+			t.Errorf("%q %v: labels = %v, want %v", test.node, test.avoid, config.Labels, test.labels)
+		}
+		if config.Hostname != "" {
+			t.Errorf("%q %v: hostname = %q, want the default", test.node, test.avoid, config.Hostname)
+		}
+		if config.HostConfig.NetworkMode != "net1" || config.MacAddress != "02:42:0a:01:00:05" {
+			t.Errorf("%q %v: network mode %q, mac address %q", test.node, test.avoid, config.HostConfig.NetworkMode, config.MacAddress)
+		}
+		endpoint := config.NetworkingConfig.EndpointsConfig["net1"]
+		if len(config.NetworkingConfig.EndpointsConfig) != 1 || endpoint == nil ||
+			endpoint.IPAMConfig == nil || endpoint.IPAMConfig.IPv4Address != "10.1.0.5" {
+			t.Errorf("%q %v: endpoints = %v", test.node, test.avoid, config.NetworkingConfig.EndpointsConfig)
+		}
+
+		// The old container is left untouched.
+		if old := migratedContainer(); !reflect.DeepEqual(info.Config, old.Config) {
+			t.Errorf("%q %v: config of the old container = %+v", test.node, test.avoid, info.Config)
+		}
+	}
+}
+
+func TestExtraNetworks(t *testing.T) {
+	info := migratedContainer()
+	info.NetworkSettings.Networks["net2"] = &dockerclient.EndpointSettings{IPAddress: "10.2.0.7", Aliases: []string{"api"}}
+	want := map[string]*dockerclient.EndpointSettings{
+		"bridge": {},
+		"net2": {
+			IPAMConfig: &dockerclient.EndpointIPAMConfig{IPv4Address: "10.2.0.7"},
+			Aliases:    []string{"api"},
+		},
+	}
+	if endpoints := extraNetworks(info); !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("endpoints = %v, want %v", endpoints, want)
+	}
+}
+
+func TestAnonymousVolumes(t *testing.T) {
+	tests := []struct {
+		volumes []string
+		binds   []string
+		paths   []string
+	}{
+		{nil, nil, []string{}},
+		{[]string{"/data"}, []string{"/srv/data:/data"}, []string{}},
+		{[]string{"/data", "/cache", "/logs"}, []string{"logs:/logs:ro"}, []string{"/cache", "/data"}},
+		{[]string{"/data"}, []string{"/data"}, []string{"/data"}},
+	}
+	for _, test := range tests {
+		info := &dockerclient.ContainerInfo{
+			Config:     &dockerclient.ContainerConfig{Volumes: map[string]struct{}{}},
+			HostConfig: &dockerclient.HostConfig{Binds: test.binds},
+		}
+		for _, p := range test.volumes {
+			info.Config.Volumes[p] = struct{}{}
+		}
+		if paths := anonymousVolumes(info); !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%v %v: paths = %v, want %v", test.volumes, test.binds, paths, test.paths)
+		}
+	}
+
+	if paths := anonymousVolumes(&dockerclient.ContainerInfo{}); paths != nil {
+		t.Errorf("paths of a container without config = %v", paths)
+	}
+}
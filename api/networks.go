@@ -6,14 +6,17 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
 	"github.com/gorilla/mux"
 	"github.com/samalba/dockerclient"
 )
@@ -53,7 +56,7 @@ type ContainerInfo struct {
 }
 
 func (a *Api) initPath() error {
-	var paths = [...]string{pathGroup, pathPolicy, pathNodeFirewall, pathNameFirewall}
+	var paths = [...]string{pathGroup, pathPolicy, pathRule, pathRulePolicy, pathBinding, pathJob, pathCordon, pathNodeFirewall, pathNameFirewall}
 	for _, p := range paths {
 		exists, _ := a.store.Exists(p)
 		if !exists {
@@ -80,13 +83,26 @@ func (a *Api) choiceGateway(node string) (*model.Gateway, error) {
 	if err != nil {
 		return nil, err
 	}
+	cordons, err := a.cordons()
+	if err != nil {
+		return nil, err
+	}
 
+	now := time.Now()
 	for _, gw := range gateway {
 		var g model.Gateway
 		if err := json.Unmarshal(gw.Value, &g); err != nil {
 			log.Errorf("error unmarshal gateway: %v", err)
 			continue
 		}
+		if g.Expired(now) {
+			log.Debugf("skipping expired gateway %s, last seen %s", g.DatapathID, g.LastSeen)
+			continue
+		}
+		if _, ok := cordons[g.DatapathID]; ok {
+			log.Debugf("skipping cordoned gateway %s", g.DatapathID)
+			continue
+		}
 		if node == g.Node || (node == "" && g.HostName == host) {
 			ok = true
 			nodeGateway = g
@@ -111,11 +127,17 @@ func (a *Api) gateways(w http.ResponseWriter, r *http.Request) {
 
 	gateway, err := a.store.List(PathGateway)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
-	gateways := []model.Gateway{}
-	tmp_gateways := []model.Gateway{}
+	cordons, err := a.cordons()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	now := time.Now()
+	gateways := []model.GatewayStatus{}
+	tmp_gateways := []model.GatewayStatus{}
 	for _, gw := range gateway {
 		var g model.Gateway
 		err := json.Unmarshal(gw.Value, &g)
@@ -123,16 +145,18 @@ func (a *Api) gateways(w http.ResponseWriter, r *http.Request) {
 			log.Errorf("error unmarshal gateway: %v", err)
 			continue
 		}
+		_, cordoned := cordons[g.DatapathID]
+		status := model.GatewayStatus{Gateway: g, Healthy: !g.Expired(now), Cordoned: cordoned}
 		if g.IntDev != g.ExtDev || g.IntIP != g.ExtIP {
-			tmp_gateways = append(tmp_gateways, g)
+			tmp_gateways = append(tmp_gateways, status)
 		}
-		gateways = append(gateways, g)
+		gateways = append(gateways, status)
 	}
 	if len(tmp_gateways) > 0 {
 		gateways = tmp_gateways
 	}
 	if err := json.NewEncoder(w).Encode(gateways); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
@@ -142,11 +166,29 @@ func (a *Api) gateway(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	gateway, err := a.store.Get(path.Join(PathGateway, vars["id"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
+		return
+	}
+
+	var g model.Gateway
+	if err := json.Unmarshal(gateway.Value, &g); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	cordons, err := a.cordons()
+	if err != nil {
+		httpError(w, err)
 		return
 	}
+	_, cordoned := cordons[g.DatapathID]
+
 	w.Header().Set("content-type", "application/json")
-	w.Write(gateway.Value)
+	status := model.GatewayStatus{Gateway: g, Healthy: !g.Expired(time.Now()), Cordoned: cordoned}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		httpError(w, err)
+		return
+	}
 }
 
 func (a *Api) groups(w http.ResponseWriter, r *http.Request) {
@@ -154,7 +196,7 @@ func (a *Api) groups(w http.ResponseWriter, r *http.Request) {
 
 	groups, err := a.store.List(pathGroup)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -165,42 +207,43 @@ func (a *Api) groups(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(groupArray); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
 
 func (a *Api) saveGroup(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request: %v", err))
 		return
 	}
-	var group = map[string]string{}
+	var group model.GroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request body: %v", err))
 		return
 	}
 
-	name, ok := group["name"]
-	if !ok {
-		http.Error(w, "name cannot be empty.", http.StatusInternalServerError)
+	name := group.Name
+	if name == "" {
+		httpError(w, errInvalid("name cannot be empty."))
 		return
 	}
 
 	key := path.Join(pathGroup, name)
 	exists, err := a.store.Exists(key)
 	if exists {
-		http.Error(w, ErrGroupExists.Error(), http.StatusInternalServerError)
+		httpError(w, ErrGroupExists)
 		return
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
+	auditChange(r, nil, group)
 	if err := a.store.PutTree(key); err != nil {
 		log.Errorf("error saving group: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -211,7 +254,7 @@ func (a *Api) group(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 	members, err := a.store.List(path.Join(pathGroup, name))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -222,16 +265,24 @@ func (a *Api) group(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(memberArray); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
 
 func (a *Api) deleteGroup(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if err := a.store.DeleteTree(path.Join(pathGroup, vars["name"])); err != nil {
+	key := path.Join(pathGroup, vars["name"])
+	if members, err := a.store.List(key); err == nil {
+		names := []string{}
+		for _, member := range members {
+			names = append(names, path.Base(member.Key))
+		}
+		auditChange(r, names, nil)
+	}
+	if err := a.store.DeleteTree(key); err != nil {
 		log.Errorf("error deleting group: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -240,19 +291,19 @@ func (a *Api) deleteGroup(w http.ResponseWriter, r *http.Request) {
 
 func (a *Api) saveMember(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request: %v", err))
 		return
 	}
 
-	var m = map[string]string{}
+	var m model.MemberRequest
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request body: %v", err))
 		return
 	}
 
-	member, ok := m["member"]
-	if !ok {
-		http.Error(w, "member cannot be empty.", http.StatusInternalServerError)
+	member := m.Member
+	if member == "" {
+		httpError(w, errInvalid("member cannot be empty."))
 		return
 	}
 
@@ -260,17 +311,18 @@ func (a *Api) saveMember(w http.ResponseWriter, r *http.Request) {
 	exists, err := a.store.Exists(groupath)
 	if !exists {
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, err)
 			return
 		} else {
-			http.Error(w, ErrGroupDoesNotExist.Error(), http.StatusInternalServerError)
+			httpError(w, ErrGroupDoesNotExist)
 			return
 		}
 	}
 
+	auditChange(r, nil, m)
 	if err := a.store.PutTree(path.Join(groupath, member)); err != nil {
 		log.Errorf("error saving member: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -279,9 +331,10 @@ func (a *Api) saveMember(w http.ResponseWriter, r *http.Request) {
 func (a *Api) deleteMember(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := path.Join(pathGroup, vars["name"], vars["member"])
+	auditChange(r, model.MemberRequest{Member: vars["member"]}, nil)
 	if err := a.store.DeleteTree(key); err != nil {
 		log.Errorf("error deleting member: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -305,7 +358,6 @@ func (a *Api) parsePolicy(parts []string) (*dockerclient.ContainerInfo, *dockerc
 
 	switch strings.Compare(pInfo.Id, qInfo.Id) {
 	case -1:
-		pInfo, qInfo = pInfo, qInfo
 	case +1:
 		pInfo, qInfo = qInfo, pInfo
 	default:
@@ -320,7 +372,7 @@ func (a *Api) policys(w http.ResponseWriter, r *http.Request) {
 
 	policies, err := a.store.List(pathPolicy)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
         var data = map[string]string{}
@@ -329,16 +381,18 @@ func (a *Api) policys(w http.ResponseWriter, r *http.Request) {
                 parts := strings.Split(peer[len(peer)-1], ":")
                 pInfo, qInfo, err := a.parsePolicy(parts)
 		if err != nil {
-                    log.Errorf(err.Error())
+                    log.Error(err)
                     continue
 		}
                 key := strings.Join([]string{
                         strings.TrimLeft(pInfo.Name, "/"),
                         strings.TrimLeft(qInfo.Name, "/")}, ":")
-                data[key] = string(policy.Value)
+                if value, err := parsePolicyValue(policy.Value); err == nil {
+                        data[key] = value.Action
+                }
 	}
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
@@ -347,7 +401,7 @@ func (a *Api) policy(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(mux.Vars(r)["peer"], ":")
 	pInfo, qInfo, err := a.parsePolicy(parts)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -355,123 +409,433 @@ func (a *Api) policy(w http.ResponseWriter, r *http.Request) {
         key := fmt.Sprintf("%s:%s", pInfo.Id, qInfo.Id)
 	// pair, err := a.store.Get(path.Join(pathPolicy, pInfo.Id, qInfo.Id))
 	pair, err := a.store.Get(path.Join(pathPolicy, key))
+	var policy *model.Policy
+	if err == nil {
+		policy, err = parsePolicyValue(pair.Value)
+	}
 	if err != nil {
 		val = []byte("")
 	} else {
-		val = pair.Value
-		if string(val) != CONNECTED && string(val) != DISCONNECTED {
-			val = []byte("")
-		}
+		val = []byte(policy.Action)
 	}
 
 	w.Write(val)
 }
 
+// policyPorts answers the actions by protocol and ports of the policy
+// between two containers.
+func (a *Api) policyPorts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(mux.Vars(r)["peer"], ":")
+	pInfo, qInfo, err := a.parsePolicy(parts)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	policy, ok := a.policyAction(pInfo.Id, qInfo.Id).(*model.Policy)
+	if !ok {
+		httpError(w, ErrPolicyDoesNotExist)
+		return
+	}
+	ports := policy.Ports
+	if ports == nil {
+		ports = []model.PolicyPort{}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(ports); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// policyAction returns the stored policy between two containers, nil
+// if there is none.
+func (a *Api) policyAction(pid, qid string) interface{} {
+	pair, err := a.store.Get(path.Join(pathPolicy, fmt.Sprintf("%s:%s", pid, qid)))
+	if err != nil {
+		return nil
+	}
+	policy, err := parsePolicyValue(pair.Value)
+	if err != nil {
+		return nil
+	}
+	return policy
+}
+
+// parsePolicyValue parses the stored policy of a pair of containers,
+// either a bare action or a json policy with ports.
+func parsePolicyValue(value []byte) (*model.Policy, error) {
+	if action := string(value); action == CONNECTED || action == DISCONNECTED {
+		return &model.Policy{Action: action}, nil
+	}
+
+	var policy model.Policy
+	if err := json.Unmarshal(value, &policy); err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %v", value, err)
+	}
+	if policy.Action != CONNECTED && policy.Action != DISCONNECTED {
+		return nil, fmt.Errorf("invalid policy action %q", policy.Action)
+	}
+	return &policy, nil
+}
+
+// policyValue returns the value stored for policy, a bare action if
+// it has no ports.
+func policyValue(policy *model.Policy) ([]byte, error) {
+	if len(policy.Ports) == 0 {
+		return []byte(policy.Action), nil
+	}
+	return json.Marshal(policy)
+}
+
+// validatePorts checks the protocols, actions and port ranges of ports,
+// the end of a range defaults to its start.
+func validatePorts(ports []model.PolicyPort) error {
+	for i := range ports {
+		port := &ports[i]
+		switch port.Protocol {
+		case model.ProtocolTCP, model.ProtocolUDP:
+		case model.ProtocolICMP:
+			if len(port.Ports) > 0 {
+				return errInvalid("icmp policies cannot have ports")
+			}
+		default:
+			return errInvalid("protocol should be %s, %s or %s",
+				model.ProtocolTCP, model.ProtocolUDP, model.ProtocolICMP)
+		}
+		if port.Action != CONNECTED && port.Action != DISCONNECTED {
+			return errInvalid("action of %s ports should be %s or %s", port.Protocol, CONNECTED, DISCONNECTED)
+		}
+		for j := range port.Ports {
+			ports := &port.Ports[j]
+			if ports.To == 0 {
+				ports.To = ports.From
+			}
+			if ports.From < 1 || ports.To > 65535 || ports.From > ports.To {
+				return errInvalid("invalid port range %d-%d", ports.From, ports.To)
+			}
+		}
+	}
+	return nil
+}
+
+// notifyPolicy sends the policy between two containers to the openflow
+// controller, a nil policy tells it the policy was deleted.
+func (a *Api) notifyPolicy(pid, qid string, policy *model.Policy) error {
+	data := map[string]interface{}{"sid": pid, "did": qid}
+	if policy != nil {
+		data["action"] = policy.Action
+		data["ports"] = policy.Ports
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	client := newClientAndScheme(a.client.TLSConfig)
+	defer closeIdleConnections(client)
+	resp, err := client.Post(a.ofcUrl+"/v1/policy", "application/json", bytes.NewBuffer(value))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("openflow controller: %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
 func (a *Api) savePolicy(w http.ResponseWriter, r *http.Request) {
-	data := map[string]string{}
+	var data model.PolicyRequest
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request body: %v", err))
 		return
 	}
 
-	action := data["action"]
+	action := data.Action
 	if action != CONNECTED && action != DISCONNECTED {
-		http.Error(w, "error to find action method", http.StatusInternalServerError)
+		httpError(w, errInvalid("action should be %s or %s", CONNECTED, DISCONNECTED))
+		return
+	}
+
+	if err := validatePorts(data.Ports); err != nil {
+		httpError(w, err)
 		return
 	}
+	policy := &model.Policy{Action: action, Ports: data.Ports}
 
 	parts := strings.Split(mux.Vars(r)["peer"], ":")
 	pInfo, qInfo, err := a.parsePolicy(parts)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
+	auditContainers(r, pInfo.Id, qInfo.Id)
+	auditChange(r, a.policyAction(pInfo.Id, qInfo.Id), policy)
 
-    if action == DISCONNECTED {
-        data := map[string]string{
-            "sid": pInfo.Id,
-            "did": qInfo.Id,
-        }
-
-        value, err := json.Marshal(data)
-        if err != nil {
-	    	log.Fatalf("json marshal error: %v", err)
-	    	http.Error(w, err.Error(), http.StatusInternalServerError)
-	    	return
-        }
-        body := bytes.NewBuffer(value)
-	    client := newClientAndScheme(a.client.TLSConfig)
+	if err := a.putPolicy(pInfo.Id, qInfo.Id, policy); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	    resp, err := client.Post(a.ofcUrl + "/v1/policy", "application/json", body)
-	    if err != nil {
-	    	http.Error(w, err.Error(), http.StatusInternalServerError)
-	    	return
-	    }
-        resp.Body.Close()
+// putPolicy sends the policy between two containers, sorted by id, to
+// the openflow controller and stores it.
+func (a *Api) putPolicy(pid, qid string, policy *model.Policy) error {
+	if err := a.notifyPolicy(pid, qid, policy); err != nil {
+		return err
+	}
 
-    }
+	value, err := policyValue(policy)
+	if err != nil {
+		return err
+	}
 
 	// if err := a.store.Put(path.Join(pathPolicy, pInfo.Id, qInfo.Id), []byte(action), nil); err != nil {
-	key := fmt.Sprintf("%s:%s", pInfo.Id, qInfo.Id)
-	if err := a.store.Put(path.Join(pathPolicy, key), []byte(action), nil); err != nil {
-		//log.Errorf("error saving policy: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusNoContent)
+	key := fmt.Sprintf("%s:%s", pid, qid)
+	return a.store.Put(path.Join(pathPolicy, key), value, nil)
 }
 
 func (a *Api) deletePolicy(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(mux.Vars(r)["peer"], ":")
 	pInfo, qInfo, err := a.parsePolicy(parts)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
-	// if err := a.store.Delete(path.Join(pathPolicy, pInfo.Id, qInfo.Id)); err != nil {
-	key := fmt.Sprintf("%s:%s", pInfo.Id, qInfo.Id)
-	if err := a.store.Delete(path.Join(pathPolicy, key)); err != nil {
-		//log.Errorf("error deleting policy: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	auditContainers(r, pInfo.Id, qInfo.Id)
+	auditChange(r, a.policyAction(pInfo.Id, qInfo.Id), nil)
+
+	if err := a.removePolicy(pInfo.Id, qInfo.Id); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := a.pushRules("policy deleted"); err != nil {
+		httpError(w, err)
 		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// removePolicy deletes the policy between two containers, sorted by id,
+// and tells the openflow controller so that its action stops applying.
+func (a *Api) removePolicy(pid, qid string) error {
+	// if err := a.store.Delete(path.Join(pathPolicy, pInfo.Id, qInfo.Id)); err != nil {
+	key := fmt.Sprintf("%s:%s", pid, qid)
+	if err := a.store.Delete(path.Join(pathPolicy, key)); err != nil {
+		return err
+	}
+	if err := a.notifyPolicy(pid, qid, nil); err != nil {
+		return fmt.Errorf("policy %s deleted, error notifying the openflow controller: %v", key, err)
+	}
+	// The controller holds no policy of the pair now, the rules send
+	// theirs again on their next sync.
+	if err := a.store.Delete(path.Join(pathRulePolicy, key)); err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
 func (a *Api) saveFirewall(w http.ResponseWriter, r *http.Request) {
 	firewall := model.Firewall{}
 	if err := json.NewDecoder(r.Body).Decode(&firewall); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, errInvalid("invalid request body: %v", err))
 		return
 	}
+
+	if err := a.createFirewall(&firewall); err != nil {
+		httpError(w, err)
+		return
+	}
+	auditContainers(r, firewall.Container)
+	auditChange(r, nil, firewall)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(firewall); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// firewallProtocol returns the protocol of a firewall, those stored
+// before firewalls had one are tcp.
+func firewallProtocol(fw *model.Firewall) string {
+	if fw.Protocol == "" {
+		return model.ProtocolTCP
+	}
+	return fw.Protocol
+}
+
+// firewallPorts returns the range of the gateway ports of a firewall.
+func firewallPorts(fw *model.Firewall) model.PortRange {
+	if fw.GatewayPorts != nil {
+		return *fw.GatewayPorts
+	}
+	return model.PortRange{From: fw.GatewayPort, To: fw.GatewayPort}
+}
+
+// firewallKey returns the key of a firewall on the node of its gateway,
+// <datapath>/<protocol>/<first gateway port>, the range is in its value.
+func firewallKey(fw *model.Firewall) string {
+	return path.Join(pathNodeFirewall, fw.DatapathID, firewallProtocol(fw), strconv.Itoa(fw.GatewayPort))
+}
+
+// validateFirewall checks the protocol, ports and sources of firewall.
+// The protocol defaults to tcp, the end of a range to its start, the
+// service ports to the gateway ports and the sources are normalized.
+func validateFirewall(fw *model.Firewall) error {
+	switch fw.Protocol {
+	case "":
+		fw.Protocol = model.ProtocolTCP
+	case model.ProtocolTCP, model.ProtocolUDP:
+	default:
+		return errInvalid("protocol of firewall should be %s or %s", model.ProtocolTCP, model.ProtocolUDP)
+	}
+
+	if fw.GatewayPorts == nil {
+		if fw.ServicePort == 0 {
+			fw.ServicePort = fw.GatewayPort
+		}
+		if fw.GatewayPort < 1 || fw.GatewayPort > 65535 || fw.ServicePort < 1 || fw.ServicePort > 65535 {
+			return errInvalid("gateway and service ports should be between 1 and 65535")
+		}
+		if fw.ServicePorts != nil {
+			return errInvalid("service ports need gateway ports")
+		}
+	} else {
+		g := fw.GatewayPorts
+		if g.To == 0 {
+			g.To = g.From
+		}
+		if g.From < 1 || g.To > 65535 || g.From > g.To {
+			return errInvalid("invalid gateway port range %d-%d", g.From, g.To)
+		}
+		if fw.ServicePorts == nil {
+			from := fw.ServicePort
+			if from == 0 {
+				from = g.From
+			}
+			fw.ServicePorts = &model.PortRange{From: from}
+		}
+		s := fw.ServicePorts
+		if s.To == 0 {
+			s.To = s.From + g.To - g.From
+		}
+		if s.From < 1 || s.To > 65535 || s.From > s.To {
+			return errInvalid("invalid service port range %d-%d", s.From, s.To)
+		}
+		if s.To-s.From != g.To-g.From {
+			return errInvalid("gateway ports %d-%d and service ports %d-%d should be as many", g.From, g.To, s.From, s.To)
+		}
+		fw.GatewayPort, fw.ServicePort = g.From, s.From
+	}
+
+	// The gateways forward ipv4 only.
+	for i, source := range fw.Sources {
+		if ip := net.ParseIP(source); ip != nil {
+			if ip.To4() == nil {
+				return errInvalid("invalid source %s, it should be an ipv4 CIDR", source)
+			}
+			fw.Sources[i] = (&net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}).String()
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(source)
+		if err != nil || ipnet.IP.To4() == nil {
+			return errInvalid("invalid source %s, it should be an ipv4 CIDR", source)
+		}
+		fw.Sources[i] = ipnet.String()
+	}
+	return nil
+}
+
+// upgradeFirewalls moves the entries of the gateway ports stored before
+// they were keyed by protocol, <datapath>/<port> and <datapath>/<port>-udp,
+// to their firewallKey.
+func (a *Api) upgradeFirewalls() error {
+	datapaths, err := a.listKeys(pathNodeFirewall)
+	if err != nil {
+		return err
+	}
+	for _, datapath := range datapaths {
+		pairs, err := a.store.List(path.Join(pathNodeFirewall, datapath))
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+		for _, pair := range pairs {
+			key := path.Base(pair.Key)
+			if key == datapath || key == model.ProtocolTCP || key == model.ProtocolUDP {
+				continue
+			}
+			var fw model.Firewall
+			if err := json.Unmarshal(pair.Value, &fw); err == nil && fw.Name != "" {
+				log.Infof("moving firewall %s to %s", fw.Name, firewallKey(&fw))
+				if err := a.store.Put(firewallKey(&fw), pair.Value, nil); err != nil {
+					return err
+				}
+			}
+			if err := a.store.Delete(path.Join(pathNodeFirewall, datapath, key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// firewallConflict returns the firewall on the gateway datapath whose
+// ports overlap those of fw for the same protocol, nil if none does.
+// Every firewall of the protocol is checked, those of a range are keyed
+// by its first port only.
+func (a *Api) firewallConflict(datapath string, fw *model.Firewall) (*model.Firewall, error) {
+	pairs, err := a.store.List(path.Join(pathNodeFirewall, datapath, firewallProtocol(fw)))
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	ports := firewallPorts(fw)
+	for _, pair := range pairs {
+		var other model.Firewall
+		if err := json.Unmarshal(pair.Value, &other); err != nil || other.Name == "" {
+			continue
+		}
+		if o := firewallPorts(&other); o.From <= ports.To && ports.From <= o.To {
+			return &other, nil
+		}
+	}
+	return nil, nil
+}
+
+// createFirewall stores firewall on the gateway of the node of its
+// container, or of its GatewayIP if set. The container name is replaced
+// by its id, the gateway fields by those of the chosen gateway.
+func (a *Api) createFirewall(firewall *model.Firewall) error {
 	name := firewall.Name
 	container := firewall.Container
 	gatewayIP := firewall.GatewayIP
 
 	if name == "" || container == "" {
-		http.Error(w, "name or container cannot be empty.", http.StatusInternalServerError)
-		return
+		return errInvalid("name or container cannot be empty.")
+	}
+	if err := validateFirewall(firewall); err != nil {
+		return err
 	}
 
 	nameurl := path.Join(pathNameFirewall, name)
 	exists, err := a.store.Exists(nameurl)
 	if exists {
-		http.Error(w, ErrFirewallNameExists.Error(), http.StatusInternalServerError)
-		return
+		return ErrFirewallNameExists
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	client := newClientAndScheme(a.client.TLSConfig)
 	resp, err := client.Get(a.dUrl + "/containers/" + container + "/json")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	//cleanup
@@ -480,19 +844,16 @@ func (a *Api) saveFirewall(w http.ResponseWriter, r *http.Request) {
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	if resp.StatusCode >= 400 {
-		http.Error(w, string(data), http.StatusInternalServerError)
-		return
+		return errDocker(resp.StatusCode, string(data))
 	}
 
 	var info ContainerInfo
 	if err := json.Unmarshal(data, &info); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
         if gatewayIP == "" {
@@ -500,8 +861,7 @@ func (a *Api) saveFirewall(w http.ResponseWriter, r *http.Request) {
         }
 	gateway, err := a.choiceGateway(gatewayIP)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	firewall.Container = info.Id
@@ -510,38 +870,39 @@ func (a *Api) saveFirewall(w http.ResponseWriter, r *http.Request) {
 
 	value, err := json.Marshal(firewall)
 	if err != nil {
-		log.Fatalf("json marshal error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	nodeurl := path.Join(pathNodeFirewall, gateway.DatapathID, strconv.Itoa(firewall.GatewayPort))
+	nodeurl := firewallKey(firewall)
 	exists, err = a.store.Exists(nodeurl)
 	if exists {
-		http.Error(w, ErrFirewallPortExists.Error(), http.StatusInternalServerError)
-		return
+		return ErrFirewallPortExists
 	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+	other, err := a.firewallConflict(gateway.DatapathID, firewall)
+	if err != nil {
+		return err
+	}
+	if other != nil {
+		return &RequestError{
+			Status:  http.StatusConflict,
+			Code:    CodeConflict,
+			Message: fmt.Sprintf("%s: %s ports of firewall %s, %d-%d, overlap", ErrFirewallPortExists,
+				firewallProtocol(other), other.Name, firewallPorts(other).From, firewallPorts(other).To),
+		}
 	}
 
 	if err := a.store.Put(nodeurl, value, nil); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	if err := a.store.Put(nameurl, value, nil); err != nil {
 		a.store.Delete(nodeurl)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(firewall); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
+	return nil
 }
 
 func (a *Api) firewalls(w http.ResponseWriter, r *http.Request) {
@@ -549,7 +910,7 @@ func (a *Api) firewalls(w http.ResponseWriter, r *http.Request) {
 
 	containers, err := a.client.ListContainers(true, true, "")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -564,7 +925,7 @@ func (a *Api) firewalls(w http.ResponseWriter, r *http.Request) {
 
 	firewalls, err := a.store.List(pathNameFirewall)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -579,7 +940,7 @@ func (a *Api) firewalls(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(values); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
@@ -590,13 +951,13 @@ func (a *Api) firewallByContainer(w http.ResponseWriter, r *http.Request) {
 
 	containerInfo, err := a.client.InspectContainer(vars["name"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
 	firewalls, err := a.store.List(pathNameFirewall)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -612,17 +973,23 @@ func (a *Api) firewallByContainer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(values); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 }
 
+// firewall answers the firewall of a gateway port for the openflow
+// controller, the port is a tcp one unless the route has a protocol.
 func (a *Api) firewall(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	key := path.Join(pathNodeFirewall, vars["node"], vars["port"])
+	protocol := vars["protocol"]
+	if protocol == "" {
+		protocol = model.ProtocolTCP
+	}
+	key := path.Join(pathNodeFirewall, vars["node"], protocol, vars["port"])
 	firewall, err := a.store.Get(key)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
@@ -634,41 +1001,71 @@ func (a *Api) deleteFirewall(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	firewall, err := a.store.Get(path.Join(pathNameFirewall, vars["name"]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 
 	var fw model.Firewall
 	if err := json.Unmarshal(firewall.Value, &fw); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
+	auditContainers(r, fw.Container)
+	auditChange(r, fw, nil)
 
-	nodeurl := path.Join(pathNodeFirewall, fw.DatapathID)
-	if err := a.store.Delete(path.Join(nodeurl, strconv.Itoa(fw.GatewayPort))); err != nil {
-		log.Warnf("deleting firewall %s: %v", vars["name"], err)
-	}
-
-	nameurl := path.Join(pathNameFirewall, fw.Name)
-	if err := a.store.Delete(nameurl); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := a.removeFirewall(&fw); err != nil {
+		httpError(w, err)
 		return
 	}
 
-	nodes, err := a.store.List(nodeurl)
+	w.Header().Set("content-type", "application/json")
+	w.Write(firewall.Value)
+}
+
+// restoreFirewall stores again a firewall as it was stored, on the
+// gateway it had.
+func (a *Api) restoreFirewall(fw *model.Firewall) error {
+	value, err := json.Marshal(fw)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+	if err := a.store.Put(firewallKey(fw), value, nil); err != nil {
+		return err
+	}
+	return a.store.Put(path.Join(pathNameFirewall, fw.Name), value, nil)
+}
+
+// removeFirewall deletes firewall from the store, along with the
+// directories of its protocol and gateway once they have no firewall
+// left. The entry of its gateway port is left if another firewall
+// holds it.
+func (a *Api) removeFirewall(fw *model.Firewall) error {
+	if pair, err := a.store.Get(firewallKey(fw)); err != nil {
+		log.Warnf("deleting firewall %s: %v", fw.Name, err)
 	} else {
-		if len(nodes) == 0 {
-			if err := a.store.DeleteTree(nodeurl); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		var held model.Firewall
+		if err := json.Unmarshal(pair.Value, &held); err == nil && held.Name != fw.Name {
+			log.Warnf("deleting firewall %s: its gateway port is held by firewall %s", fw.Name, held.Name)
+		} else if err := a.store.Delete(firewallKey(fw)); err != nil {
+			log.Warnf("deleting firewall %s: %v", fw.Name, err)
 		}
+	}
 
+	nameurl := path.Join(pathNameFirewall, fw.Name)
+	if err := a.store.Delete(nameurl); err != nil {
+		return err
 	}
 
-	w.Header().Set("content-type", "application/json")
-	w.Write(firewall.Value)
+	for _, dir := range []string{path.Dir(firewallKey(fw)), path.Join(pathNodeFirewall, fw.DatapathID)} {
+		pairs, err := a.store.List(dir)
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+		if err == nil && len(pairs) == 0 {
+			if err := a.store.DeleteTree(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
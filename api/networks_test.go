@@ -0,0 +1,108 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/daolinet/daolinet/model"
+)
+
+func TestValidateFirewall(t *testing.T) {
+	tests := []struct {
+		fw   model.Firewall
+		want model.Firewall
+		fail bool
+	}{
+		// The protocol defaults to tcp, the service port to the gateway port.
+		{
+			fw:   model.Firewall{GatewayPort: 8080},
+			want: model.Firewall{GatewayPort: 8080, ServicePort: 8080, Protocol: "tcp"},
+		},
+		{
+			fw:   model.Firewall{GatewayPort: 5353, ServicePort: 53, Protocol: "udp"},
+			want: model.Firewall{GatewayPort: 5353, ServicePort: 53, Protocol: "udp"},
+		},
+		{fw: model.Firewall{GatewayPort: 8080, Protocol: "icmp"}, fail: true},
+		{fw: model.Firewall{}, fail: true},
+		{fw: model.Firewall{GatewayPort: 70000}, fail: true},
+		{fw: model.Firewall{GatewayPort: 8080, ServicePorts: &model.PortRange{From: 80, To: 81}}, fail: true},
+
+		// A range defaults to a single port and to as many service
+		// ports from the service port or else the first gateway port.
+		{
+			fw: model.Firewall{GatewayPorts: &model.PortRange{From: 8000}},
+			want: model.Firewall{
+				GatewayPort:  8000,
+				ServicePort:  8000,
+				Protocol:     "tcp",
+				GatewayPorts: &model.PortRange{From: 8000, To: 8000},
+				ServicePorts: &model.PortRange{From: 8000, To: 8000},
+			},
+		},
+		{
+			fw: model.Firewall{ServicePort: 9000, GatewayPorts: &model.PortRange{From: 8000, To: 8009}},
+			want: model.Firewall{
+				GatewayPort:  8000,
+				ServicePort:  9000,
+				Protocol:     "tcp",
+				GatewayPorts: &model.PortRange{From: 8000, To: 8009},
+				ServicePorts: &model.PortRange{From: 9000, To: 9009},
+			},
+		},
+		{
+			fw: model.Firewall{
+				GatewayPorts: &model.PortRange{From: 8000, To: 8009},
+				ServicePorts: &model.PortRange{From: 100},
+			},
+			want: model.Firewall{
+				GatewayPort:  8000,
+				ServicePort:  100,
+				Protocol:     "tcp",
+				GatewayPorts: &model.PortRange{From: 8000, To: 8009},
+				ServicePorts: &model.PortRange{From: 100, To: 109},
+			},
+		},
+		{fw: model.Firewall{GatewayPorts: &model.PortRange{From: 8009, To: 8000}}, fail: true},
+		{fw: model.Firewall{GatewayPorts: &model.PortRange{From: 65530, To: 65540}}, fail: true},
+		{
+			fw: model.Firewall{
+				GatewayPorts: &model.PortRange{From: 8000, To: 8009},
+				ServicePorts: &model.PortRange{From: 100, To: 104},
+			},
+			fail: true,
+		},
+		{fw: model.Firewall{ServicePort: 65530, GatewayPorts: &model.PortRange{From: 8000, To: 8009}}, fail: true},
+
+		// Sources are ipv4 addresses or networks.
+		{
+			fw: model.Firewall{GatewayPort: 22, Sources: []string{"10.0.0.1", "10.1.2.3/16", "::ffff:192.168.1.1"}},
+			want: model.Firewall{
+				GatewayPort: 22,
+				ServicePort: 22,
+				Protocol:    "tcp",
+				Sources:     []string{"10.0.0.1/32", "10.1.0.0/16", "192.168.1.1/32"},
+			},
+		},
+		{fw: model.Firewall{GatewayPort: 22, Sources: []string{"fd00::1"}}, fail: true},
+		{fw: model.Firewall{GatewayPort: 22, Sources: []string{"fd00::/64"}}, fail: true},
+		{fw: model.Firewall{GatewayPort: 22, Sources: []string{"10.0.0.0/33"}}, fail: true},
+		{fw: model.Firewall{GatewayPort: 22, Sources: []string{"office"}}, fail: true},
+	}
+	for i, test := range tests {
+		fw := test.fw
+		err := validateFirewall(&fw)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%d: firewall %+v was accepted", i, test.fw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(fw, test.want) {
+			t.Errorf("%d: firewall = %+v, want %+v", i, fw, test.want)
+		}
+	}
+}
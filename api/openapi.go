@@ -0,0 +1,284 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/daolinet/daolinet/model"
+)
+
+const openapiVersion = "3.0.0"
+
+// text marks an operation answering with a text/plain body.
+type text string
+
+// accepted marks an operation answering 202 with the body it holds.
+type accepted struct {
+	body interface{}
+}
+
+// operation documents a route of the api, request and response are
+// zero values of the body types, nil for an empty body.
+type operation struct {
+	method   string
+	path     string
+	summary  string
+	request  interface{}
+	response interface{}
+}
+
+// operations lists every route registered by Api.Run under /api.
+var operations = []operation{
+	{"GET", "/api/openapi.json", "The openapi document of the api", nil, map[string]interface{}{}},
+	{"GET", "/api/audit", "Query the audit log, oldest first", nil, []model.AuditEntry{}},
+	{"GET", "/api/watch", "Stream the changes of the resources, as json or server-sent events", nil, model.WatchEvent{}},
+	{"GET", "/api/export", "Export the groups, policies, rules and firewalls as a json or yaml document", nil, model.Document{}},
+	{"POST", "/api/apply", "Reconcile the state with a json or yaml document, optionally as a dry run", model.Document{}, model.ApplyResult{}},
+	{"GET", "/api/gc", "List the orphan entries of deleted containers and networks, a dry run of POST", nil, []model.Orphan{}},
+	{"POST", "/api/gc", "Delete the orphan entries of deleted containers and networks, each checked again first, the deleted policies are removed from the openflow controller", nil, []model.Orphan{}},
+	{"GET", "/api/gateways", "List the gateways with their health", nil, []model.GatewayStatus{}},
+	{"GET", "/api/gateways/{id}", "Show a gateway by datapath id", nil, model.GatewayStatus{}},
+	{"POST", "/api/gateways/{id}/drain", "Cordon a gateway and start the jobs migrating the containers of its swarm node, the stopped ones are left stopped, answers the jobs at once, poll them with GET /api/jobs/{id}", model.DrainRequest{}, accepted{model.DrainResult{}}},
+	{"POST", "/api/gateways/{id}/cordon", "Cordon a gateway, it takes no new container", nil, model.Cordon{}},
+	{"POST", "/api/gateways/{id}/uncordon", "Uncordon a gateway", nil, nil},
+	{"GET", "/api/groups", "List the group names", nil, []string{}},
+	{"POST", "/api/groups", "Create a group", model.GroupRequest{}, nil},
+	{"GET", "/api/groups/{name}", "List the members of a group", nil, []string{}},
+	{"POST", "/api/groups/{name}", "Add a member to a group", model.MemberRequest{}, nil},
+	{"DELETE", "/api/groups/{name}", "Delete a group and its members", nil, nil},
+	{"DELETE", "/api/groups/{name}/{member}", "Remove a member from a group", nil, nil},
+	{"GET", "/api/policy", "List the policies by container names", nil, map[string]string{}},
+	{"GET", "/api/policy/{peer}", "Show the action between two containers", nil, text("")},
+	{"GET", "/api/policy/{peer}/ports", "Show the actions by protocol and ports of the policy between two containers", nil, []model.PolicyPort{}},
+	{"POST", "/api/policy/{peer}", "Set the action between two containers", model.PolicyRequest{}, nil},
+	{"DELETE", "/api/policy/{peer}", "Delete the policy between two containers", nil, nil},
+	{"POST", "/api/policy/evaluate", "Evaluate the traffic from a container to another, changes nothing", model.EvaluateRequest{}, model.Evaluation{}},
+	{"GET", "/api/policy/{peer}/effective", "Resolve the policies of the traffic of a container or between two containers", nil, []model.EffectivePolicy{}},
+	{"GET", "/api/rules", "List the policy rules", nil, []model.PolicyRule{}},
+	{"POST", "/api/rules", "Create a policy rule, the policies it gives to the containers without a pair policy are sent to the openflow controller", model.PolicyRule{}, nil},
+	{"GET", "/api/rules/{name}", "Show a policy rule", nil, model.PolicyRule{}},
+	{"PUT", "/api/rules/{name}", "Replace a policy rule and send the policies it now gives to the openflow controller", model.PolicyRule{}, nil},
+	{"DELETE", "/api/rules/{name}", "Delete a policy rule and the policies it gave from the openflow controller", nil, nil},
+	{"GET", "/api/firewalls", "List the firewalls with their protocol, ports and sources", nil, []model.Firewall{}},
+	{"POST", "/api/firewalls", "Create a firewall, tcp by default and open to any source if it has none, the sources are ipv4 CIDRs. The ports of two firewalls of the same protocol cannot overlap", model.Firewall{}, model.Firewall{}},
+	{"GET", "/api/firewalls/{name}", "List the firewalls of a container", nil, []model.Firewall{}},
+	{"DELETE", "/api/firewalls/{name}", "Delete a firewall by name", nil, model.Firewall{}},
+	{"GET", "/api/firewalls/{node}/{port}", "Show the firewall of a tcp gateway port, the first port of its range", nil, model.Firewall{}},
+	{"GET", "/api/firewalls/{node}/{protocol}/{port}", "Show the firewall of a tcp or udp gateway port, the first port of its range, the openflow controller looks the firewalls up by protocol", nil, model.Firewall{}},
+	{"GET", "/api/containers/{id}", "Show the networks of a container", nil, []model.ContainerNetwork{}},
+	{"PUT", "/api/containers/{id}/reset", "Start a job migrating a container to a new one, on the node of the request or else the one its strategy chooses, answers the job id, or the job with its placement to clients accepting json. Containers with anonymous volumes are refused, their data would be lost", model.ResetRequest{}, accepted{text("")}},
+	{"GET", "/api/jobs", "List the migration jobs", nil, []model.Job{}},
+	{"GET", "/api/jobs/{id}", "Show a migration job and the status of its steps", nil, model.Job{}},
+	{"POST", "/api/jobs/{id}/cancel", "Cancel a migration job, which rolls back its steps", nil, accepted{model.Job{}}},
+}
+
+// queryParams are the query parameters of operations, by method and path.
+var queryParams = map[string][]string{
+	"GET /api/audit":  {"since", "until", "actor", "limit"},
+	"GET /api/watch":  {"kind"},
+	"GET /api/export": {"format"},
+	"POST /api/apply": {"dryRun", "prune", "format"},
+}
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+// openapiDoc builds the openapi document of operations.
+func openapiDoc(ops []operation) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorSchema := schemaOf(reflect.TypeOf(model.Error{}), schemas)
+
+	paths := map[string]interface{}{}
+	for _, op := range ops {
+		item, ok := paths[op.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.path] = item
+		}
+
+		o := map[string]interface{}{
+			"summary":     op.summary,
+			"operationId": strings.ToLower(op.method) + operationName(op.path),
+		}
+
+		params := []interface{}{}
+		for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, name := range queryParams[op.method+" "+op.path] {
+			params = append(params, map[string]interface{}{
+				"name":   name,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+
+		if op.request != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(op.request), schemas),
+					},
+				},
+			}
+		}
+
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{
+				"description": "error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": errorSchema},
+				},
+			},
+		}
+		status, description, response := "200", "ok", op.response
+		if a, ok := response.(accepted); ok {
+			status, description, response = "202", "accepted", a.body
+		}
+		switch response.(type) {
+		case nil:
+			responses["204"] = map[string]interface{}{"description": "no content"}
+		case text:
+			responses[status] = map[string]interface{}{
+				"description": description,
+				"content": map[string]interface{}{
+					"text/plain": map[string]interface{}{
+						"schema": map[string]interface{}{"type": "string"},
+					},
+				},
+			}
+		default:
+			responses[status] = map[string]interface{}{
+				"description": description,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(response), schemas),
+					},
+				},
+			}
+		}
+		o["responses"] = responses
+
+		item[strings.ToLower(op.method)] = o
+	}
+
+	return map[string]interface{}{
+		"openapi": openapiVersion,
+		"info": map[string]interface{}{
+			"title":   "daolinet api",
+			"version": "1.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"basic": []string{}},
+		},
+	}
+}
+
+// operationName turns /api/groups/{name} into GroupsName.
+func operationName(p string) string {
+	name := ""
+	for _, part := range strings.Split(strings.TrimPrefix(p, "/api/"), "/") {
+		part = strings.Trim(part, "{}")
+		part = strings.Replace(strings.Title(strings.Replace(part, ".", " ", -1)), " ", "", -1)
+		name += part
+	}
+	return name
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the json schema of t, named structs are added to
+// schemas and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[t.Name()]; !ok {
+			// Reserve the name first for recursive types.
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	addFields(t, properties, schemas)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// addFields adds the json fields of t to properties, following the
+// encoding/json rules for tags and embedded structs.
+func addFields(t reflect.Type, properties, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(f.Type, properties, schemas)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type, schemas)
+	}
+}
+
+func (a *Api) openapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(openapiDoc(operations)); err != nil {
+		httpError(w, err)
+		return
+	}
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/samalba/dockerclient"
+)
+
+var ErrNoPlacement = errors.New("no gateway to place the container on")
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case "", model.StrategyLeastLoaded, model.StrategySpread, model.StrategyAffinity:
+		return nil
+	}
+	return errInvalid("strategy should be %s, %s or %s",
+		model.StrategyLeastLoaded, model.StrategySpread, model.StrategyAffinity)
+}
+
+// containerNode returns the swarm node of a listed container, swarm
+// prefixes the names of the containers with their node.
+func containerNode(c *dockerclient.Container) string {
+	for _, name := range c.Names {
+		if parts := strings.SplitN(strings.TrimLeft(name, "/"), "/", 2); len(parts) == 2 {
+			return parts[0]
+		}
+	}
+	return ""
+}
+
+// nodeLoad is a candidate node of a placement.
+type nodeLoad struct {
+	node       string
+	containers int
+	// subnet counts the containers sharing a network with the placed
+	// one, affinity sums the scores of its peers.
+	subnet   int
+	affinity int
+	peers    []string
+}
+
+// byStrategy sorts candidate nodes best first for strategy.
+type byStrategy struct {
+	loads    []*nodeLoad
+	strategy string
+}
+
+func (s byStrategy) Len() int      { return len(s.loads) }
+func (s byStrategy) Swap(i, j int) { s.loads[i], s.loads[j] = s.loads[j], s.loads[i] }
+func (s byStrategy) Less(i, j int) bool {
+	li, lj := s.loads[i], s.loads[j]
+	switch {
+	case s.strategy == model.StrategySpread && li.subnet != lj.subnet:
+		return li.subnet < lj.subnet
+	case s.strategy == model.StrategyAffinity && li.affinity != lj.affinity:
+		return li.affinity > lj.affinity
+	case li.containers != lj.containers:
+		return li.containers < lj.containers
+	}
+	return li.node < lj.node
+}
+
+// affinities scores the containers a container talks to: two for an
+// accepting policy between them, minus two for a dropping one, and one
+// for each daolinet network they share or a group connects. The
+// container itself is not scored.
+func (a *Api) affinities(info *dockerclient.ContainerInfo, containers []dockerclient.Container, mine map[string]bool) (map[string]int, error) {
+	scores := map[string]int{}
+
+	policies, err := a.store.List(pathPolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	for _, pair := range policies {
+		parts := strings.Split(path.Base(pair.Key), ":")
+		if len(parts) != 2 || (parts[0] != info.Id && parts[1] != info.Id) {
+			continue
+		}
+		peer := parts[0]
+		if peer == info.Id {
+			peer = parts[1]
+		}
+		policy, err := parsePolicyValue(pair.Value)
+		if err != nil {
+			continue
+		}
+		if policy.Action == CONNECTED {
+			scores[peer] += 2
+		} else {
+			scores[peer] -= 2
+		}
+	}
+
+	connected := map[string]bool{}
+	groups, err := a.listKeys(pathGroup)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		members, err := a.listKeys(path.Join(pathGroup, group))
+		if err != nil {
+			return nil, err
+		}
+		member := false
+		for _, m := range members {
+			member = member || mine[m] || mine[path.Base(m)]
+		}
+		if !member {
+			continue
+		}
+		for _, m := range members {
+			connected[m] = true
+		}
+	}
+
+	for _, c := range containers {
+		if c.Id == info.Id {
+			continue
+		}
+		for name := range c.NetworkSettings.Networks {
+			if mine[name] || mine[path.Base(name)] || connected[name] || connected[path.Base(name)] {
+				scores[c.Id]++
+			}
+		}
+	}
+	delete(scores, info.Id)
+	return scores, nil
+}
+
+// place chooses the node of the new container of a migration with
+// strategy, among the nodes of the healthy gateways which are not
+// cordoned, but the node the container runs on. Ties go to the node
+// running the fewest containers.
+func (a *Api) place(info *dockerclient.ContainerInfo, strategy string) (*model.Placement, error) {
+	if err := validateStrategy(strategy); err != nil {
+		return nil, err
+	}
+
+	gateways, err := a.store.List(PathGateway)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	cordons, err := a.cordons()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := a.swarmNodes()
+	if err != nil {
+		return nil, err
+	}
+	// The candidates are keyed by swarm node, as the containers are.
+	loads := map[string]*nodeLoad{}
+	now := time.Now()
+	for _, pair := range gateways {
+		var g model.Gateway
+		if err := json.Unmarshal(pair.Value, &g); err != nil {
+			log.Errorf("error unmarshal gateway: %v", err)
+			continue
+		}
+		node := a.nodeName(&g, nodes)
+		if _, ok := cordons[g.DatapathID]; ok || g.Expired(now) || node == "" {
+			continue
+		}
+		loads[node] = &nodeLoad{node: node}
+	}
+
+	containers, err := a.client.ListContainers(false, false, "")
+	if err != nil {
+		return nil, err
+	}
+	// The networks of the container which other nodes share.
+	daolinet, err := a.daolinetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	mine := map[string]bool{}
+	for name := range info.NetworkSettings.Networks {
+		if daolinet[name] {
+			mine[name] = true
+			mine[path.Base(name)] = true
+		}
+	}
+	var scores map[string]int
+	if strategy == model.StrategyAffinity {
+		if scores, err = a.affinities(info, containers, mine); err != nil {
+			return nil, err
+		}
+	}
+	current := ""
+	for i := range containers {
+		c := &containers[i]
+		node := containerNode(c)
+		if c.Id == info.Id {
+			current = node
+			continue
+		}
+		l, ok := loads[node]
+		if !ok {
+			continue
+		}
+		l.containers++
+		for name := range c.NetworkSettings.Networks {
+			if mine[name] || mine[path.Base(name)] {
+				l.subnet++
+				break
+			}
+		}
+		if score := scores[c.Id]; score != 0 {
+			l.affinity += score
+			if score > 0 {
+				l.peers = append(l.peers, strings.TrimLeft(path.Base(c.Names[0]), "/"))
+			}
+		}
+	}
+	delete(loads, current)
+	if len(loads) == 0 {
+		return nil, ErrNoPlacement
+	}
+
+	candidates := []*nodeLoad{}
+	for _, l := range loads {
+		candidates = append(candidates, l)
+	}
+	sort.Sort(byStrategy{candidates, strategy})
+
+	best := candidates[0]
+	p := &model.Placement{Strategy: strategy, Node: best.node}
+	switch {
+	case strategy == model.StrategySpread:
+		p.Reason = fmt.Sprintf("node %s runs %d containers of the networks of %s, the fewest of %d nodes",
+			best.node, best.subnet, strings.TrimLeft(info.Name, "/"), len(candidates))
+	case strategy == model.StrategyAffinity && best.affinity > 0:
+		sort.Strings(best.peers)
+		p.Reason = fmt.Sprintf("node %s runs the peers %s, the highest affinity %d of %d nodes",
+			best.node, strings.Join(best.peers, ", "), best.affinity, len(candidates))
+	case strategy == model.StrategyAffinity:
+		p.Reason = fmt.Sprintf("no node runs a peer, node %s runs %d containers, the fewest of %d nodes",
+			best.node, best.containers, len(candidates))
+	default:
+		p.Reason = fmt.Sprintf("node %s runs %d containers, the fewest of %d nodes",
+			best.node, best.containers, len(candidates))
+	}
+	return p, nil
+}
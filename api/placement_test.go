@@ -0,0 +1,46 @@
+package api
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/daolinet/daolinet/model"
+)
+
+func TestByStrategy(t *testing.T) {
+	loads := []nodeLoad{
+		{node: "node3", containers: 2, subnet: 1, affinity: 0},
+		{node: "node1", containers: 5, subnet: 0, affinity: 4},
+		{node: "node2", containers: 2, subnet: 1, affinity: 4},
+		{node: "node4", containers: 1, subnet: 3, affinity: -2},
+	}
+	tests := []struct {
+		strategy string
+		order    []string
+	}{
+		// Fewest containers, ties broken by name.
+		{model.StrategyLeastLoaded, []string{"node4", "node2", "node3", "node1"}},
+		{"", []string{"node4", "node2", "node3", "node1"}},
+		// Fewest containers of the networks, then least loaded.
+		{model.StrategySpread, []string{"node1", "node2", "node3", "node4"}},
+		// Highest affinity, then least loaded.
+		{model.StrategyAffinity, []string{"node2", "node1", "node3", "node4"}},
+	}
+	for _, test := range tests {
+		candidates := []*nodeLoad{}
+		for i := range loads {
+			l := loads[i]
+			candidates = append(candidates, &l)
+		}
+		sort.Sort(byStrategy{candidates, test.strategy})
+
+		order := []string{}
+		for _, l := range candidates {
+			order = append(order, l.node)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%q: order = %v, want %v", test.strategy, order, test.order)
+		}
+	}
+}
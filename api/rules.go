@@ -0,0 +1,514 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+	"github.com/gorilla/mux"
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	pathRule = "daolinet/rules"
+	// pathRulePolicy keeps the policies the rules gave to the pairs of
+	// containers, as last sent to the openflow controller.
+	pathRulePolicy = "daolinet/rulepolicies"
+)
+
+var (
+	ErrRuleExists       = errors.New("rule already exists")
+	ErrRuleDoesNotExist = errors.New("rule does not exist")
+)
+
+// matchSelector reports whether the container c is selected by s.
+func matchSelector(s *model.Selector, c *dockerclient.Container) bool {
+	for key, value := range s.Labels {
+		if v, ok := c.Labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	if len(s.Networks) == 0 {
+		return true
+	}
+	for _, network := range s.Networks {
+		if _, ok := c.NetworkSettings.Networks[network]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRule reports whether rule applies to the traffic from src to dst.
+func matchRule(rule *model.PolicyRule, src, dst *dockerclient.Container) bool {
+	egress := matchSelector(&rule.Source, src) && matchSelector(&rule.Destination, dst)
+	ingress := matchSelector(&rule.Destination, src) && matchSelector(&rule.Source, dst)
+	switch rule.Direction {
+	case model.DirectionEgress:
+		return egress
+	case model.DirectionIngress:
+		return ingress
+	default:
+		return egress || ingress
+	}
+}
+
+func validateRule(rule *model.PolicyRule) error {
+	if rule.Name == "" || strings.Contains(rule.Name, "/") {
+		return errInvalid("name cannot be empty or contain a /")
+	}
+	if rule.Action != CONNECTED && rule.Action != DISCONNECTED {
+		return errInvalid("action should be %s or %s", CONNECTED, DISCONNECTED)
+	}
+	switch rule.Direction {
+	case "":
+		rule.Direction = model.DirectionBoth
+	case model.DirectionIngress, model.DirectionEgress, model.DirectionBoth:
+	default:
+		return errInvalid("direction should be %s, %s or %s",
+			model.DirectionIngress, model.DirectionEgress, model.DirectionBoth)
+	}
+	return validatePorts(rule.Ports)
+}
+
+// policyResolver expands the rules and the pair policies into the
+// actions of the traffic between concrete containers.
+type policyResolver struct {
+	rules      []model.PolicyRule
+	pairs      map[string]*model.Policy
+	containers []dockerclient.Container
+}
+
+func (a *Api) rules() ([]model.PolicyRule, error) {
+	pairs, err := a.store.List(pathRule)
+	if err == store.ErrKeyNotFound {
+		return []model.PolicyRule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []model.PolicyRule{}
+	for _, pair := range pairs {
+		var rule model.PolicyRule
+		if err := json.Unmarshal(pair.Value, &rule); err != nil {
+			log.Errorf("error unmarshal rule %s: %v", pair.Key, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Sort(rulesByName(rules))
+	return rules, nil
+}
+
+// rulesByName sorts rules by name.
+type rulesByName []model.PolicyRule
+
+func (r rulesByName) Len() int           { return len(r) }
+func (r rulesByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rulesByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+func (a *Api) newPolicyResolver() (*policyResolver, error) {
+	rules, err := a.rules()
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := a.store.List(pathPolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		return nil, err
+	}
+	pairs := map[string]*model.Policy{}
+	for _, pair := range policies {
+		policy, err := parsePolicyValue(pair.Value)
+		if err != nil {
+			log.Errorf("error parsing policy %s: %v", pair.Key, err)
+			continue
+		}
+		pairs[path.Base(pair.Key)] = policy
+	}
+
+	containers, err := a.client.ListContainers(true, false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyResolver{rules: rules, pairs: pairs, containers: containers}, nil
+}
+
+func containerName(c *dockerclient.Container) string {
+	if len(c.Names) > 0 {
+		return strings.TrimLeft(c.Names[0], "/")
+	}
+	return c.Id
+}
+
+// resolve returns the effective policy of the traffic from src to dst,
+// nil if neither a pair policy nor a rule applies. The policy set on
+// the pair of containers overrides the rules.
+func (p *policyResolver) resolve(src, dst *dockerclient.Container) *model.EffectivePolicy {
+	effective := &model.EffectivePolicy{
+		Source:          src.Id,
+		SourceName:      containerName(src),
+		Destination:     dst.Id,
+		DestinationName: containerName(dst),
+	}
+
+	pid, qid := src.Id, dst.Id
+	if pid > qid {
+		pid, qid = qid, pid
+	}
+	if policy, ok := p.pairs[pid+":"+qid]; ok {
+		effective.Action = policy.Action
+		effective.Ports = policy.Ports
+		return effective
+	}
+
+	var match *model.PolicyRule
+	for i := range p.rules {
+		rule := &p.rules[i]
+		if !matchRule(rule, src, dst) {
+			continue
+		}
+		if match == nil || rule.Priority > match.Priority ||
+			(rule.Priority == match.Priority && rule.Action == DISCONNECTED && match.Action != DISCONNECTED) {
+			match = rule
+		}
+	}
+	if match == nil {
+		return nil
+	}
+	effective.Action = match.Action
+	effective.Ports = match.Ports
+	effective.Rule = match.Name
+	effective.Priority = match.Priority
+	return effective
+}
+
+// expand returns the effective policies of the traffic between every
+// two containers, with src or dst being one of ids if given.
+func (p *policyResolver) expand(ids ...string) []model.EffectivePolicy {
+	selected := func(c *dockerclient.Container) bool {
+		if len(ids) == 0 {
+			return true
+		}
+		for _, id := range ids {
+			if c.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	effective := []model.EffectivePolicy{}
+	for i := range p.containers {
+		for j := range p.containers {
+			src, dst := &p.containers[i], &p.containers[j]
+			if i == j || !(selected(src) || selected(dst)) {
+				continue
+			}
+			if e := p.resolve(src, dst); e != nil {
+				effective = append(effective, *e)
+			}
+		}
+	}
+	return effective
+}
+
+// rulePolicies returns the policies the rules give to the pairs of
+// containers without a pair policy, keyed by their sorted ids. The
+// openflow controller applies a policy both ways, a pair a rule drops
+// one way is dropped, else it gets the action of either way.
+func (p *policyResolver) rulePolicies() map[string]*model.Policy {
+	policies := map[string]*model.Policy{}
+	for i := range p.containers {
+		for j := i + 1; j < len(p.containers); j++ {
+			src, dst := &p.containers[i], &p.containers[j]
+			if src.Id > dst.Id {
+				src, dst = dst, src
+			}
+			key := src.Id + ":" + dst.Id
+			if _, ok := p.pairs[key]; ok {
+				continue
+			}
+
+			var chosen *model.EffectivePolicy
+			for _, e := range []*model.EffectivePolicy{p.resolve(src, dst), p.resolve(dst, src)} {
+				if e != nil && (chosen == nil || (e.Action == DISCONNECTED && chosen.Action != DISCONNECTED)) {
+					chosen = e
+				}
+			}
+			if chosen != nil {
+				policies[key] = &model.Policy{Action: chosen.Action, Ports: chosen.Ports}
+			}
+		}
+	}
+	return policies
+}
+
+// syncRules sends to the openflow controller the policies the rules
+// give to the containers, and deletes those they no longer give. It
+// runs whenever a rule changes or a container comes or goes.
+func (a *Api) syncRules() error {
+	a.ruleLock.Lock()
+	defer a.ruleLock.Unlock()
+
+	resolver, err := a.newPolicyResolver()
+	if err != nil {
+		return err
+	}
+	want := resolver.rulePolicies()
+
+	pairs, err := a.store.List(pathRulePolicy)
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	sent := map[string][]byte{}
+	for _, pair := range pairs {
+		sent[path.Base(pair.Key)] = pair.Value
+	}
+
+	var failed error
+	for key := range sent {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		// The controller holds the pair policy overriding it, if any.
+		if _, ok := resolver.pairs[key]; !ok {
+			ids := strings.SplitN(key, ":", 2)
+			if len(ids) == 2 {
+				if err := a.notifyPolicy(ids[0], ids[1], nil); err != nil {
+					failed = err
+					continue
+				}
+			}
+		}
+		if err := a.store.Delete(path.Join(pathRulePolicy, key)); err != nil && err != store.ErrKeyNotFound {
+			failed = err
+		}
+	}
+
+	for key, policy := range want {
+		value, err := policyValue(policy)
+		if err != nil {
+			return err
+		}
+		if old, ok := sent[key]; ok && bytes.Equal(old, value) {
+			continue
+		}
+		ids := strings.SplitN(key, ":", 2)
+		if err := a.notifyPolicy(ids[0], ids[1], policy); err != nil {
+			failed = err
+			continue
+		}
+		if err := a.store.Put(path.Join(pathRulePolicy, key), value, nil); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// pushRules syncs the rules after a change, the change is done even if
+// the controller could not be told.
+func (a *Api) pushRules(change string) error {
+	if err := a.syncRules(); err != nil {
+		return fmt.Errorf("%s, error notifying the openflow controller: %v", change, err)
+	}
+	return nil
+}
+
+func (a *Api) policyRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := a.rules()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+func (a *Api) getRule(name string) (*model.PolicyRule, error) {
+	pair, err := a.store.Get(path.Join(pathRule, name))
+	if err == store.ErrKeyNotFound {
+		return nil, ErrRuleDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rule model.PolicyRule
+	if err := json.Unmarshal(pair.Value, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (a *Api) policyRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := a.getRule(mux.Vars(r)["name"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(rule); err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+func (a *Api) putRule(rule *model.PolicyRule) error {
+	value, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	return a.store.Put(path.Join(pathRule, rule.Name), value, nil)
+}
+
+func (a *Api) saveRule(w http.ResponseWriter, r *http.Request) {
+	var rule model.PolicyRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+	if err := validateRule(&rule); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	exists, err := a.store.Exists(path.Join(pathRule, rule.Name))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if exists {
+		httpError(w, ErrRuleExists)
+		return
+	}
+
+	auditChange(r, nil, rule)
+	if err := a.putRule(&rule); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := a.pushRules("rule " + rule.Name + " saved"); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) updateRule(w http.ResponseWriter, r *http.Request) {
+	var rule model.PolicyRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		httpError(w, errInvalid("invalid request body: %v", err))
+		return
+	}
+	rule.Name = mux.Vars(r)["name"]
+	if err := validateRule(&rule); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	old, err := a.getRule(rule.Name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	auditChange(r, old, rule)
+	if err := a.putRule(&rule); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := a.pushRules("rule " + rule.Name + " updated"); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) deleteRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := a.getRule(mux.Vars(r)["name"])
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	auditChange(r, rule, nil)
+	if err := a.store.Delete(path.Join(pathRule, rule.Name)); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := a.pushRules("rule " + rule.Name + " deleted"); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// effectivePolicy answers the effective policies of the traffic between
+// the containers of peer, either both ways between two containers or
+// from and to every other container for a single one.
+func (a *Api) effectivePolicy(w http.ResponseWriter, r *http.Request) {
+	peer := mux.Vars(r)["peer"]
+	parts := strings.Split(peer, ":")
+
+	var ids []string
+	switch len(parts) {
+	case 1:
+		info, err := a.client.InspectContainer(parts[0])
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		ids = []string{info.Id}
+	case 2:
+		pInfo, qInfo, err := a.parsePolicy(parts)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		ids = []string{pInfo.Id, qInfo.Id}
+	default:
+		httpError(w, ErrPolicyFormat)
+		return
+	}
+
+	resolver, err := a.newPolicyResolver()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	effective := resolver.expand(ids...)
+	if len(ids) == 2 {
+		// Keep the traffic between the two containers only.
+		between := []model.EffectivePolicy{}
+		for _, e := range effective {
+			if (e.Source == ids[0] && e.Destination == ids[1]) ||
+				(e.Source == ids[1] && e.Destination == ids[0]) {
+				between = append(between, e)
+			}
+		}
+		effective = between
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(effective); err != nil {
+		httpError(w, err)
+		return
+	}
+}
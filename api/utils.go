@@ -3,6 +3,8 @@ package api
 import (
 	"crypto/tls"
 	"net/http"
+	"sort"
+	"strings"
 )
 
 func newClientAndScheme(tlsConfig *tls.Config) *http.Client {
@@ -12,6 +14,27 @@ func newClientAndScheme(tlsConfig *tls.Config) *http.Client {
         return &http.Client{}
 }
 
+// sortedRoutes returns the routes with the fewest variables first, so
+// that a literal route is matched before the variable ones matching it.
+func sortedRoutes(routes map[string]http.HandlerFunc) []string {
+	sorted := []string{}
+	for route := range routes {
+		sorted = append(sorted, route)
+	}
+	sort.Strings(sorted)
+	sort.Stable(routesByVariables(sorted))
+	return sorted
+}
+
+// routesByVariables sorts routes by their number of variables.
+type routesByVariables []string
+
+func (r routesByVariables) Len() int      { return len(r) }
+func (r routesByVariables) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByVariables) Less(i, j int) bool {
+	return strings.Count(r[i], "{") < strings.Count(r[j], "{")
+}
+
 // prevents leak with https
 func closeIdleConnections(client *http.Client) {
     if tr, ok := client.Transport.(*http.Transport); ok {
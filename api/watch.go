@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/docker/libkv/store"
+)
+
+const watchKeepAlive = 30 * time.Second
+
+// watchPaths are the store paths watched for every kind of resource.
+// Members are watched under the path of their group.
+var watchPaths = map[string]string{
+	model.KindGateway:  PathGateway,
+	model.KindGroup:    pathGroup,
+	model.KindPolicy:   pathPolicy,
+	model.KindRule:     pathRule,
+	model.KindFirewall: pathNameFirewall,
+}
+
+// watcher turns the snapshots of store watches into resource events.
+type watcher struct {
+	a      *Api
+	events chan model.WatchEvent
+	stopCh chan struct{}
+}
+
+func (w *watcher) send(e model.WatchEvent) bool {
+	select {
+	case w.events <- e:
+		return true
+	case <-w.stopCh:
+		return false
+	}
+}
+
+// eventValue returns the value of a pair as json if it is json, as a
+// string otherwise.
+func eventValue(value []byte) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(value, &raw); err == nil {
+		return raw
+	}
+	return string(value)
+}
+
+// watch sends an event for every child of dir added, updated or
+// deleted until the watcher stops. The children existing when it
+// starts are sent as added. Every group gets its own member watch.
+func (w *watcher) watch(kind, dir, root string) error {
+	pairsCh, err := w.a.store.WatchTree(dir, w.stopCh)
+	if err != nil {
+		return fmt.Errorf("error watching %s: %v", dir, err)
+	}
+
+	prev := map[string]*store.KVPair{}
+	members := map[string]chan struct{}{}
+	defer func() {
+		for _, stop := range members {
+			close(stop)
+		}
+	}()
+
+	event := func(typ string, pair *store.KVPair) bool {
+		key := strings.Trim(pair.Key, "/")
+		return w.send(model.WatchEvent{
+			Type:  typ,
+			Kind:  kind,
+			Key:   key,
+			Name:  strings.TrimPrefix(key, strings.Trim(root, "/")+"/"),
+			Value: eventValue(pair.Value),
+		})
+	}
+
+	for {
+		var pairs []*store.KVPair
+		select {
+		case p, ok := <-pairsCh:
+			if !ok {
+				return fmt.Errorf("watch of %s closed", dir)
+			}
+			pairs = p
+		case <-w.stopCh:
+			return nil
+		}
+
+		current := map[string]*store.KVPair{}
+		for _, pair := range pairs {
+			key := strings.Trim(pair.Key, "/")
+			if key != strings.Trim(dir, "/") {
+				current[key] = pair
+			}
+		}
+
+		for key, pair := range current {
+			old, ok := prev[key]
+			switch {
+			case !ok:
+				if !event(model.EventAdd, pair) {
+					return nil
+				}
+				if kind == model.KindGroup {
+					stop := make(chan struct{})
+					members[key] = stop
+					go w.watchMembers(key, stop)
+				}
+			case !bytes.Equal(old.Value, pair.Value):
+				if !event(model.EventUpdate, pair) {
+					return nil
+				}
+			}
+		}
+		for key, pair := range prev {
+			if _, ok := current[key]; ok {
+				continue
+			}
+			if stop, ok := members[key]; ok {
+				close(stop)
+				delete(members, key)
+			}
+			if !event(model.EventDelete, pair) {
+				return nil
+			}
+		}
+		prev = current
+	}
+}
+
+// watchMembers watches the members of group until stop is closed.
+func (w *watcher) watchMembers(group string, stop chan struct{}) {
+	members := &watcher{a: w.a, events: w.events, stopCh: make(chan struct{})}
+	go func() {
+		select {
+		case <-stop:
+		case <-w.stopCh:
+		}
+		close(members.stopCh)
+	}()
+
+	if err := members.watch(model.KindMember, group, pathGroup); err != nil {
+		// The watch closes when the group is deleted.
+		log.Debugf("stop watching members of %s: %v", path.Base(group), err)
+	}
+}
+
+// watchEvents streams the changes of the groups, members, policies,
+// firewalls and gateways. Clients accepting text/event-stream receive
+// server-sent events, other clients a stream of json events.
+func (a *Api) watchEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	kinds := map[string]bool{}
+	if value := r.URL.Query().Get("kind"); value != "" {
+		for _, kind := range strings.Split(value, ",") {
+			if kind == model.KindMember {
+				kind = model.KindGroup
+			}
+			if _, ok := watchPaths[kind]; !ok {
+				httpError(w, errInvalid("unknown kind %q", kind))
+				return
+			}
+			kinds[kind] = true
+		}
+	} else {
+		for kind := range watchPaths {
+			kinds[kind] = true
+		}
+	}
+
+	wt := &watcher{
+		a:      a,
+		events: make(chan model.WatchEvent),
+		stopCh: make(chan struct{}),
+	}
+	defer close(wt.stopCh)
+
+	errCh := make(chan error, len(kinds))
+	for kind := range kinds {
+		go func(kind string) {
+			errCh <- wt.watch(kind, watchPaths[kind], watchPaths[kind])
+		}(kind)
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("content-type", "text/event-stream")
+	} else {
+		w.Header().Set("content-type", "application/json")
+	}
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-wt.events:
+			if sse {
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Errorf("error marshal watch event: %v", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case err := <-errCh:
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		case <-keepAlive.C:
+			if sse {
+				fmt.Fprint(w, ": keepalive\n\n")
+			} else {
+				fmt.Fprint(w, "\n")
+			}
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
@@ -3,12 +3,15 @@ package cli
 import (
 	"encoding/json"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/daolinet/daolinet/discovery"
+	"github.com/daolinet/daolinet/discovery/kv"
 	"github.com/daolinet/daolinet/model"
 	"github.com/daolinet/daolinet/netutils"
 )
@@ -37,7 +40,7 @@ func agent(c *cli.Context) {
 		log.Fatalf("discovery required to connect a cluster. See '%s agent --help'.", c.App.Name)
 	}
 
-	ovs := netutils.NewOVS(c.String("bridge"))
+	ovs := netutils.NewOVS(c.String("bridge"), c.String("ovsdb"))
 	dpid, err := ovs.GetDatapath()
 	if err != nil {
 		log.Fatalf("error to get ovs datapath: %v", err)
@@ -76,10 +79,6 @@ func agent(c *cli.Context) {
 	}
 
 	gateway := model.NewGateway(node, host, dpid, intdev, intip, extdev, extip)
-	value, err := json.Marshal(gateway)
-	if err != nil {
-		log.Fatalf("json marshal error: %v", err)
-	}
 
 	hb, err := time.ParseDuration(c.String("heartbeat"))
 	if err != nil {
@@ -97,23 +96,50 @@ func agent(c *cli.Context) {
 	}
 
 	//kv.Init()
-	ttl = 0
 	d, err := discovery.New(dflag, hb, ttl, getDiscoveryOpt(c))
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.WithFields(log.Fields{"addr": extip, "discovery": dflag}).Infof("Registering on the discovery service every %s...", hb)
-	if err := d.Register(dpid, value); err != nil {
+	if err := register(d, gateway, ttl); err != nil {
 		log.Error(err)
 	}
-	//time.Sleep(hb)
+
+	kvDiscovery, ok := d.(*kv.Discovery)
+	if !ok {
+		log.Fatal("Discovery service is only supported with consul, etcd, zookeeper, memory and boltdb discovery.")
+	}
+
+	interval, err := time.ParseDuration(c.String("reconcile-interval"))
+	if err != nil {
+		log.Fatalf("invalid --reconcile-interval: %v", err)
+	}
+	if interval < 1*time.Second {
+		log.Fatal("--reconcile-interval should be at least one second")
+	}
+
+	rules, err := netutils.NewRuleManager(c.String("firewall-backend"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The rules a previous run left keep forwarding until the first
+	// reconcile replaces them at once.
+	r := newReconciler(ovs, netutils.IP{}, rules)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(hb)
+	defer heartbeat.Stop()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 	stopCh := make(chan struct{})
-	defer func() {
-		stopCh <- struct{}{}
+	stop := func(sig os.Signal) {
+		log.Infof("Received %s, shutting down.", sig)
 		close(stopCh)
-	}()
+		shutdown(kvDiscovery, dpid, r, c.Bool("cleanup-on-exit"))
+	}
 
 	for {
 		exists, err := d.Exists(DOCKERNETWORK)
@@ -130,82 +156,80 @@ func agent(c *cli.Context) {
 	Loop:
 		for {
 			select {
-			case pairs := <-eventCh:
-				if err := monitorGateway(ovs, pairs); err != nil {
+			case pairs, ok := <-eventCh:
+				if !ok {
+					break Loop
+				}
+				if err := r.reconcile(pairs); err != nil {
 					log.Error(err)
 				}
+			case <-heartbeat.C:
+				if err := register(d, gateway, ttl); err != nil {
+					log.Errorf("error refreshing registration: %v", err)
+				}
+			case <-ticker.C:
+				log.Debug("running periodic reconcile")
+				if err := reconcileAll(kvDiscovery, r); err != nil {
+					log.Errorf("error reconciling networks: %v", err)
+				}
 			case err := <-errCh:
 				if err != nil {
 					log.Errorf("error chan: %v", err)
 				}
 				break Loop
+			case sig := <-sigCh:
+				stop(sig)
+				return
 			}
 		}
 		log.Warn("Watch to disconnected, retrying again.")
-		time.Sleep(hb / 2)
-	}
-}
-
-func monitorGateway(ovs *netutils.OVS, pairs [][]byte) error {
-	var devMap = make(map[string]string)
-	for _, pair := range pairs {
-		network := model.Network{}
-		if err := network.UnmarshalJSON(pair); err != nil {
-			continue
-		}
-		if network.NetworkType == DRIVERNETWORK {
-			ipamInfo := network.IPAMV4Info
-			if len(ipamInfo) != 1 {
-				log.Error("daolinet driver supported only one subnet")
-				continue
-			}
-			devname := netutils.DeviceByNetwork(network.Id)
-			devMap[devname] = ipamInfo[0].Gateway.String()
+		select {
+		case <-time.After(hb / 2):
+		case sig := <-sigCh:
+			stop(sig)
+			return
 		}
 	}
+}
 
-	var ovsMap = make(map[string]string)
-	ip := netutils.IP{}
-	iptable := netutils.IPtable{}
-
-	out, err := ovs.FindInternal()
+// register stores the gateway in the discovery with a ttl, it has to
+// be called again before the ttl elapses to keep the gateway alive.
+func register(d discovery.Backend, gateway *model.Gateway, ttl time.Duration) error {
+	now := time.Now().UTC()
+	gateway.LastSeen = now
+	gateway.Expires = now.Add(ttl)
+	value, err := json.Marshal(gateway)
 	if err != nil {
 		return err
 	}
+	return d.Register(gateway.DatapathID, value)
+}
 
-	data := map[string][]interface{}{}
-	if err := json.Unmarshal([]byte(out), &data); err != nil {
-		return err
+// shutdown deregisters the gateway and, if cleanup is set, removes the
+// tap ports and nat rules created by the agent.
+func shutdown(d *kv.Discovery, dpid string, r *reconciler, cleanup bool) {
+	if err := d.Deregister(dpid); err != nil {
+		log.Errorf("error deregistering gateway %s: %v", dpid, err)
+	} else {
+		log.WithField("datapath", dpid).Info("Gateway deregistered from the discovery service")
 	}
 
-	for _, names := range data["data"] {
-		name := names.([]interface{})
-		dev := name[0].(string)
-		if dev != DRIVERNETWORK {
-			ovsMap[dev] = dev
-			if _, ok := devMap[dev]; !ok {
-				addr, err := ip.GetAddress(dev)
-				ovs.DeleteNetwork(dev)
-				if err != nil {
-					log.Error(err)
-					break
-				}
-				iptable.DropRule(addr)
-			}
-		}
+	if cleanup {
+		r.cleanup()
 	}
+	r.ovs.Close()
+}
 
-	for key, val := range devMap {
-		if _, ok := ovsMap[key]; !ok {
-			if err := ovs.CreateNetwork(key); err != nil {
-				return err
-			}
-			ip.SetDeviceUP(key)
-			if err := ip.SetAddress(key, val); err != nil {
-				return err
-			}
-			iptable.AddRule(val)
-		}
+// reconcileAll runs a full reconcile against every network in the store.
+func reconcileAll(d *kv.Discovery, r *reconciler) error {
+	networks, err := d.List(DOCKERNETWORK)
+	if err != nil {
+		return err
+	}
+
+	pairs := [][]byte{}
+	for _, network := range networks {
+		pairs = append(pairs, network.Value)
 	}
-	return nil
+	return r.reconcile(pairs)
 }
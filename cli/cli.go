@@ -35,7 +35,7 @@ func Run() {
 		log.SetOutput(os.Stderr)
 		level, err := log.ParseLevel(c.String("log-level"))
 		if err != nil {
-			log.Fatalf(err.Error())
+			log.Fatal(err)
 		}
 		log.SetLevel(level)
 
@@ -73,8 +73,55 @@ func Run() {
                 },
 				cli.BoolFlag{
 					Name:  "allow-insecure",
-					Usage: "enable insecure tls communication",
+					Usage: "do not verify the certificate of the swarm endpoint",
 				},
+				cli.StringFlag{
+					Name:  "swarm-tlscacert",
+					Usage: "trust only a swarm endpoint providing a certificate signed by the CA given here",
+				},
+				cli.StringFlag{
+					Name:  "swarm-tlscert",
+					Usage: "path to the TLS certificate file presented to swarm",
+				},
+				cli.StringFlag{
+					Name:  "swarm-tlskey",
+					Usage: "path to the TLS key file presented to swarm",
+				},
+				cli.StringFlag{
+					Name:  "audit-file",
+					Usage: "append the audit log to this json-lines file instead of the kv store",
+				},
+				cli.StringFlag{
+					Name:  "audit-retention",
+					Usage: "how long audit entries are kept in the kv store, 0 to keep them forever",
+					Value: "720h",
+				},
+				cli.StringFlag{
+					Name:  "gc-interval",
+					Usage: "period between each search of orphan entries in the store, 0 to disable",
+					Value: "10m",
+				},
+				cli.BoolFlag{
+					Name:  "gc-delete",
+					Usage: "delete the orphan entries found, instead of only reporting them",
+				},
+				cli.StringFlag{
+					Name:  "auth-tokens",
+					Usage: "file of bearer tokens, one <token> <name> <role> per line",
+				},
+				cli.StringFlag{
+					Name:  "auth-htpasswd",
+					Usage: "htpasswd file of basic auth users (bcrypt or sha1)",
+				},
+				cli.BoolFlag{
+					Name:  "auth-client-certs",
+					Usage: "authenticate verified tls client certificates by common name",
+				},
+				cli.StringFlag{
+					Name:  "auth-roles",
+					Usage: "file of the roles of basic auth users and certificate names, one <name> <role> per line",
+				},
+				flTLS, flTLSCaCert, flTLSCert, flTLSKey, flTLSVerify,
 				flHeartBeat, flDiscoveryOpt,
 			},
 		},
@@ -89,6 +136,11 @@ func Run() {
 					Usage: "daolinet ovs bridge",
 					Value: "daolinet",
 				},
+				cli.StringFlag{
+					Name:  "ovsdb",
+					Usage: "ovsdb-server endpoint (unix:<path> or tcp:<ip>:<port>)",
+					Value: "unix:/var/run/openvswitch/db.sock",
+				},
 				cli.StringFlag{
 					Name:  "addr",
 					Usage: "discover address",
@@ -97,6 +149,20 @@ func Run() {
 					Name:  "iface",
 					Usage: "docker network interface(format <devname:ip>).",
 				},
+				cli.StringFlag{
+					Name:  "firewall-backend",
+					Usage: "nat and forward rules backend (options: auto, iptables, nftables)",
+					Value: "auto",
+				},
+				cli.BoolFlag{
+					Name:  "cleanup-on-exit",
+					Usage: "remove the tap ports and nat rules created by the agent on exit",
+				},
+				cli.StringFlag{
+					Name:  "reconcile-interval",
+					Usage: "period between each full reconcile of the local networks",
+					Value: "60s",
+				},
 				/*cli.StringFlag{
 					Name:  "int-nic",
 					Usage: "internal network interface",
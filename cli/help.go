@@ -19,6 +19,8 @@ Arguments:
                    * consul://<ip>/<path>
                    * etcd://<ip1>,<ip2>/<path>
                    * file://path/to/file
+                   * memory://[<name>]/<path>
+                   * boltdb://path/to/file.db
                    * zk://<ip1>,<ip2>/<path>
                    * [nodes://]<ip1>,<ip2>{{end}}{{if .Flags}}
 
@@ -0,0 +1,205 @@
+package cli
+
+import (
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daolinet/daolinet/model"
+	"github.com/daolinet/daolinet/netutils"
+)
+
+// bridge manages the tap ports of the local ovs bridge, it is
+// implemented by netutils.OVS.
+type bridge interface {
+	FindInternal() ([]netutils.Interface, error)
+	CreateNetwork(dev string) error
+	DeleteNetwork(dev string) error
+	Close()
+}
+
+// reconciler converges the tap ports of the local ovs bridge, their
+// addresses and the nat rules to the daolinet networks in the store.
+type reconciler struct {
+	ovs   bridge
+	ip    netutils.IPManager
+	rules netutils.RuleManager
+	// synced is set once the nat rules were rebuilt, the first
+	// reconcile replaces the rules a previous run of the agent left.
+	synced bool
+}
+
+func newReconciler(ovs bridge, ip netutils.IPManager, rules netutils.RuleManager) *reconciler {
+	return &reconciler{
+		ovs:   ovs,
+		ip:    ip,
+		rules: rules,
+	}
+}
+
+// network is the local state expected for a daolinet network.
+type network struct {
+	id      string
+	gateway string
+}
+
+// desired returns every daolinet network indexed by its device name.
+func (r *reconciler) desired(pairs [][]byte) map[string]network {
+	var devMap = make(map[string]network)
+	for _, pair := range pairs {
+		n := model.Network{}
+		if err := n.UnmarshalJSON(pair); err != nil {
+			continue
+		}
+		if n.NetworkType == DRIVERNETWORK {
+			ipamInfo := n.IPAMV4Info
+			if len(ipamInfo) != 1 || ipamInfo[0].Gateway == nil {
+				log.WithField("network", n.Id).Error("daolinet driver supported only one subnet")
+				continue
+			}
+			devname := netutils.DeviceByNetwork(n.Id)
+			devMap[devname] = network{id: n.Id, gateway: ipamInfo[0].Gateway.String()}
+		}
+	}
+	return devMap
+}
+
+// actual returns the tap ports found on the ovs bridge.
+func (r *reconciler) actual() (map[string]bool, error) {
+	ifaces, err := r.ovs.FindInternal()
+	if err != nil {
+		return nil, err
+	}
+
+	ports := map[string]bool{}
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, netutils.NETPREFIX) {
+			ports[iface.Name] = true
+		}
+	}
+	return ports, nil
+}
+
+// reconcile repairs the drift between the networks in pairs and the
+// local host. Every device is handled on its own, so that an error on
+// one of them does not leave the others unrepaired.
+func (r *reconciler) reconcile(pairs [][]byte) error {
+	devMap := r.desired(pairs)
+	ports, err := r.actual()
+	if err != nil {
+		return err
+	}
+
+	for dev := range ports {
+		if _, ok := devMap[dev]; !ok {
+			r.removeStale(dev)
+		}
+	}
+
+	rules := map[string]string{}
+	for dev, n := range devMap {
+		if r.ensure(dev, n.gateway, ports[dev]) {
+			_, ipnet, _ := net.ParseCIDR(n.gateway)
+			rules[n.id] = ipnet.String()
+		}
+	}
+	return r.ensureRules(rules)
+}
+
+// removeStale deletes a tap port whose network no longer exists.
+func (r *reconciler) removeStale(dev string) {
+	logger := log.WithField("device", dev)
+	logger.Info("drift: port has no network, deleting it")
+	if err := r.ovs.DeleteNetwork(dev); err != nil {
+		logger.Errorf("error deleting port: %v", err)
+	}
+}
+
+// ensure creates the tap port dev if it is missing and checks that it
+// is up and carries addr. It returns false if the port is not usable.
+func (r *reconciler) ensure(dev, addr string, exists bool) bool {
+	logger := log.WithFields(log.Fields{"device": dev, "addr": addr})
+	if !exists {
+		logger.Info("drift: network has no port, creating it")
+		if err := r.ovs.CreateNetwork(dev); err != nil {
+			logger.Errorf("error creating port: %v", err)
+			return false
+		}
+	}
+
+	if up, err := r.ip.IsDeviceUP(dev); err != nil || !up {
+		logger.Info("drift: port is down, setting it up")
+		if err := r.ip.SetDeviceUP(dev); err != nil {
+			logger.Errorf("error setting port up: %v", err)
+			return false
+		}
+	}
+
+	current, err := r.ip.GetAddress(dev)
+	if err != nil || current != addr {
+		if current != "" && current != addr {
+			logger.WithField("current", current).Info("drift: port address changed, replacing it")
+			if err := r.ip.DeleteAddress(dev, current); err != nil {
+				logger.Warnf("error deleting address: %v", err)
+			}
+		} else {
+			logger.Info("drift: port has no address, setting it")
+		}
+		if err := r.ip.SetAddress(dev, addr); err != nil {
+			logger.Errorf("error setting address: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// ensureRules rebuilds the nat rules if they differ from rules,
+// a map of network id to subnet, or if they were never rebuilt.
+func (r *reconciler) ensureRules(rules map[string]string) error {
+	current, err := r.rules.Networks()
+	if err != nil {
+		return err
+	}
+
+	drift := !r.synced
+	for id, addr := range rules {
+		if current[id] != addr {
+			log.WithFields(log.Fields{"network": id, "addr": addr}).Info("drift: nat rules missing")
+			drift = true
+		}
+	}
+	for id, addr := range current {
+		if _, ok := rules[id]; !ok {
+			log.WithFields(log.Fields{"network": id, "addr": addr}).Info("drift: nat rules for a removed network")
+			drift = true
+		}
+	}
+
+	if drift {
+		log.WithField("networks", len(rules)).Info("rebuilding nat rules")
+		if err := r.rules.Sync(rules); err != nil {
+			return err
+		}
+		r.synced = true
+	}
+	return nil
+}
+
+// cleanup removes every tap port of the bridge and every nat rule.
+func (r *reconciler) cleanup() {
+	ports, err := r.actual()
+	if err != nil {
+		log.Errorf("error listing ports: %v", err)
+	}
+	for dev := range ports {
+		log.WithField("device", dev).Info("deleting port")
+		if err := r.ovs.DeleteNetwork(dev); err != nil {
+			log.WithField("device", dev).Errorf("error deleting port: %v", err)
+		}
+	}
+
+	log.Info("flushing nat rules")
+	if err := r.rules.Flush(); err != nil {
+		log.Errorf("error flushing nat rules: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/daolinet/daolinet/netutils"
+)
+
+// fakeIP is an IPManager keeping the state of the devices in memory.
+type fakeIP struct {
+	up    map[string]bool
+	addrs map[string]string
+	// fail makes every change of the device fail.
+	fail  string
+	calls []string
+}
+
+func newFakeIP() *fakeIP {
+	return &fakeIP{up: map[string]bool{}, addrs: map[string]string{}}
+}
+
+func (f *fakeIP) change(call, dev string) error {
+	f.calls = append(f.calls, call+" "+dev)
+	if dev == f.fail {
+		return errors.New("device busy")
+	}
+	return nil
+}
+
+func (f *fakeIP) SetDeviceUP(dev string) error {
+	if err := f.change("up", dev); err != nil {
+		return err
+	}
+	f.up[dev] = true
+	return nil
+}
+
+func (f *fakeIP) SetDeviceDown(dev string) error {
+	if err := f.change("down", dev); err != nil {
+		return err
+	}
+	f.up[dev] = false
+	return nil
+}
+
+func (f *fakeIP) IsDeviceUP(dev string) (bool, error) {
+	return f.up[dev], nil
+}
+
+func (f *fakeIP) DeleteDevice(dev string) error {
+	if err := f.change("delete", dev); err != nil {
+		return err
+	}
+	delete(f.up, dev)
+	delete(f.addrs, dev)
+	return nil
+}
+
+func (f *fakeIP) GetAddress(dev string) (string, error) {
+	addr, ok := f.addrs[dev]
+	if !ok {
+		return "", netutils.ErrNoAddress
+	}
+	return addr, nil
+}
+
+func (f *fakeIP) SetAddress(dev, address string) error {
+	if err := f.change("set-address", dev); err != nil {
+		return err
+	}
+	f.addrs[dev] = address
+	return nil
+}
+
+func (f *fakeIP) DeleteAddress(dev, address string) error {
+	if err := f.change("delete-address", dev); err != nil {
+		return err
+	}
+	delete(f.addrs, dev)
+	return nil
+}
+
+func (f *fakeIP) AddRoute(dst, gw, dev string) error {
+	return f.change("route", dev)
+}
+
+// fakeBridge is a bridge keeping its ports in memory.
+type fakeBridge struct {
+	ports map[string]bool
+}
+
+func (b *fakeBridge) FindInternal() ([]netutils.Interface, error) {
+	ifaces := []netutils.Interface{{Name: "br0", Type: "internal"}}
+	for dev := range b.ports {
+		ifaces = append(ifaces, netutils.Interface{Name: dev, Type: "internal"})
+	}
+	return ifaces, nil
+}
+
+func (b *fakeBridge) CreateNetwork(dev string) error {
+	b.ports[dev] = true
+	return nil
+}
+
+func (b *fakeBridge) DeleteNetwork(dev string) error {
+	delete(b.ports, dev)
+	return nil
+}
+
+func (b *fakeBridge) Close() {}
+
+// fakeRules is a RuleManager keeping its networks in memory.
+type fakeRules struct {
+	networks map[string]string
+	syncs    int
+}
+
+func (r *fakeRules) Sync(networks map[string]string) error {
+	r.syncs++
+	r.networks = map[string]string{}
+	for id, addr := range networks {
+		r.networks[id] = addr
+	}
+	return nil
+}
+
+func (r *fakeRules) Networks() (map[string]string, error) {
+	return r.networks, nil
+}
+
+func (r *fakeRules) Flush() error {
+	r.networks = map[string]string{}
+	return nil
+}
+
+// networkPair encodes a network the way libnetwork stores it.
+func networkPair(t *testing.T, id, driver, gateway string) []byte {
+	ipamData, _ := json.Marshal(map[string]string{"AddressSpace": "", "Gateway": gateway})
+	ipamInfo, _ := json.Marshal([]map[string]string{{"PoolID": "pool", "IPAMData": string(ipamData)}})
+	b, err := json.Marshal(map[string]string{"id": id, "networkType": driver, "ipamV4Info": string(ipamInfo)})
+	if err != nil {
+		t.Fatalf("marshal network: %v", err)
+	}
+	return b
+}
+
+const (
+	netA = "aaaaaaaaaaaaaaaaaaaa"
+	netB = "bbbbbbbbbbbbbbbbbbbb"
+	netC = "cccccccccccccccccccc"
+)
+
+func TestReconcile(t *testing.T) {
+	devA, devB := netutils.DeviceByNetwork(netA), netutils.DeviceByNetwork(netB)
+	stale := netutils.DeviceByNetwork(netC)
+
+	tests := []struct {
+		name     string
+		ports    []string
+		up       map[string]bool
+		addrs    map[string]string
+		rules    map[string]string
+		fail     string
+		calls    []string
+		wantPort []string
+		addrsOut map[string]string
+		rulesOut map[string]string
+		syncs    int
+	}{
+		{
+			name:     "missing ports are created",
+			calls:    []string{"up " + devA, "set-address " + devA, "up " + devB, "set-address " + devB},
+			wantPort: []string{devA, devB},
+			addrsOut: map[string]string{devA: "10.1.0.1/24", devB: "10.2.0.1/24"},
+			rulesOut: map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24"},
+			syncs:    1,
+		},
+		{
+			name:     "converged host is left alone",
+			ports:    []string{devA, devB},
+			up:       map[string]bool{devA: true, devB: true},
+			addrs:    map[string]string{devA: "10.1.0.1/24", devB: "10.2.0.1/24"},
+			rules:    map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24"},
+			wantPort: []string{devA, devB},
+			addrsOut: map[string]string{devA: "10.1.0.1/24", devB: "10.2.0.1/24"},
+			rulesOut: map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24"},
+		},
+		{
+			name:     "drifted address and stale port are repaired",
+			ports:    []string{devA, devB, stale},
+			up:       map[string]bool{devA: true, devB: true},
+			addrs:    map[string]string{devA: "10.9.0.1/24", devB: "10.2.0.1/24"},
+			rules:    map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24", netC: "10.3.0.0/24"},
+			calls:    []string{"delete-address " + devA, "set-address " + devA},
+			wantPort: []string{devA, devB},
+			addrsOut: map[string]string{devA: "10.1.0.1/24", devB: "10.2.0.1/24"},
+			rulesOut: map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24"},
+			syncs:    1,
+		},
+		{
+			name:     "failing device keeps its network out of the rules",
+			ports:    []string{devA, devB},
+			up:       map[string]bool{devB: true},
+			addrs:    map[string]string{devB: "10.2.0.1/24"},
+			rules:    map[string]string{netA: "10.1.0.0/24", netB: "10.2.0.0/24"},
+			fail:     devA,
+			calls:    []string{"up " + devA},
+			wantPort: []string{devA, devB},
+			addrsOut: map[string]string{devB: "10.2.0.1/24"},
+			rulesOut: map[string]string{netB: "10.2.0.0/24"},
+			syncs:    1,
+		},
+	}
+
+	pairs := [][]byte{
+		networkPair(t, netA, DRIVERNETWORK, "10.1.0.1/24"),
+		networkPair(t, netB, DRIVERNETWORK, "10.2.0.1/24"),
+		networkPair(t, "dddddddddddddddddddd", "bridge", "172.17.0.1/16"),
+		[]byte("invalid"),
+	}
+	for _, test := range tests {
+		ip := newFakeIP()
+		for dev, up := range test.up {
+			ip.up[dev] = up
+		}
+		for dev, addr := range test.addrs {
+			ip.addrs[dev] = addr
+		}
+		ip.fail = test.fail
+		br := &fakeBridge{ports: map[string]bool{}}
+		for _, dev := range test.ports {
+			br.ports[dev] = true
+		}
+		rules := &fakeRules{networks: test.rules}
+		if rules.networks == nil {
+			rules.networks = map[string]string{}
+		}
+
+		r := newReconciler(br, ip, rules)
+		r.synced = true
+		if err := r.reconcile(pairs); err != nil {
+			t.Fatalf("%s: reconcile: %v", test.name, err)
+		}
+
+		sort.Strings(ip.calls)
+		sort.Strings(test.calls)
+		if !reflect.DeepEqual(ip.calls, test.calls) {
+			t.Errorf("%s: calls = %v, want %v", test.name, ip.calls, test.calls)
+		}
+		ports := []string{}
+		for dev := range br.ports {
+			ports = append(ports, dev)
+		}
+		sort.Strings(ports)
+		if !reflect.DeepEqual(ports, test.wantPort) {
+			t.Errorf("%s: ports = %v, want %v", test.name, ports, test.wantPort)
+		}
+		if !reflect.DeepEqual(ip.addrs, test.addrsOut) {
+			t.Errorf("%s: addresses = %v, want %v", test.name, ip.addrs, test.addrsOut)
+		}
+		if !reflect.DeepEqual(rules.networks, test.rulesOut) || rules.syncs != test.syncs {
+			t.Errorf("%s: rules = %v after %d syncs, want %v after %d", test.name, rules.networks, rules.syncs, test.rulesOut, test.syncs)
+		}
+	}
+}
+
+func TestFirstReconcile(t *testing.T) {
+	devA := netutils.DeviceByNetwork(netA)
+	ip := newFakeIP()
+	ip.up[devA] = true
+	ip.addrs[devA] = "10.1.0.1/24"
+	br := &fakeBridge{ports: map[string]bool{devA: true}}
+	rules := &fakeRules{networks: map[string]string{netA: "10.1.0.0/24"}}
+	pairs := [][]byte{networkPair(t, netA, DRIVERNETWORK, "10.1.0.1/24")}
+
+	// The rules left by a previous run are replaced, not flushed, even
+	// if they look converged.
+	r := newReconciler(br, ip, rules)
+	for i := 0; i < 2; i++ {
+		if err := r.reconcile(pairs); err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+	}
+	if rules.syncs != 1 {
+		t.Errorf("rules synced %d times, want once", rules.syncs)
+	}
+	if !reflect.DeepEqual(rules.networks, map[string]string{netA: "10.1.0.0/24"}) {
+		t.Errorf("rules = %v", rules.networks)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dev := netutils.DeviceByNetwork(netA)
+	br := &fakeBridge{ports: map[string]bool{dev: true}}
+	rules := &fakeRules{networks: map[string]string{netA: "10.1.0.0/24"}}
+
+	newReconciler(br, newFakeIP(), rules).cleanup()
+	if len(br.ports) != 0 {
+		t.Errorf("ports left after cleanup: %v", br.ports)
+	}
+	if len(rules.networks) != 0 {
+		t.Errorf("rules left after cleanup: %v", rules.networks)
+	}
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
         "crypto/tls"
+        "fmt"
         "strings"
         "time"
 
@@ -31,10 +32,13 @@ func server(c *cli.Context) {
     discovery := createDiscovery(uri, c, c.StringSlice("discovery-opt"))
     kvDiscovery, ok := discovery.(*kv.Discovery)
     if !ok {
-        log.Fatal("Discovery service is only supported with consul, etcd and zookeeper discovery.")
+        log.Fatal("Discovery service is only supported with consul, etcd, zookeeper, memory and boltdb discovery.")
     }
 
-    var tlsConfig *tls.Config
+    tlsConfig, err := getSwarmTLSConfig(c, swarmUrl, allowInsecure)
+    if err != nil {
+        log.Fatal(err)
+    }
     client, err := dockerclient.NewDockerClient(swarmUrl, tlsConfig)
     if err != nil {
         log.Fatal(err)
@@ -42,12 +46,46 @@ func server(c *cli.Context) {
 
     log.Debugf("connected to swarm: url=%s", swarmUrl)
 
+    serverTLSConfig, err := getServerTLSConfig(c)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    authenticators, err := getAuthenticators(c)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if len(authenticators) == 0 {
+        log.Warn("no authentication configured, the api is open to anyone reaching it")
+    }
+
+    auditRetention, err := time.ParseDuration(c.String("audit-retention"))
+    if err != nil {
+        log.Fatalf("invalid --audit-retention: %v", err)
+    }
+    var audit api.AuditLog = api.NewKVAudit(kvDiscovery, auditRetention)
+    if file := c.String("audit-file"); file != "" {
+        if audit, err = api.NewFileAudit(file); err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    gcInterval, err := time.ParseDuration(c.String("gc-interval"))
+    if err != nil {
+        log.Fatalf("invalid --gc-interval: %v", err)
+    }
+
     apiConfig := api.ApiConfig{
         ListenAddr: listenAddr,
         OfcUrl: ofcUrl, 
         Client: client,
         Store: kvDiscovery,
         AllowInsecure: allowInsecure,
+        Authenticators: authenticators,
+        TLSConfig: serverTLSConfig,
+        Audit: audit,
+        GCInterval: gcInterval,
+        GCDelete: c.Bool("gc-delete"),
     }
 
     daolinetApi, err := api.NewApi(apiConfig)
@@ -60,6 +98,99 @@ func server(c *cli.Context) {
     }
 }
 
+// getServerTLSConfig returns the tls configuration of the controller
+// listener, or nil to serve plain http. Client certificates are
+// required with --tlsverify, and verified if given with --tlscacert.
+func getServerTLSConfig(c *cli.Context) (*tls.Config, error) {
+    if !c.Bool("tls") && !c.Bool("tlsverify") {
+        return nil, nil
+    }
+
+    options := kv.Options{
+        CAFile: c.String("tlscacert"),
+        CertFile: c.String("tlscert"),
+        KeyFile: c.String("tlskey"),
+    }
+    if options.CertFile == "" || options.KeyFile == "" {
+        return nil, fmt.Errorf("--tls requires --tlscert and --tlskey")
+    }
+
+    switch {
+    case c.Bool("tlsverify"):
+        if options.CAFile == "" {
+            return nil, fmt.Errorf("--tlsverify requires --tlscacert")
+        }
+        options.ClientAuth = tls.RequireAndVerifyClientCert
+    case options.CAFile != "":
+        options.ClientAuth = tls.VerifyClientCertIfGiven
+    }
+
+    return kv.Server(options)
+}
+
+// getSwarmTLSConfig returns the tls configuration of the swarm client,
+// or nil if swarm is reached in plain http. Tls is used for an https
+// url or once a swarm certificate is given.
+func getSwarmTLSConfig(c *cli.Context, swarmUrl string, allowInsecure bool) (*tls.Config, error) {
+    options := kv.Options{
+        CAFile: c.String("swarm-tlscacert"),
+        CertFile: c.String("swarm-tlscert"),
+        KeyFile: c.String("swarm-tlskey"),
+        InsecureSkipVerify: allowInsecure,
+    }
+    if !strings.HasPrefix(swarmUrl, "https://") &&
+        options.CAFile == "" && options.CertFile == "" && options.KeyFile == "" {
+        return nil, nil
+    }
+    if (options.CertFile == "") != (options.KeyFile == "") {
+        return nil, fmt.Errorf("--swarm-tlscert and --swarm-tlskey should be given together")
+    }
+    if allowInsecure {
+        log.Warn("the certificate of the swarm endpoint is not verified")
+    }
+
+    return kv.Client(options)
+}
+
+// getAuthenticators returns the authenticators enabled by the flags,
+// in the order they are tried.
+func getAuthenticators(c *cli.Context) ([]api.Authenticator, error) {
+    authenticators := []api.Authenticator{}
+
+    roles := map[string]string{}
+    if file := c.String("auth-roles"); file != "" {
+        var err error
+        if roles, err = api.LoadRoles(file); err != nil {
+            return nil, err
+        }
+    }
+
+    if file := c.String("auth-tokens"); file != "" {
+        auth, err := api.NewTokenAuth(file)
+        if err != nil {
+            return nil, err
+        }
+        authenticators = append(authenticators, auth)
+    }
+
+    if file := c.String("auth-htpasswd"); file != "" {
+        auth, err := api.NewBasicAuth(file, roles)
+        if err != nil {
+            return nil, err
+        }
+        authenticators = append(authenticators, auth)
+    }
+
+    if c.Bool("auth-client-certs") {
+        if c.String("tlscacert") == "" || (!c.Bool("tls") && !c.Bool("tlsverify")) {
+            return nil, fmt.Errorf("--auth-client-certs requires --tls and --tlscacert")
+        }
+        authenticators = append(authenticators, api.NewCertAuth(roles))
+    }
+
+    return authenticators, nil
+}
+
 // Initialize the discovery service.
 func createDiscovery(uri string, c *cli.Context, discoveryOpt []string) discovery.Backend {
     hb, err := time.ParseDuration(c.String("heartbeat"))
@@ -0,0 +1,538 @@
+// Package client is a Go client of the daolinet controller /api
+// endpoints.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daolinet/daolinet/model"
+)
+
+// Error is an error answered by the controller.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    interface{}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("daolinet: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Client talks to a daolinet controller.
+type Client struct {
+	URL        *url.URL
+	HTTPClient *http.Client
+
+	// Token is sent as a bearer token if it is set, otherwise
+	// Username and Password as basic credentials if they are set.
+	Token    string
+	Username string
+	Password string
+}
+
+// NewClient returns a client of the controller at addr, either a
+// host:port or an url. tlsConfig may be nil for plain http.
+func NewClient(addr string, tlsConfig *tls.Config) (*Client, error) {
+	if !strings.Contains(addr, "://") {
+		scheme := "http://"
+		if tlsConfig != nil {
+			scheme = "https://"
+		}
+		addr = scheme + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return &Client{URL: u, HTTPClient: httpClient}, nil
+}
+
+// do sends the request and decodes the json response into out, if it
+// is not nil.
+func (c *Client) do(method, p string, in, out interface{}) error {
+	resp, err := c.request(method, p, "application/json", in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// doText sends the request and returns the text response.
+func (c *Client) doText(method, p string, in interface{}) (string, error) {
+	resp, err := c.request(method, p, "text/plain", in)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (c *Client) request(method, p, accept string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := *c.URL
+	if i := strings.Index(p, "?"); i >= 0 {
+		p, u.RawQuery = p[:i], p[i+1:]
+	}
+	u.Path = path.Join(u.Path, p)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var body model.Error
+		if err := json.Unmarshal(data, &body); err != nil || body.Message == "" {
+			body.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Code:       body.Code,
+			Message:    body.Message,
+			Details:    body.Details,
+		}
+	}
+	return resp, nil
+}
+
+// Audit returns the audit entries between since and until made by
+// actor, the most recent limit ones if limit is positive. Zero values
+// match every entry.
+func (c *Client) Audit(since, until time.Time, actor string, limit int) ([]model.AuditEntry, error) {
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339))
+	}
+	if !until.IsZero() {
+		query.Set("until", until.Format(time.RFC3339))
+	}
+	if actor != "" {
+		query.Set("actor", actor)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var entries []model.AuditEntry
+	err := c.do("GET", "/api/audit?"+query.Encode(), nil, &entries)
+	return entries, err
+}
+
+// Export returns the groups, policies, rules and firewalls as a
+// document naming the containers.
+func (c *Client) Export() (*model.Document, error) {
+	var doc model.Document
+	if err := c.do("GET", "/api/export", nil, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Apply reconciles the state with doc, deleting the resources missing
+// from it if prune is set. A dry run returns the changes without
+// making them.
+func (c *Client) Apply(doc *model.Document, dryRun, prune bool) (*model.ApplyResult, error) {
+	query := url.Values{}
+	query.Set("dryRun", strconv.FormatBool(dryRun))
+	query.Set("prune", strconv.FormatBool(prune))
+
+	var result model.ApplyResult
+	if err := c.do("POST", "/api/apply?"+query.Encode(), doc, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Orphans returns the entries of deleted containers and networks left
+// in the store.
+func (c *Client) Orphans() ([]model.Orphan, error) {
+	var orphans []model.Orphan
+	err := c.do("GET", "/api/gc", nil, &orphans)
+	return orphans, err
+}
+
+// CollectGarbage deletes the orphan entries and returns them.
+func (c *Client) CollectGarbage() ([]model.Orphan, error) {
+	var orphans []model.Orphan
+	err := c.do("POST", "/api/gc", nil, &orphans)
+	return orphans, err
+}
+
+// Watch streams the changes of the resources of kinds, or of every
+// kind if none is given, until stopCh is closed. The resources existing
+// when the watch starts are first sent as added. The events channel is
+// closed when the stream ends, after the cause is sent on the error
+// channel, nil if stopCh was closed.
+func (c *Client) Watch(stopCh <-chan struct{}, kinds ...string) (<-chan model.WatchEvent, <-chan error, error) {
+	p := "/api/watch"
+	if len(kinds) > 0 {
+		p += "?" + url.Values{"kind": {strings.Join(kinds, ",")}}.Encode()
+	}
+	resp, err := c.request("GET", p, "application/json", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eventCh := make(chan model.WatchEvent)
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stopCh:
+		case <-done:
+		}
+		resp.Body.Close()
+	}()
+
+	go func() {
+		defer close(eventCh)
+		defer close(done)
+
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var e model.WatchEvent
+			if err := dec.Decode(&e); err != nil {
+				select {
+				case <-stopCh:
+					errCh <- nil
+				default:
+					errCh <- err
+				}
+				return
+			}
+			select {
+			case eventCh <- e:
+			case <-stopCh:
+				errCh <- nil
+				return
+			}
+		}
+	}()
+	return eventCh, errCh, nil
+}
+
+// Gateways lists the gateways with their health.
+func (c *Client) Gateways() ([]model.GatewayStatus, error) {
+	var gateways []model.GatewayStatus
+	err := c.do("GET", "/api/gateways", nil, &gateways)
+	return gateways, err
+}
+
+// Gateway returns the gateway of the datapath id.
+func (c *Client) Gateway(id string) (*model.GatewayStatus, error) {
+	var gateway model.GatewayStatus
+	if err := c.do("GET", path.Join("/api/gateways", id), nil, &gateway); err != nil {
+		return nil, err
+	}
+	return &gateway, nil
+}
+
+// DrainGateway cordons the gateway id and starts the jobs migrating
+// the containers of its node, it returns them at once, WaitJob
+// waits for each to finish.
+func (c *Client) DrainGateway(id string, req model.DrainRequest) (*model.DrainResult, error) {
+	var result model.DrainResult
+	if err := c.do("POST", path.Join("/api/gateways", id, "drain"), req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CordonGateway marks the gateway id as taking no new container.
+func (c *Client) CordonGateway(id string) (*model.Cordon, error) {
+	var cordon model.Cordon
+	if err := c.do("POST", path.Join("/api/gateways", id, "cordon"), nil, &cordon); err != nil {
+		return nil, err
+	}
+	return &cordon, nil
+}
+
+// UncordonGateway lets the gateway id take new containers again.
+func (c *Client) UncordonGateway(id string) error {
+	return c.do("POST", path.Join("/api/gateways", id, "uncordon"), nil, nil)
+}
+
+// Groups lists the group names.
+func (c *Client) Groups() ([]string, error) {
+	var groups []string
+	err := c.do("GET", "/api/groups", nil, &groups)
+	return groups, err
+}
+
+// CreateGroup creates the group name.
+func (c *Client) CreateGroup(name string) error {
+	return c.do("POST", "/api/groups", model.GroupRequest{Name: name}, nil)
+}
+
+// Group lists the members of the group name.
+func (c *Client) Group(name string) ([]string, error) {
+	var members []string
+	err := c.do("GET", path.Join("/api/groups", name), nil, &members)
+	return members, err
+}
+
+// DeleteGroup deletes the group name and its members.
+func (c *Client) DeleteGroup(name string) error {
+	return c.do("DELETE", path.Join("/api/groups", name), nil, nil)
+}
+
+// AddMember adds member to the group name.
+func (c *Client) AddMember(name, member string) error {
+	return c.do("POST", path.Join("/api/groups", name), model.MemberRequest{Member: member}, nil)
+}
+
+// DeleteMember removes member from the group name.
+func (c *Client) DeleteMember(name, member string) error {
+	return c.do("DELETE", path.Join("/api/groups", name, member), nil, nil)
+}
+
+// Policies returns the actions by pair of container names.
+func (c *Client) Policies() (map[string]string, error) {
+	var policies map[string]string
+	err := c.do("GET", "/api/policy", nil, &policies)
+	return policies, err
+}
+
+// Policy returns the action between the containers of peer, of the
+// form <CONTAINER:CONTAINER>, or an empty string if there is none.
+func (c *Client) Policy(peer string) (string, error) {
+	return c.doText("GET", path.Join("/api/policy", peer), nil)
+}
+
+// PolicyPorts returns the actions by protocol and ports of the policy
+// between the containers of peer.
+func (c *Client) PolicyPorts(peer string) ([]model.PolicyPort, error) {
+	var ports []model.PolicyPort
+	err := c.do("GET", path.Join("/api/policy", peer, "ports"), nil, &ports)
+	return ports, err
+}
+
+// SetPolicy sets the action, ACCEPT or DROP, between the containers of
+// peer, ports optionally set another action for some protocols and ports.
+func (c *Client) SetPolicy(peer, action string, ports ...model.PolicyPort) error {
+	return c.do("POST", path.Join("/api/policy", peer), model.PolicyRequest{Action: action, Ports: ports}, nil)
+}
+
+// DeletePolicy deletes the policy between the containers of peer.
+func (c *Client) DeletePolicy(peer string) error {
+	return c.do("DELETE", path.Join("/api/policy", peer), nil, nil)
+}
+
+// Evaluate returns whether the source container can talk to the
+// destination, optionally on a protocol and port, along with the trace
+// of the policies leading to it.
+func (c *Client) Evaluate(req model.EvaluateRequest) (*model.Evaluation, error) {
+	var e model.Evaluation
+	if err := c.do("POST", "/api/policy/evaluate", req, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// EffectivePolicies resolves the policies of the traffic between the
+// containers of peer, either <CONTAINER:CONTAINER> or a single container.
+func (c *Client) EffectivePolicies(peer string) ([]model.EffectivePolicy, error) {
+	var effective []model.EffectivePolicy
+	err := c.do("GET", path.Join("/api/policy", peer, "effective"), nil, &effective)
+	return effective, err
+}
+
+// Rules lists the policy rules.
+func (c *Client) Rules() ([]model.PolicyRule, error) {
+	var rules []model.PolicyRule
+	err := c.do("GET", "/api/rules", nil, &rules)
+	return rules, err
+}
+
+// Rule returns the policy rule name.
+func (c *Client) Rule(name string) (*model.PolicyRule, error) {
+	var rule model.PolicyRule
+	if err := c.do("GET", path.Join("/api/rules", name), nil, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// CreateRule creates a policy rule.
+func (c *Client) CreateRule(rule model.PolicyRule) error {
+	return c.do("POST", "/api/rules", rule, nil)
+}
+
+// UpdateRule replaces the policy rule of the same name.
+func (c *Client) UpdateRule(rule model.PolicyRule) error {
+	return c.do("PUT", path.Join("/api/rules", rule.Name), rule, nil)
+}
+
+// DeleteRule deletes the policy rule name.
+func (c *Client) DeleteRule(name string) error {
+	return c.do("DELETE", path.Join("/api/rules", name), nil, nil)
+}
+
+// Firewalls lists the firewalls.
+func (c *Client) Firewalls() ([]model.Firewall, error) {
+	var firewalls []model.Firewall
+	err := c.do("GET", "/api/firewalls", nil, &firewalls)
+	return firewalls, err
+}
+
+// CreateFirewall creates the firewall and returns it as stored.
+func (c *Client) CreateFirewall(firewall model.Firewall) (*model.Firewall, error) {
+	var created model.Firewall
+	if err := c.do("POST", "/api/firewalls", firewall, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ContainerFirewalls lists the firewalls of the container.
+func (c *Client) ContainerFirewalls(container string) ([]model.Firewall, error) {
+	var firewalls []model.Firewall
+	err := c.do("GET", path.Join("/api/firewalls", container), nil, &firewalls)
+	return firewalls, err
+}
+
+// Firewall returns the firewall on the protocol port of the gateway
+// datapath node, the first port of its range.
+func (c *Client) Firewall(node, protocol string, port int) (*model.Firewall, error) {
+	var firewall model.Firewall
+	if err := c.do("GET", path.Join("/api/firewalls", node, protocol, strconv.Itoa(port)), nil, &firewall); err != nil {
+		return nil, err
+	}
+	return &firewall, nil
+}
+
+// DeleteFirewall deletes the firewall name and returns it.
+func (c *Client) DeleteFirewall(name string) (*model.Firewall, error) {
+	var firewall model.Firewall
+	if err := c.do("DELETE", path.Join("/api/firewalls", name), nil, &firewall); err != nil {
+		return nil, err
+	}
+	return &firewall, nil
+}
+
+// Container returns the network endpoints of the container.
+func (c *Client) Container(id string) ([]model.ContainerNetwork, error) {
+	var networks []model.ContainerNetwork
+	err := c.do("GET", path.Join("/api/containers", id), nil, &networks)
+	return networks, err
+}
+
+// ResetContainer recreates the container, on node if it is not empty,
+// waits for the migration and returns the id of the new container.
+func (c *Client) ResetContainer(id, node string) (string, error) {
+	job, err := c.MigrateContainer(id, model.ResetRequest{Node: node})
+	if err != nil {
+		return "", err
+	}
+	job, err = c.WaitJob(job.Id, time.Second)
+	if err != nil {
+		return "", err
+	}
+	if job.Status != model.StatusDone {
+		return "", fmt.Errorf("daolinet: migration of %s %s: %s", job.Name, job.Status, job.Error)
+	}
+	return job.Migration.NewContainer, nil
+}
+
+// MigrateContainer starts a job migrating the container as requested
+// and returns the job.
+func (c *Client) MigrateContainer(id string, req model.ResetRequest) (*model.Job, error) {
+	var job model.Job
+	if err := c.do("PUT", path.Join("/api/containers", id, "reset"), req, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs returns the migration jobs, oldest first.
+func (c *Client) Jobs() ([]model.Job, error) {
+	var jobs []model.Job
+	err := c.do("GET", "/api/jobs", nil, &jobs)
+	return jobs, err
+}
+
+// Job returns the migration job id along with the status of its steps.
+func (c *Client) Job(id string) (*model.Job, error) {
+	var job model.Job
+	if err := c.do("GET", path.Join("/api/jobs", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels the migration job id, which rolls back its steps.
+func (c *Client) CancelJob(id string) (*model.Job, error) {
+	var job model.Job
+	if err := c.do("POST", path.Join("/api/jobs", id, "cancel"), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// WaitJob polls the migration job id every interval until it is
+// finished and returns it.
+func (c *Client) WaitJob(id string, interval time.Duration) (*model.Job, error) {
+	for {
+		job, err := c.Job(id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status != model.StatusPending && job.Status != model.StatusRunning {
+			return job, nil
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daolinet/daolinet/model"
+)
+
+// recorder answers every request with status and body and records the
+// last request it served.
+type recorder struct {
+	status int
+	body   string
+	req    *http.Request
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.req = req
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.status)
+	w.Write([]byte(r.body))
+}
+
+func newTestClient(t *testing.T, status int, body string) (*Client, *recorder, func()) {
+	rec := &recorder{status: status, body: body}
+	server := httptest.NewServer(rec)
+	c, err := NewClient(server.URL, nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return c, rec, server.Close
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		addr string
+		url  string
+	}{
+		{"127.0.0.1:8080", "http://127.0.0.1:8080"},
+		{"http://ctl:8080/base", "http://ctl:8080/base"},
+		{"https://ctl:8443", "https://ctl:8443"},
+	}
+	for _, test := range tests {
+		c, err := NewClient(test.addr, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if u := c.URL.String(); u != test.url {
+			t.Errorf("%s: url = %s, want %s", test.addr, u, test.url)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		err    Error
+	}{
+		{
+			status: http.StatusConflict,
+			body:   `{"code":"conflict","message":"rule web exists.","details":["web"]}`,
+			err: Error{
+				StatusCode: http.StatusConflict,
+				Code:       "conflict",
+				Message:    "rule web exists.",
+				Details:    []interface{}{"web"},
+			},
+		},
+		{
+			status: http.StatusNotFound,
+			body:   `{"code":"not_found","message":"no rule web."}`,
+			err:    Error{StatusCode: http.StatusNotFound, Code: "not_found", Message: "no rule web."},
+		},
+		{
+			status: http.StatusInternalServerError,
+			body:   "store unavailable\n",
+			err:    Error{StatusCode: http.StatusInternalServerError, Message: "store unavailable"},
+		},
+	}
+	for _, test := range tests {
+		c, _, done := newTestClient(t, test.status, test.body)
+		_, err := c.Rule("web")
+		done()
+
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%d: error = %#v, want a *Error", test.status, err)
+			continue
+		}
+		if !reflect.DeepEqual(*e, test.err) {
+			t.Errorf("%d: error = %+v, want %+v", test.status, *e, test.err)
+		}
+	}
+}
+
+func TestRequestQuery(t *testing.T) {
+	c, rec, done := newTestClient(t, http.StatusOK, "[]")
+	defer done()
+	c.URL.Path = "/base"
+
+	since := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := c.Audit(since, time.Time{}, "admin", 10); err != nil {
+		t.Fatal(err)
+	}
+	if rec.req.URL.Path != "/base/api/audit" {
+		t.Errorf("path = %s, want /base/api/audit", rec.req.URL.Path)
+	}
+	want := map[string][]string{
+		"since": {"2016-01-02T03:04:05Z"},
+		"actor": {"admin"},
+		"limit": {"10"},
+	}
+	if query := map[string][]string(rec.req.URL.Query()); !reflect.DeepEqual(query, want) {
+		t.Errorf("query = %v, want %v", query, want)
+	}
+
+	if _, err := c.Orphans(); err != nil {
+		t.Fatal(err)
+	}
+	if rec.req.URL.Path != "/base/api/gc" || rec.req.URL.RawQuery != "" {
+		t.Errorf("url = %s, want /base/api/gc", rec.req.URL)
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	tests := []struct {
+		token    string
+		username string
+		password string
+		auth     string
+	}{
+		{auth: ""},
+		{token: "secret", auth: "Bearer secret"},
+		{username: "admin", password: "pass", auth: "Basic YWRtaW46cGFzcw=="},
+		{token: "secret", username: "admin", password: "pass", auth: "Bearer secret"},
+	}
+	for _, test := range tests {
+		c, rec, done := newTestClient(t, http.StatusOK, "{}")
+		c.Token, c.Username, c.Password = test.token, test.username, test.password
+		_, err := c.CreateFirewall(model.Firewall{Name: "web"})
+		done()
+		if err != nil {
+			t.Errorf("%q: %v", test.auth, err)
+			continue
+		}
+
+		if auth := rec.req.Header.Get("Authorization"); auth != test.auth {
+			t.Errorf("%q: authorization = %q", test.auth, auth)
+		}
+		if accept := rec.req.Header.Get("Accept"); accept != "application/json" {
+			t.Errorf("%q: accept = %q", test.auth, accept)
+		}
+		if ct := rec.req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%q: content type = %q", test.auth, ct)
+		}
+	}
+
+	c, rec, done := newTestClient(t, http.StatusOK, "allow")
+	defer done()
+	if _, err := c.Policy("a:b"); err != nil {
+		t.Fatal(err)
+	}
+	if accept := rec.req.Header.Get("Accept"); !strings.HasPrefix(accept, "text/plain") {
+		t.Errorf("accept of a text request = %q", accept)
+	}
+	if ct := rec.req.Header.Get("Content-Type"); ct != "" {
+		t.Errorf("content type of a request without body = %q", ct)
+	}
+}
@@ -23,6 +23,8 @@ type Backend interface {
 
 	// Register to the discovery
 	Register(string, []byte) error
+	// Deregister from the discovery
+	Deregister(string) error
 	Watch(string, <-chan struct{}) (<-chan [][]byte, <-chan error)
 	Exists(string) (bool, error)
 	PutTree(string) error
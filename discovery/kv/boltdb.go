@@ -0,0 +1,123 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+)
+
+const (
+	boltDefaultBucket = "daolinet"
+	boltFilePerm      = 0600
+	boltOpenTimeout   = 10 * time.Second
+
+	boltFlagValue = 0
+	boltFlagDir   = 1
+)
+
+// ErrBoltMultipleEndpoints is returned when more than one file is given to
+// the boltdb store.
+var ErrBoltMultipleEndpoints = errors.New("boltdb supports one endpoint and should be a file path")
+
+// BoltDB is a file backed store. Every key is kept in memory and written
+// through to a bolt database, so it supports watches like Memory does and
+// its content survives a restart. Keys written with a TTL are not saved.
+type BoltDB struct {
+	*Memory
+	db     *bolt.DB
+	bucket []byte
+}
+
+func registerBoltDB() {
+	libkv.AddStore(store.BOLTDB, newBoltDBStore)
+}
+
+func newBoltDBStore(addrs []string, options *store.Config) (store.Store, error) {
+	if len(addrs) != 1 || addrs[0] == "" {
+		return nil, ErrBoltMultipleEndpoints
+	}
+	bucket := boltDefaultBucket
+	if options != nil && options.Bucket != "" {
+		bucket = options.Bucket
+	}
+	return NewBoltDB(addrs[0], bucket)
+}
+
+// NewBoltDB opens or creates the database at file and loads the
+// content of bucket into memory.
+func NewBoltDB(file, bucket string) (*BoltDB, error) {
+	if dir := filepath.Dir(file); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(file, boltFilePerm, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BoltDB{
+		Memory: NewMemory(),
+		db:     db,
+		bucket: []byte(bucket),
+	}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.Memory.backing = s
+	return s, nil
+}
+
+func (s *BoltDB) load() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(s.bucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s.Memory.index++
+			e := &entry{index: s.Memory.index}
+			if len(v) > 0 {
+				e.dir = v[0] == boltFlagDir
+				e.value = append([]byte(nil), v[1:]...)
+			}
+			s.Memory.entries[string(k)] = e
+			return nil
+		})
+	})
+}
+
+func (s *BoltDB) persist(key string, e *entry) error {
+	flag := byte(boltFlagValue)
+	if e.dir {
+		flag = boltFlagDir
+	}
+	value := append([]byte{flag}, e.value...)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), value)
+	})
+}
+
+func (s *BoltDB) remove(keys []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close the underlying database
+func (s *BoltDB) Close() {
+	s.db.Close()
+}
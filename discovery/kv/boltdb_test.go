@@ -0,0 +1,78 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/docker/libkv/store"
+)
+
+func tempBoltDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "daolinet-kv")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	return filepath.Join(dir, "store.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestBoltDB(t *testing.T) {
+	file, cleanup := tempBoltDB(t)
+	defer cleanup()
+
+	s, err := NewBoltDB(file, boltDefaultBucket)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestBoltDBReopen(t *testing.T) {
+	file, cleanup := tempBoltDB(t)
+	defer cleanup()
+
+	s, err := NewBoltDB(file, boltDefaultBucket)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for _, key := range []string{"r/leaf", "r/leaf/child", "r/other"} {
+		if err := s.Put(key, []byte(key), nil); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	if err := s.Put("r/ephemeral", []byte("v"), &store.WriteOptions{TTL: time.Minute}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	s.Close()
+
+	s, err = NewBoltDB(file, boltDefaultBucket)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if keys := listKeys(t, s, "r"); !reflect.DeepEqual(keys, []string{"r/leaf", "r/other"}) {
+		t.Fatalf("list r after reopen = %v", keys)
+	}
+	if keys := listKeys(t, s, "r/leaf"); !reflect.DeepEqual(keys, []string{"r/leaf/child"}) {
+		t.Fatalf("list r/leaf after reopen = %v", keys)
+	}
+	pair, err := s.Get("r/leaf")
+	if err != nil || string(pair.Value) != "r/leaf" {
+		t.Fatalf("get r/leaf after reopen = %v, %v", pair, err)
+	}
+
+	// The leaf a child was put under is saved as a directory.
+	var saved []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		saved = tx.Bucket(s.bucket).Get([]byte("r/leaf"))
+		return nil
+	})
+	if len(saved) == 0 || saved[0] != boltFlagDir || string(saved[1:]) != "r/leaf" {
+		t.Fatalf("r/leaf saved as %q, want a directory", saved)
+	}
+}
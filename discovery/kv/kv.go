@@ -35,11 +35,15 @@ func Init() {
 	zookeeper.Register()
 	consul.Register()
 	etcd.Register()
+	registerMemory()
+	registerBoltDB()
 
 	// Register to internal discovery service
 	discovery.Register("zk", &Discovery{backend: store.ZK})
 	discovery.Register("consul", &Discovery{backend: store.CONSUL})
 	discovery.Register("etcd", &Discovery{backend: store.ETCD})
+	discovery.Register("memory", &Discovery{backend: MEMORY})
+	discovery.Register("boltdb", &Discovery{backend: store.BOLTDB})
 }
 
 // Initialize is exported
@@ -55,6 +59,12 @@ func (s *Discovery) Initialize(uris string, heartbeat time.Duration, ttl time.Du
 		s.prefix = parts[1]
 	}
 
+	// The boltdb uri is the path of the database file.
+	if s.backend == store.BOLTDB {
+		addrs = []string{uris}
+		s.prefix = ""
+	}
+
 	s.heartbeat = heartbeat
 	s.ttl = ttl
 
@@ -101,6 +111,11 @@ func (s *Discovery) Register(dpid string, gateway []byte) error {
 	return s.store.Put(path.Join(s.path, dpid), gateway, opts)
 }
 
+// Deregister is exported
+func (s *Discovery) Deregister(dpid string) error {
+	return s.store.Delete(path.Join(s.path, dpid))
+}
+
 // Store returns the underlying store used by KV discovery
 func (s *Discovery) Store() store.Store {
 	return s.store
@@ -149,6 +164,12 @@ func (s *Discovery) DeleteTree(directory string) error {
 	return s.store.DeleteTree(directory)
 }
 
+// WatchTree watches the children of path, the channel receives all
+// of them, with their keys, on every change until stopCh is closed
+func (s *Discovery) WatchTree(path string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.store.WatchTree(path, stopCh)
+}
+
 // Watch is exported
 func (s *Discovery) Watch(path string, stopCh <-chan struct{}) (<-chan [][]byte, <-chan error) {
 	errCh := make(chan error)
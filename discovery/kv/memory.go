@@ -0,0 +1,432 @@
+package kv
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+)
+
+// MEMORY backend keeps every key in process memory.
+const MEMORY store.Backend = "memory"
+
+// ErrDirNotEmpty is returned when deleting a directory that still has
+// children, use DeleteTree to remove it.
+var ErrDirNotEmpty = errors.New("directory not empty")
+
+var (
+	memoryLock   sync.Mutex
+	memoryStores = map[string]*Memory{}
+)
+
+type (
+	entry struct {
+		value []byte
+		index uint64
+		dir   bool
+		timer *time.Timer
+	}
+
+	watcher struct {
+		key    string
+		tree   bool
+		notify chan struct{}
+	}
+
+	// persister is called before a change is applied in memory, so that
+	// a file backed store can reject the change if it can not be saved.
+	persister interface {
+		persist(key string, e *entry) error
+		remove(keys []string) error
+	}
+
+	// Memory is an in-process implementation of store.Store.
+	// Keys are slash separated paths, every parent of a key
+	// is implicitly created as a directory.
+	Memory struct {
+		sync.Mutex
+		entries  map[string]*entry
+		index    uint64
+		watchers map[*watcher]struct{}
+		backing  persister
+	}
+)
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		entries:  map[string]*entry{},
+		watchers: map[*watcher]struct{}{},
+	}
+}
+
+// newMemoryStore returns the in-memory store shared by every caller
+// in this process that uses the same name, so that a server and an
+// agent started in one process see the same data.
+func newMemoryStore(addrs []string, options *store.Config) (store.Store, error) {
+	name := ""
+	if len(addrs) > 0 {
+		name = addrs[0]
+	}
+
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+	s, ok := memoryStores[name]
+	if !ok {
+		s = NewMemory()
+		memoryStores[name] = s
+	}
+	return s, nil
+}
+
+func registerMemory() {
+	libkv.AddStore(MEMORY, newMemoryStore)
+}
+
+func normalize(key string) string {
+	return strings.Trim(key, "/")
+}
+
+func parent(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+func isChild(dir, key string) bool {
+	if dir == "" {
+		return key != ""
+	}
+	return strings.HasPrefix(key, dir+"/")
+}
+
+func (s *Memory) pair(key string, e *entry) *store.KVPair {
+	value := make([]byte, len(e.value))
+	copy(value, e.value)
+	return &store.KVPair{Key: key, Value: value, LastIndex: e.index}
+}
+
+// children returns the direct children of dir.
+func (s *Memory) children(dir string) []*store.KVPair {
+	pairs := []*store.KVPair{}
+	for key, e := range s.entries {
+		if isChild(dir, key) && parent(key) == dir {
+			pairs = append(pairs, s.pair(key, e))
+		}
+	}
+	return pairs
+}
+
+func (s *Memory) notify(key string) {
+	for w := range s.watchers {
+		if w.key == key || (w.tree && (isChild(w.key, key) || isChild(key, w.key))) {
+			select {
+			case w.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// mkdirs creates every missing parent directory of key, a parent
+// holding a value becomes a directory keeping its value.
+func (s *Memory) mkdirs(key string) error {
+	for dir := parent(key); dir != ""; dir = parent(dir) {
+		if e, ok := s.entries[dir]; ok {
+			if e.dir {
+				continue
+			}
+			converted := *e
+			converted.dir = true
+			if s.backing != nil && e.timer == nil {
+				if err := s.backing.persist(dir, &converted); err != nil {
+					return err
+				}
+			}
+			e.dir = true
+			continue
+		}
+		e := &entry{dir: true, index: s.index}
+		if s.backing != nil {
+			if err := s.backing.persist(dir, e); err != nil {
+				return err
+			}
+		}
+		s.entries[dir] = e
+	}
+	return nil
+}
+
+func (s *Memory) put(key string, value []byte, options *store.WriteOptions) (*entry, error) {
+	s.index++
+	e := &entry{value: value, index: s.index}
+	if options != nil {
+		e.dir = options.IsDir
+	}
+	if old, ok := s.entries[key]; ok {
+		if old.timer != nil {
+			old.timer.Stop()
+		}
+		e.dir = e.dir || old.dir
+	}
+
+	ephemeral := options != nil && options.TTL > 0
+	if s.backing != nil {
+		if ephemeral {
+			// Ephemeral keys do not survive a restart.
+			if err := s.backing.remove([]string{key}); err != nil {
+				return nil, err
+			}
+		} else if err := s.backing.persist(key, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.mkdirs(key); err != nil {
+		return nil, err
+	}
+	if ephemeral {
+		index := e.index
+		e.timer = time.AfterFunc(options.TTL, func() {
+			s.expire(key, index)
+		})
+	}
+	s.entries[key] = e
+	s.notify(key)
+	return e, nil
+}
+
+func (s *Memory) expire(key string, index uint64) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.entries[key]; ok && e.index == index {
+		delete(s.entries, key)
+		s.notify(key)
+	}
+}
+
+func (s *Memory) remove(keys []string) error {
+	if s.backing != nil {
+		if err := s.backing.remove(keys); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if e, ok := s.entries[key]; ok && e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(s.entries, key)
+	}
+	for _, key := range keys {
+		s.notify(key)
+	}
+	return nil
+}
+
+// Put a value at the specified key
+func (s *Memory) Put(key string, value []byte, options *store.WriteOptions) error {
+	s.Lock()
+	defer s.Unlock()
+	_, err := s.put(normalize(key), value, options)
+	return err
+}
+
+// Get a value given its key
+func (s *Memory) Get(key string) (*store.KVPair, error) {
+	s.Lock()
+	defer s.Unlock()
+	key = normalize(key)
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return s.pair(key, e), nil
+}
+
+// Delete the value at the specified key
+func (s *Memory) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	key = normalize(key)
+	if _, ok := s.entries[key]; !ok {
+		return store.ErrKeyNotFound
+	}
+	if len(s.children(key)) > 0 {
+		return ErrDirNotEmpty
+	}
+	return s.remove([]string{key})
+}
+
+// Exists verifies if a key exists in the store
+func (s *Memory) Exists(key string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.entries[normalize(key)]
+	return ok, nil
+}
+
+// List the direct children of a given directory
+func (s *Memory) List(directory string) ([]*store.KVPair, error) {
+	s.Lock()
+	defer s.Unlock()
+	directory = normalize(directory)
+	if _, ok := s.entries[directory]; !ok && directory != "" {
+		return nil, store.ErrKeyNotFound
+	}
+	return s.children(directory), nil
+}
+
+// DeleteTree deletes a directory and every key under it
+func (s *Memory) DeleteTree(directory string) error {
+	s.Lock()
+	defer s.Unlock()
+	directory = normalize(directory)
+	keys := []string{}
+	for key := range s.entries {
+		if key == directory || isChild(directory, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return store.ErrKeyNotFound
+	}
+	return s.remove(keys)
+}
+
+// watch calls send once and then again on every change to key, until
+// send returns false or stopCh is closed. done is called on return.
+func (s *Memory) watch(key string, tree bool, stopCh <-chan struct{}, send func() bool, done func()) {
+	w := &watcher{key: key, tree: tree, notify: make(chan struct{}, 1)}
+	s.Lock()
+	s.watchers[w] = struct{}{}
+	s.Unlock()
+
+	go func() {
+		defer func() {
+			s.Lock()
+			delete(s.watchers, w)
+			s.Unlock()
+			done()
+		}()
+		for {
+			if !send() {
+				return
+			}
+			select {
+			case <-w.notify:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Watch for changes on a key. The current value is sent first,
+// then a value is sent every time the key is modified.
+func (s *Memory) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	key = normalize(key)
+	if _, err := s.Get(key); err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan *store.KVPair)
+	s.watch(key, false, stopCh, func() bool {
+		pair, err := s.Get(key)
+		if err != nil {
+			return false
+		}
+		select {
+		case watchCh <- pair:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}, func() { close(watchCh) })
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on the direct children of a
+// directory. The whole list of children is sent on every change.
+func (s *Memory) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	directory = normalize(directory)
+	if _, err := s.List(directory); err != nil {
+		return nil, err
+	}
+
+	watchCh := make(chan []*store.KVPair)
+	s.watch(directory, true, stopCh, func() bool {
+		pairs, err := s.List(directory)
+		if err != nil {
+			return false
+		}
+		select {
+		case watchCh <- pairs:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}, func() { close(watchCh) })
+	return watchCh, nil
+}
+
+// NewLock is not supported by the in-memory store
+func (s *Memory) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// AtomicPut puts a value at key only if the key has not been
+// modified since previous was read. Pass previous = nil to
+// create a new key.
+func (s *Memory) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	s.Lock()
+	defer s.Unlock()
+	key = normalize(key)
+	e, ok := s.entries[key]
+	if previous == nil {
+		if ok {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if !ok {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if e.index != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+
+	e, err := s.put(key, value, options)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, s.pair(key, e), nil
+}
+
+// AtomicDelete deletes a value at key only if the key has not
+// been modified since previous was read.
+func (s *Memory) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	key = normalize(key)
+	e, ok := s.entries[key]
+	if !ok {
+		return false, store.ErrKeyNotFound
+	}
+	if e.index != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := s.remove([]string{key}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Close the store
+func (s *Memory) Close() {}
@@ -0,0 +1,210 @@
+package kv
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/libkv/store"
+)
+
+func listKeys(t *testing.T, s store.Store, dir string) []string {
+	pairs, err := s.List(dir)
+	if err != nil {
+		t.Fatalf("list %s: %v", dir, err)
+	}
+	keys := []string{}
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testPutGet(t *testing.T, s store.Store) {
+	if err := s.Put("/a/b/c", []byte("v1"), nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	pair, err := s.Get("a/b/c")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if pair.Key != "a/b/c" || string(pair.Value) != "v1" {
+		t.Fatalf("get a/b/c = %s %q", pair.Key, pair.Value)
+	}
+	if ok, _ := s.Exists("a/b"); !ok {
+		t.Fatalf("parent a/b was not created")
+	}
+	if _, err := s.Get("a/x"); err != store.ErrKeyNotFound {
+		t.Fatalf("get missing key: %v", err)
+	}
+
+	if err := s.Put("a/b/c", []byte("v2"), nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	updated, _ := s.Get("a/b/c")
+	if string(updated.Value) != "v2" || updated.LastIndex <= pair.LastIndex {
+		t.Fatalf("update a/b/c = %q index %d, was index %d", updated.Value, updated.LastIndex, pair.LastIndex)
+	}
+}
+
+func testList(t *testing.T, s store.Store) {
+	for _, key := range []string{"l/x", "l/y", "l/d/z"} {
+		if err := s.Put(key, []byte(key), nil); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	if keys := listKeys(t, s, "l"); !reflect.DeepEqual(keys, []string{"l/d", "l/x", "l/y"}) {
+		t.Fatalf("list l = %v", keys)
+	}
+	if _, err := s.List("missing"); err != store.ErrKeyNotFound {
+		t.Fatalf("list missing: %v", err)
+	}
+	if err := s.Delete("l/d"); err != ErrDirNotEmpty {
+		t.Fatalf("delete non empty directory: %v", err)
+	}
+	if err := s.DeleteTree("l/d"); err != nil {
+		t.Fatalf("delete tree: %v", err)
+	}
+	if keys := listKeys(t, s, "l"); !reflect.DeepEqual(keys, []string{"l/x", "l/y"}) {
+		t.Fatalf("list l after delete tree = %v", keys)
+	}
+}
+
+func testLeafToDir(t *testing.T, s store.Store) {
+	if err := s.Put("f/leaf", []byte("value"), nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := s.Put("f/leaf/child", []byte("child"), nil); err != nil {
+		t.Fatalf("put under a leaf: %v", err)
+	}
+	pair, err := s.Get("f/leaf")
+	if err != nil || string(pair.Value) != "value" {
+		t.Fatalf("get converted leaf = %v, %v", pair, err)
+	}
+	if keys := listKeys(t, s, "f/leaf"); !reflect.DeepEqual(keys, []string{"f/leaf/child"}) {
+		t.Fatalf("list f/leaf = %v", keys)
+	}
+}
+
+func receiveTree(t *testing.T, ch <-chan []*store.KVPair) []string {
+	select {
+	case pairs := <-ch:
+		keys := []string{}
+		for _, pair := range pairs {
+			keys = append(keys, pair.Key)
+		}
+		sort.Strings(keys)
+		return keys
+	case <-time.After(time.Second):
+		t.Fatalf("no change received")
+	}
+	return nil
+}
+
+func testWatchTree(t *testing.T, s store.Store) {
+	if err := s.Put("w/a", nil, nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	stop := make(chan struct{})
+	ch, err := s.WatchTree("w", stop)
+	if err != nil {
+		t.Fatalf("watch tree: %v", err)
+	}
+	if keys := receiveTree(t, ch); !reflect.DeepEqual(keys, []string{"w/a"}) {
+		t.Fatalf("first watch = %v", keys)
+	}
+	if err := s.Put("w/b", nil, nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if keys := receiveTree(t, ch); !reflect.DeepEqual(keys, []string{"w/a", "w/b"}) {
+		t.Fatalf("watch after put = %v", keys)
+	}
+	if err := s.Delete("w/a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if keys := receiveTree(t, ch); !reflect.DeepEqual(keys, []string{"w/b"}) {
+		t.Fatalf("watch after delete = %v", keys)
+	}
+
+	close(stop)
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("change received after stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watch not closed after stop")
+	}
+}
+
+func testTTL(t *testing.T, s store.Store) {
+	if err := s.Put("t/key", []byte("v"), &store.WriteOptions{TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if ok, _ := s.Exists("t/key"); !ok {
+		t.Fatalf("key expired too early")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ok, _ := s.Exists("t/key"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("key did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testAtomicPut(t *testing.T, s store.Store) {
+	ok, pair, err := s.AtomicPut("at/key", []byte("v1"), nil, nil)
+	if !ok || err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, _, err := s.AtomicPut("at/key", []byte("v1"), nil, nil); err != store.ErrKeyExists {
+		t.Fatalf("create existing key: %v", err)
+	}
+	ok, updated, err := s.AtomicPut("at/key", []byte("v2"), pair, nil)
+	if !ok || err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if _, _, err := s.AtomicPut("at/key", []byte("v3"), pair, nil); err != store.ErrKeyModified {
+		t.Fatalf("update with a stale pair: %v", err)
+	}
+	if _, _, err := s.AtomicPut("at/missing", []byte("v"), pair, nil); err != store.ErrKeyNotFound {
+		t.Fatalf("update missing key: %v", err)
+	}
+	if _, err := s.AtomicDelete("at/key", pair); err != store.ErrKeyModified {
+		t.Fatalf("delete with a stale pair: %v", err)
+	}
+	if ok, err := s.AtomicDelete("at/key", updated); !ok || err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+}
+
+// testStore runs the tests every store should pass.
+func testStore(t *testing.T, s store.Store) {
+	tests := []struct {
+		name string
+		test func(*testing.T, store.Store)
+	}{
+		{"PutGet", testPutGet},
+		{"List", testList},
+		{"LeafToDir", testLeafToDir},
+		{"WatchTree", testWatchTree},
+		{"TTL", testTTL},
+		{"AtomicPut", testAtomicPut},
+	}
+	for _, test := range tests {
+		test.test(t, s)
+		if t.Failed() {
+			t.Fatalf("%s failed", test.name)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
@@ -0,0 +1,119 @@
+package model
+
+// DocumentVersion is the version of the documents of GET /api/export.
+const DocumentVersion = "v1"
+
+// Operations of the changes of POST /api/apply.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Request and response bodies of the /api endpoints.
+type (
+	// GroupRequest is the body of POST /api/groups.
+	GroupRequest struct {
+		Name string `json:"name"`
+	}
+
+	// MemberRequest is the body of POST /api/groups/{name}.
+	MemberRequest struct {
+		Member string `json:"member"`
+	}
+
+	// PolicyRequest is the body of POST /api/policy/{peer}, Action is
+	// either ACCEPT or DROP. Ports optionally set another action for
+	// the traffic of some protocols and ports.
+	PolicyRequest struct {
+		Action string       `json:"action"`
+		Ports  []PolicyPort `json:"ports,omitempty"`
+	}
+
+	// EvaluateRequest is the body of POST /api/policy/evaluate, the
+	// traffic from Source to Destination optionally of a protocol and
+	// a port.
+	EvaluateRequest struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+		Protocol    string `json:"protocol,omitempty"`
+		Port        int    `json:"port,omitempty"`
+	}
+
+	// ResetRequest is the body of PUT /api/containers/{id}/reset, Node
+	// optionally constrains the swarm node of the new container, or
+	// else Strategy chooses it. Checkpoint moves the running processes
+	// along with the container through a checkpoint in CheckpointDir,
+	// which both nodes share.
+	ResetRequest struct {
+		Node          string `json:"node,omitempty"`
+		Strategy      string `json:"strategy,omitempty"`
+		Checkpoint    bool   `json:"checkpoint,omitempty"`
+		CheckpointDir string `json:"checkpointDir,omitempty"`
+	}
+
+	// DrainRequest is the body of POST /api/gateways/{id}/drain, at
+	// most Concurrency containers are migrated at once. Strategy,
+	// Checkpoint and CheckpointDir are those of ResetRequest.
+	DrainRequest struct {
+		Concurrency   int    `json:"concurrency,omitempty"`
+		Strategy      string `json:"strategy,omitempty"`
+		Checkpoint    bool   `json:"checkpoint,omitempty"`
+		CheckpointDir string `json:"checkpointDir,omitempty"`
+	}
+
+	// DrainResult is the response of POST /api/gateways/{id}/drain,
+	// the jobs migrating the containers of the gateway.
+	DrainResult struct {
+		Gateway string
+		Node    string
+		Jobs    []Job
+	}
+
+	// ContainerNetwork is a network endpoint of a container, as
+	// returned by GET /api/containers/{id}.
+	ContainerNetwork struct {
+		Id          string
+		NetworkName string
+		IPAddress   string
+		MacAddress  string
+		Gateway     string
+		VIPAddress  string
+	}
+
+	// Document is the declarative state of daolinet, as answered by
+	// GET /api/export and taken by POST /api/apply. Containers are
+	// named, Groups are the members by group.
+	Document struct {
+		Version   string
+		Groups    map[string][]string `json:",omitempty"`
+		Policies  []DocumentPolicy    `json:",omitempty"`
+		Rules     []PolicyRule        `json:",omitempty"`
+		Firewalls []Firewall          `json:",omitempty"`
+	}
+
+	// DocumentPolicy is the policy between the containers of Peer, of
+	// the form <CONTAINER:CONTAINER>.
+	DocumentPolicy struct {
+		Peer   string
+		Action string
+		Ports  []PolicyPort `json:",omitempty"`
+	}
+
+	// Change is a change of POST /api/apply to reconcile the state
+	// with a document.
+	Change struct {
+		Op     string
+		Kind   string
+		Name   string
+		Before interface{} `json:",omitempty"`
+		After  interface{} `json:",omitempty"`
+	}
+
+	// ApplyResult is the response of POST /api/apply, the changes made
+	// or, on a dry run, the changes to make.
+	ApplyResult struct {
+		DryRun  bool
+		Changes []Change
+	}
+)
@@ -1,5 +1,77 @@
 package model
 
+import "time"
+
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+const (
+	KindGateway  = "gateway"
+	KindGroup    = "group"
+	KindMember   = "member"
+	KindPolicy   = "policy"
+	KindFirewall = "firewall"
+	KindRule     = "rule"
+)
+
+// Protocols of the ports of a policy.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolICMP = "icmp"
+)
+
+// Steps of the evaluation of a policy, from the most to the least
+// specific one.
+const (
+	StepPolicy   = "policy"
+	StepRule     = "rule"
+	StepGroup    = "group"
+	StepSubnet   = "subnet"
+	StepFirewall = "firewall"
+)
+
+// Directions of a policy rule, relative to its source containers.
+const (
+	DirectionIngress = "ingress"
+	DirectionEgress  = "egress"
+	DirectionBoth    = "both"
+)
+
+// Strategies placing the new container of a migration, swarm places it
+// if none is given.
+const (
+	StrategyLeastLoaded = "least-loaded"
+	StrategySpread      = "spread"
+	StrategyAffinity    = "affinity"
+)
+
+// Steps of a container migration, in the order they are taken.
+const (
+	MigrationCheckpoint = "checkpoint"
+	MigrationStop       = "stop"
+	MigrationRename     = "rename"
+	MigrationCreate     = "create"
+	MigrationConnect    = "connect"
+	MigrationRebind     = "rebind"
+	MigrationStart      = "start"
+	MigrationVerify     = "verify"
+	MigrationRemove     = "remove"
+)
+
+// Statuses of the jobs, of the container migrations and of their steps.
+const (
+	StatusPending    = "pending"
+	StatusRunning    = "running"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+	StatusRolledBack = "rolled-back"
+	StatusCanceled   = "canceled"
+)
+
 type (
 	Gateway struct {
 		Node       string
@@ -9,15 +81,226 @@ type (
 		IntIP      string
 		ExtDev     string
 		ExtIP      string
+		LastSeen   time.Time
+		Expires    time.Time
 	}
 
-	Firewall struct {
+	// Error is the body of every api error response.
+	Error struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Details interface{} `json:"details,omitempty"`
+	}
+
+	// GatewayStatus is a gateway along with its liveness, a cordoned
+	// gateway takes no new container.
+	GatewayStatus struct {
+		Gateway
+		Healthy  bool
+		Cordoned bool
+	}
+
+	// Cordon marks the gateway of a swarm node as taking no new
+	// container, until it is uncordoned. Node is the name of the swarm
+	// node, resolved from the address of the gateway.
+	Cordon struct {
+		Gateway string
+		Node    string
+		Time    time.Time
+	}
+
+	// AuditEntry records a request changing the state of the api.
+	AuditEntry struct {
+		Time       time.Time
+		Actor      string
+		Role       string `json:",omitempty"`
+		Remote     string
+		Method     string
+		Route      string
+		Path       string
+		Containers []string    `json:",omitempty"`
+		Before     interface{} `json:",omitempty"`
+		After      interface{} `json:",omitempty"`
+		Status     int
+		Result     string
+	}
+
+	// WatchEvent is a change of a resource, Name is the key of the
+	// resource relative to the path of its kind.
+	WatchEvent struct {
+		Type  string
+		Kind  string
+		Key   string
+		Name  string
+		Value interface{} `json:",omitempty"`
+	}
+
+	// PortRange is an inclusive range of ports.
+	PortRange struct {
+		From int
+		To   int
+	}
+
+	// PolicyPort sets the action of the traffic of a protocol to the
+	// port ranges, or to every port if there is none. Ports are
+	// ignored for icmp.
+	PolicyPort struct {
+		Protocol string
+		Ports    []PortRange `json:",omitempty"`
+		Action   string
+	}
+
+	// Policy is the policy set on a pair of containers, Action applies
+	// to the traffic matching none of Ports.
+	Policy struct {
+		Action string
+		Ports  []PolicyPort `json:",omitempty"`
+	}
+
+	// Selector selects containers by labels and networks. A container
+	// matches if it has every label and is attached to one of the
+	// networks, an empty selector matches every container.
+	Selector struct {
+		Labels   map[string]string `json:",omitempty"`
+		Networks []string          `json:",omitempty"`
+	}
+
+	// PolicyRule sets the action, ACCEPT or DROP, of the traffic between
+	// the containers of two selectors. Egress rules apply to the traffic
+	// from Source to Destination, ingress rules to the traffic from
+	// Destination to Source. The matching rule of highest priority wins,
+	// DROP wins over ACCEPT at equal priority. Ports override Action for
+	// the traffic they match.
+	PolicyRule struct {
 		Name        string
-		Container   string
-		DatapathID  string
-		GatewayIP   string
-		GatewayPort int
-		ServicePort int
+		Source      Selector
+		Destination Selector
+		Direction   string
+		Priority    int
+		Action      string
+		Ports       []PolicyPort `json:",omitempty"`
+	}
+
+	// EffectivePolicy is the action of the traffic from a container to
+	// another and the rule it comes from, Rule is empty for the policy
+	// set on the pair of containers.
+	EffectivePolicy struct {
+		Source          string
+		SourceName      string
+		Destination     string
+		DestinationName string
+		Action          string
+		Ports           []PolicyPort `json:",omitempty"`
+		Rule            string       `json:",omitempty"`
+		Priority        int
+	}
+
+	// EvaluateStep is a policy considered by an evaluation, Action is
+	// empty for the steps not deciding the traffic and Applied is set
+	// on the step which decided it.
+	EvaluateStep struct {
+		Step    string
+		Name    string
+		Detail  string
+		Action  string `json:",omitempty"`
+		Applied bool
+	}
+
+	// Evaluation is the action of the traffic from a container to
+	// another and the trace of the policies leading to it.
+	Evaluation struct {
+		Source          string
+		SourceName      string
+		Destination     string
+		DestinationName string
+		Protocol        string `json:",omitempty"`
+		Port            int    `json:",omitempty"`
+		Action          string
+		Trace           []EvaluateStep
+	}
+
+	// Binding is the identity of a container, which outlives its id.
+	// Removed is set once the container is destroyed, until its state
+	// is bound to a new container or deleted.
+	Binding struct {
+		Id       string
+		Name     string
+		Identity string
+		Removed  time.Time
+	}
+
+	// MigrationStep is a step of a container migration. Rollback is
+	// set on the steps undoing a previous one.
+	MigrationStep struct {
+		Step     string
+		Rollback bool `json:",omitempty"`
+		Status   string
+		Detail   string `json:",omitempty"`
+		Started  time.Time
+		Finished time.Time
+	}
+
+	// Migration is the report of a container migration, Status is
+	// done, rolled-back, or failed when the rollback failed too.
+	Migration struct {
+		Container    string
+		Name         string
+		NewContainer string `json:",omitempty"`
+		Node         string `json:",omitempty"`
+		Checkpoint   string `json:",omitempty"`
+		Status       string
+		Error        string `json:",omitempty"`
+		Steps        []MigrationStep
+	}
+
+	// Placement is the node a strategy chose for the new container of a
+	// migration, and why.
+	Placement struct {
+		Strategy string
+		Node     string
+		Reason   string
+	}
+
+	// Job is a container migration run in the background, Migration
+	// reports its steps as they are taken.
+	Job struct {
+		Id        string
+		Container string
+		Name      string
+		Request   ResetRequest
+		Placement *Placement `json:",omitempty"`
+		Status    string
+		Error     string `json:",omitempty"`
+		Created   time.Time
+		Started   time.Time
+		Finished  time.Time
+		Migration *Migration `json:",omitempty"`
+	}
+
+	// Orphan is a stored entry of a container or network which does
+	// not exist anymore.
+	Orphan struct {
+		Kind   string
+		Key    string
+		Reason string
+	}
+
+	// Firewall maps GatewayPort of a gateway to ServicePort of a
+	// container or, with port ranges, each port of GatewayPorts to the
+	// port of ServicePorts at the same offset, GatewayPort and
+	// ServicePort being then their first ports. Protocol is tcp or udp,
+	// Sources are the CIDRs allowed to connect, any if empty.
+	Firewall struct {
+		Name         string
+		Container    string
+		DatapathID   string
+		GatewayIP    string
+		GatewayPort  int
+		ServicePort  int
+		Protocol     string     `json:",omitempty"`
+		GatewayPorts *PortRange `json:",omitempty"`
+		ServicePorts *PortRange `json:",omitempty"`
+		Sources      []string   `json:",omitempty"`
 	}
 )
 
@@ -32,3 +315,9 @@ func NewGateway(node, hostname, datapath, intdev, intip, extdev, extip string) *
 		ExtIP:      extip,
 	}
 }
+
+// Expired reports whether the gateway registration was not refreshed
+// before its ttl. Gateways registered without a ttl never expire.
+func (g *Gateway) Expired(now time.Time) bool {
+	return !g.Expires.IsZero() && now.After(g.Expires)
+}
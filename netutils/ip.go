@@ -2,27 +2,86 @@ package netutils
 
 import (
 	"errors"
+	"fmt"
 	"net"
-	"os"
-	"os/exec"
+	"syscall"
 )
 
+var ErrNoAddress = errors.New("error to get address.")
+
+// IPManager manages network devices, their addresses and routes.
+type IPManager interface {
+	// SetDeviceUP brings the device up.
+	SetDeviceUP(dev string) error
+	// SetDeviceDown brings the device down.
+	SetDeviceDown(dev string) error
+	// IsDeviceUP reports whether the device is administratively up.
+	IsDeviceUP(dev string) (bool, error)
+	// DeleteDevice deletes the device, it is not an error if it does not exist.
+	DeleteDevice(dev string) error
+	// GetAddress returns the first ipv4 address of the device in cidr form.
+	GetAddress(dev string) (string, error)
+	// SetAddress adds the cidr address to the device, or replaces it.
+	SetAddress(dev, address string) error
+	// DeleteAddress removes the cidr address from the device.
+	DeleteAddress(dev, address string) error
+	// AddRoute adds a route to the cidr dst via gateway gw and device dev,
+	// either gw or dev may be empty.
+	AddRoute(dst, gw, dev string) error
+}
+
+// IP implements IPManager on rtnetlink.
 type IP struct{}
 
-func (i IP) run(args ...string) (string, error) {
-	out, err := exec.Command("ip", args...).Output()
-	return string(out), err
+func (i IP) link(dev string) (*net.Interface, error) {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("device %s: %v", dev, err)
+	}
+	return iface, nil
 }
 
-func (i IP) DeleteDevice(dev string) {
-	_, err := os.Stat("/sys/class/net/" + dev)
-	if err == nil {
-		i.run("link", "delete", dev)
+func (i IP) setFlags(dev string, flags uint32) error {
+	iface, err := i.link(dev)
+	if err != nil {
+		return err
+	}
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, 0)
+	req.ifInfomsg(iface.Index, flags, syscall.IFF_UP)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set device %s: %v", dev, err)
 	}
+	return nil
 }
 
-func (i IP) SetDeviceUP(dev string) {
-	i.run("link", "set", dev, "up")
+func (i IP) SetDeviceUP(dev string) error {
+	return i.setFlags(dev, syscall.IFF_UP)
+}
+
+func (i IP) SetDeviceDown(dev string) error {
+	return i.setFlags(dev, 0)
+}
+
+func (i IP) IsDeviceUP(dev string) (bool, error) {
+	iface, err := i.link(dev)
+	if err != nil {
+		return false, err
+	}
+	return iface.Flags&net.FlagUp != 0, nil
+}
+
+func (i IP) DeleteDevice(dev string) error {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		// The device is already gone.
+		return nil
+	}
+	req := newNetlinkRequest(syscall.RTM_DELLINK, 0)
+	req.ifInfomsg(iface.Index, 0, 0)
+	if err := req.execute(); err != nil && err != syscall.ENODEV {
+		return fmt.Errorf("delete device %s: %v", dev, err)
+	}
+	return nil
 }
 
 func (i IP) GetAddress(dev string) (string, error) {
@@ -44,10 +103,110 @@ func (i IP) GetAddress(dev string) (string, error) {
 		}
 	}
 
-	return "", errors.New("error to get address.")
+	return "", ErrNoAddress
+}
+
+// addrRequest builds a RTM_NEWADDR or RTM_DELADDR request for the
+// ipv4 cidr address on the device index.
+func addrRequest(typ, flags, index int, address string) (*netlinkRequest, error) {
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 address", address)
+	}
+	prefixlen, _ := ipnet.Mask.Size()
+
+	req := newNetlinkRequest(typ, flags)
+	req.ifAddrmsg(syscall.AF_INET, prefixlen, index)
+	req.attr(syscall.IFA_LOCAL, ip4)
+	req.attr(syscall.IFA_ADDRESS, ip4)
+	return req, nil
+}
+
+func (i IP) addrRequest(typ, flags int, dev, address string) (*netlinkRequest, error) {
+	iface, err := i.link(dev)
+	if err != nil {
+		return nil, err
+	}
+	return addrRequest(typ, flags, iface.Index, address)
 }
 
 func (i IP) SetAddress(dev, address string) error {
-	_, err := i.run("addr", "replace", address, "dev", dev)
-	return err
+	req, err := i.addrRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, dev, address)
+	if err != nil {
+		return err
+	}
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set address %s on %s: %v", address, dev, err)
+	}
+	return nil
+}
+
+func (i IP) DeleteAddress(dev, address string) error {
+	req, err := i.addrRequest(syscall.RTM_DELADDR, 0, dev, address)
+	if err != nil {
+		return err
+	}
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("delete address %s on %s: %v", address, dev, err)
+	}
+	return nil
+}
+
+// routeRequest builds a RTM_NEWROUTE request to the ipv4 cidr dst via
+// gateway gw and the device index, gw may be empty and index zero.
+func routeRequest(dst, gw string, index int) (*netlinkRequest, error) {
+	_, ipnet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return nil, err
+	}
+	dst4 := ipnet.IP.To4()
+	if dst4 == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 network", dst)
+	}
+	dstlen, _ := ipnet.Mask.Size()
+
+	scope := syscall.RT_SCOPE_UNIVERSE
+	if gw == "" {
+		scope = syscall.RT_SCOPE_LINK
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	req.rtMsg(syscall.AF_INET, dstlen, scope)
+	if dstlen > 0 {
+		req.attr(syscall.RTA_DST, dst4)
+	}
+	if gw != "" {
+		gw4 := net.ParseIP(gw).To4()
+		if gw4 == nil {
+			return nil, fmt.Errorf("%s is not an ipv4 address", gw)
+		}
+		req.attr(syscall.RTA_GATEWAY, gw4)
+	}
+	if index != 0 {
+		req.attrUint32(syscall.RTA_OIF, uint32(index))
+	}
+	return req, nil
+}
+
+func (i IP) AddRoute(dst, gw, dev string) error {
+	index := 0
+	if dev != "" {
+		iface, err := i.link(dev)
+		if err != nil {
+			return err
+		}
+		index = iface.Index
+	}
+	req, err := routeRequest(dst, gw, index)
+	if err != nil {
+		return err
+	}
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("add route %s: %v", dst, err)
+	}
+	return nil
 }
@@ -1,29 +1,182 @@
 package netutils
 
-import "os/exec"
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+)
 
+const (
+	ChainPostrouting = "DAOLINET-POSTROUTING"
+	ChainForward     = "DAOLINET-FORWARD"
+
+	// commentPrefix tags every rule with the network it belongs to.
+	commentPrefix = "daolinet:"
+)
+
+// IPtable manages the nat and forward rules of the daolinet networks
+// in chains owned by daolinet, jumped to from the built-in chains.
 type IPtable struct{}
 
-func (i IPtable) runNat(action, addr string) (string, error) {
-	out, err := exec.Command("iptables", "-t", "nat", action, "POSTROUTING",
-		"-s", addr, "!", "-d", addr, "-j", "MASQUERADE").Output()
-	return string(out), err
+type chainJump struct {
+	table   string
+	builtin string
+	chain   string
 }
 
-func (i IPtable) runForward(action, target, addr string) (string, error) {
-	out, err := exec.Command("iptables", action, "FORWARD",
-		target, addr, "-j", "ACCEPT").Output()
-	return string(out), err
+var iptableJumps = []chainJump{
+	{"nat", "POSTROUTING", ChainPostrouting},
+	{"filter", "FORWARD", ChainForward},
+}
+
+func (i IPtable) run(args ...string) (string, error) {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func (i IPtable) exists(table, builtin, chain string) bool {
+	_, err := i.run("-t", table, "-C", builtin, "-j", chain)
+	return err == nil
+}
+
+// restore builds the iptables-restore input replacing the content of
+// the daolinet chains with the rules of networks, indexed by network id.
+func (i IPtable) restore(networks map[string]string) (string, error) {
+	ids := []string{}
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var nat, filter bytes.Buffer
+	for _, id := range ids {
+		_, ipnet, err := net.ParseCIDR(networks[id])
+		if err != nil {
+			return "", fmt.Errorf("network %s: %v", id, err)
+		}
+		addr := ipnet.String()
+		comment := fmt.Sprintf("-m comment --comment \"%s%s\"", commentPrefix, id)
+		fmt.Fprintf(&nat, "-A %s -s %s ! -d %s %s -j MASQUERADE\n", ChainPostrouting, addr, addr, comment)
+		fmt.Fprintf(&filter, "-A %s -s %s %s -j ACCEPT\n", ChainForward, addr, comment)
+		fmt.Fprintf(&filter, "-A %s -d %s %s -j ACCEPT\n", ChainForward, addr, comment)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*nat\n:%s - [0:0]\n-F %s\n%sCOMMIT\n", ChainPostrouting, ChainPostrouting, nat.String())
+	fmt.Fprintf(&b, "*filter\n:%s - [0:0]\n-F %s\n%sCOMMIT\n", ChainForward, ChainForward, filter.String())
+	return b.String(), nil
+}
+
+// Sync atomically replaces the rules of the daolinet chains with the
+// rules of networks, a map of network id to cidr, and makes sure the
+// built-in chains jump to them. It can be called any number of times.
+func (i IPtable) Sync(networks map[string]string) error {
+	input, err := i.restore(networks)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(input)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables-restore: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	for _, j := range iptableJumps {
+		if !i.exists(j.table, j.builtin, j.chain) {
+			if _, err := i.run("-t", j.table, "-I", j.builtin, "1", "-j", j.chain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Networks returns the networks, by id, whose masquerade and forward
+// rules are all present in the daolinet chains.
+func (i IPtable) Networks() (map[string]string, error) {
+	count := map[string]int{}
+	addrs := map[string]string{}
+	for _, j := range iptableJumps {
+		if !i.exists(j.table, j.builtin, j.chain) {
+			return map[string]string{}, nil
+		}
+		out, err := i.run("-t", j.table, "-S", j.chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			id, addr := parseRule(line)
+			if id == "" {
+				continue
+			}
+			if prev, ok := addrs[id]; ok && prev != addr {
+				continue
+			}
+			addrs[id] = addr
+			count[id]++
+		}
+	}
+
+	networks := map[string]string{}
+	for id, n := range count {
+		// One masquerade and two forward rules.
+		if n == 3 {
+			networks[id] = addrs[id]
+		}
+	}
+	return networks, nil
 }
 
-func (i IPtable) AddRule(addr string) {
-	i.runNat("-A", addr)
-	i.runForward("-I", "-s", addr)
-	i.runForward("-I", "-d", addr)
+// parseRule returns the network id and source or destination address
+// of a rule printed by iptables -S, or empty strings for other rules.
+func parseRule(line string) (string, string) {
+	fields := strings.Fields(line)
+	var id, addr string
+	for k := 0; k < len(fields)-1; k++ {
+		switch fields[k] {
+		case "-s", "-d":
+			if addr == "" {
+				addr = fields[k+1]
+			}
+		case "--comment":
+			comment := strings.Trim(fields[k+1], "\"")
+			if strings.HasPrefix(comment, commentPrefix) {
+				id = strings.TrimPrefix(comment, commentPrefix)
+			}
+		}
+	}
+	if id == "" || addr == "" {
+		return "", ""
+	}
+	return id, addr
 }
 
-func (i IPtable) DropRule(addr string) {
-	i.runNat("-D", addr)
-	i.runForward("-D", "-s", addr)
-	i.runForward("-D", "-d", addr)
+// Flush removes the jumps to the daolinet chains and the chains
+// themselves, along with every rule they hold.
+func (i IPtable) Flush() error {
+	for _, j := range iptableJumps {
+		for i.exists(j.table, j.builtin, j.chain) {
+			if _, err := i.run("-t", j.table, "-D", j.builtin, "-j", j.chain); err != nil {
+				return err
+			}
+		}
+		if _, err := i.run("-t", j.table, "-L", j.chain, "-n"); err != nil {
+			// The chain does not exist.
+			continue
+		}
+		if _, err := i.run("-t", j.table, "-F", j.chain); err != nil {
+			return err
+		}
+		if _, err := i.run("-t", j.table, "-X", j.chain); err != nil {
+			return err
+		}
+	}
+	return nil
 }
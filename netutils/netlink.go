@@ -0,0 +1,154 @@
+package netutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	nativeEndian binary.ByteOrder
+	netlinkSeq   uint32
+)
+
+func init() {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// netlinkRequest is a rtnetlink message under construction.
+type netlinkRequest struct {
+	typ   uint16
+	flags uint16
+	data  []byte
+}
+
+func newNetlinkRequest(typ, flags int) *netlinkRequest {
+	return &netlinkRequest{
+		typ:   uint16(typ),
+		flags: uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags),
+	}
+}
+
+// ifInfomsg appends a struct ifinfomsg.
+func (r *netlinkRequest) ifInfomsg(index int, flags, change uint32) {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	nativeEndian.PutUint32(b[8:], flags)
+	nativeEndian.PutUint32(b[12:], change)
+	r.data = append(r.data, b...)
+}
+
+// ifAddrmsg appends a struct ifaddrmsg.
+func (r *netlinkRequest) ifAddrmsg(family, prefixlen, index int) {
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = byte(family)
+	b[1] = byte(prefixlen)
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	r.data = append(r.data, b...)
+}
+
+// rtMsg appends a struct rtmsg.
+func (r *netlinkRequest) rtMsg(family, dstlen, scope int) {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = byte(family)
+	b[1] = byte(dstlen)
+	b[4] = syscall.RT_TABLE_MAIN
+	b[5] = syscall.RTPROT_BOOT
+	b[6] = byte(scope)
+	b[7] = syscall.RTN_UNICAST
+	r.data = append(r.data, b...)
+}
+
+// attr appends a route attribute.
+func (r *netlinkRequest) attr(typ int, value []byte) {
+	length := syscall.SizeofRtAttr + len(value)
+	b := make([]byte, rtaAlign(length))
+	nativeEndian.PutUint16(b[0:], uint16(length))
+	nativeEndian.PutUint16(b[2:], uint16(typ))
+	copy(b[syscall.SizeofRtAttr:], value)
+	r.data = append(r.data, b...)
+}
+
+func (r *netlinkRequest) attrUint32(typ int, value uint32) {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, value)
+	r.attr(typ, b)
+}
+
+func (r *netlinkRequest) serialize(seq uint32) []byte {
+	length := syscall.NLMSG_HDRLEN + len(r.data)
+	b := make([]byte, length)
+	nativeEndian.PutUint32(b[0:], uint32(length))
+	nativeEndian.PutUint16(b[4:], r.typ)
+	nativeEndian.PutUint16(b[6:], r.flags)
+	nativeEndian.PutUint32(b[8:], seq)
+	copy(b[syscall.NLMSG_HDRLEN:], r.data)
+	return b
+}
+
+// execute sends the request on a new rtnetlink socket and waits for
+// the kernel acknowledgement. A negative acknowledgement is returned
+// as the corresponding syscall.Errno.
+func (r *netlinkRequest) execute() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	local := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, local); err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Sendto(fd, r.serialize(seq), 0, kernel); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		if n < syscall.NLMSG_HDRLEN {
+			return fmt.Errorf("netlink: short message of %d bytes", n)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("netlink: short error message")
+				}
+				errno := int32(nativeEndian.Uint32(m.Data[0:4]))
+				if errno == 0 {
+					return nil
+				}
+				return syscall.Errno(-errno)
+			case syscall.NLMSG_DONE:
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package netutils
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// parseRequest decodes a serialized request with the syscall parsers,
+// it returns the header, the fixed size message and the attributes.
+func parseRequest(t *testing.T, b []byte, size int) (syscall.NlMsghdr, []byte, map[uint16][]byte) {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("parse message: %d messages, %v", len(msgs), err)
+	}
+	m := msgs[0]
+	if int(m.Header.Len) != len(b) {
+		t.Errorf("header length %d, message length %d", m.Header.Len, len(b))
+	}
+	if len(m.Data) < size {
+		t.Fatalf("message of %d bytes, want at least %d", len(m.Data), size)
+	}
+
+	attrs := map[uint16][]byte{}
+	if len(m.Data) > size {
+		rtas, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			t.Fatalf("parse attributes: %v", err)
+		}
+		for _, rta := range rtas {
+			attrs[rta.Attr.Type] = rta.Value
+		}
+	}
+	return m.Header, m.Data[:size], attrs
+}
+
+func unsafePointer(b []byte) unsafe.Pointer {
+	return unsafe.Pointer(&b[0])
+}
+
+func TestSerialize(t *testing.T) {
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, 0)
+	req.ifInfomsg(7, syscall.IFF_UP, syscall.IFF_UP)
+	b := req.serialize(42)
+
+	h, msg, attrs := parseRequest(t, b, syscall.SizeofIfInfomsg)
+	if h.Type != syscall.RTM_NEWLINK || h.Seq != 42 || h.Flags != syscall.NLM_F_REQUEST|syscall.NLM_F_ACK {
+		t.Errorf("header = %+v", h)
+	}
+	if len(attrs) != 0 {
+		t.Errorf("attributes = %v", attrs)
+	}
+	info := (*syscall.IfInfomsg)(unsafePointer(msg))
+	if info.Family != syscall.AF_UNSPEC || info.Index != 7 || info.Flags != syscall.IFF_UP || info.Change != syscall.IFF_UP {
+		t.Errorf("ifinfomsg = %+v", info)
+	}
+}
+
+func TestAttrAlign(t *testing.T) {
+	tests := []struct {
+		value  []byte
+		length int
+	}{
+		{[]byte{}, 4},
+		{[]byte{1}, 8},
+		{[]byte{1, 2, 3, 4}, 8},
+		{[]byte{1, 2, 3, 4, 5}, 12},
+	}
+	for _, test := range tests {
+		req := &netlinkRequest{}
+		req.attr(syscall.IFA_LOCAL, test.value)
+		if len(req.data) != test.length {
+			t.Errorf("attribute of %d bytes takes %d bytes, want %d", len(test.value), len(req.data), test.length)
+		}
+		if l := int(nativeEndian.Uint16(req.data)); l != syscall.SizeofRtAttr+len(test.value) {
+			t.Errorf("attribute of %d bytes has length %d", len(test.value), l)
+		}
+	}
+}
+
+func TestAddrRequest(t *testing.T) {
+	tests := []struct {
+		typ       int
+		flags     int
+		address   string
+		prefixlen uint8
+		ip        net.IP
+		fail      bool
+	}{
+		{
+			typ:       syscall.RTM_NEWADDR,
+			flags:     syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE,
+			address:   "10.1.0.1/24",
+			prefixlen: 24,
+			ip:        net.IP{10, 1, 0, 1},
+		},
+		{
+			typ:       syscall.RTM_DELADDR,
+			address:   "192.168.3.4/32",
+			prefixlen: 32,
+			ip:        net.IP{192, 168, 3, 4},
+		},
+		{typ: syscall.RTM_NEWADDR, address: "fd00::1/64", fail: true},
+		{typ: syscall.RTM_NEWADDR, address: "10.1.0.1", fail: true},
+	}
+	for _, test := range tests {
+		req, err := addrRequest(test.typ, test.flags, 3, test.address)
+		if test.fail {
+			if err == nil {
+				t.Errorf("address %s was accepted", test.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("address %s: %v", test.address, err)
+		}
+
+		h, msg, attrs := parseRequest(t, req.serialize(1), syscall.SizeofIfAddrmsg)
+		flags := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | test.flags)
+		if h.Type != uint16(test.typ) || h.Flags != flags {
+			t.Errorf("%s: header = %+v", test.address, h)
+		}
+		addr := (*syscall.IfAddrmsg)(unsafePointer(msg))
+		if addr.Family != syscall.AF_INET || addr.Prefixlen != test.prefixlen || addr.Index != 3 {
+			t.Errorf("%s: ifaddrmsg = %+v", test.address, addr)
+		}
+		want := map[uint16][]byte{
+			syscall.IFA_LOCAL:   []byte(test.ip),
+			syscall.IFA_ADDRESS: []byte(test.ip),
+		}
+		if !reflect.DeepEqual(attrs, want) {
+			t.Errorf("%s: attributes = %v, want %v", test.address, attrs, want)
+		}
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	oif := make([]byte, 4)
+	nativeEndian.PutUint32(oif, 5)
+
+	tests := []struct {
+		dst    string
+		gw     string
+		index  int
+		dstlen uint8
+		scope  uint8
+		attrs  map[uint16][]byte
+		fail   bool
+	}{
+		{
+			dst:    "10.2.0.0/16",
+			gw:     "10.1.0.254",
+			dstlen: 16,
+			scope:  syscall.RT_SCOPE_UNIVERSE,
+			attrs: map[uint16][]byte{
+				syscall.RTA_DST:     {10, 2, 0, 0},
+				syscall.RTA_GATEWAY: {10, 1, 0, 254},
+			},
+		},
+		{
+			dst:    "10.3.0.0/24",
+			index:  5,
+			dstlen: 24,
+			scope:  syscall.RT_SCOPE_LINK,
+			attrs: map[uint16][]byte{
+				syscall.RTA_DST: {10, 3, 0, 0},
+				syscall.RTA_OIF: oif,
+			},
+		},
+		{
+			dst:   "0.0.0.0/0",
+			gw:    "10.1.0.254",
+			scope: syscall.RT_SCOPE_UNIVERSE,
+			attrs: map[uint16][]byte{
+				syscall.RTA_GATEWAY: {10, 1, 0, 254},
+			},
+		},
+		{dst: "fd00::/64", fail: true},
+		{dst: "10.2.0.0/16", gw: "fd00::1", fail: true},
+	}
+	for _, test := range tests {
+		req, err := routeRequest(test.dst, test.gw, test.index)
+		if test.fail {
+			if err == nil {
+				t.Errorf("route %s via %s was accepted", test.dst, test.gw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("route %s: %v", test.dst, err)
+		}
+
+		h, msg, attrs := parseRequest(t, req.serialize(1), syscall.SizeofRtMsg)
+		flags := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_EXCL)
+		if h.Type != syscall.RTM_NEWROUTE || h.Flags != flags {
+			t.Errorf("%s: header = %+v", test.dst, h)
+		}
+		rt := (*syscall.RtMsg)(unsafePointer(msg))
+		if rt.Family != syscall.AF_INET || rt.Dst_len != test.dstlen || rt.Scope != test.scope ||
+			rt.Table != syscall.RT_TABLE_MAIN || rt.Type != syscall.RTN_UNICAST {
+			t.Errorf("%s: rtmsg = %+v", test.dst, rt)
+		}
+		if !reflect.DeepEqual(attrs, test.attrs) {
+			t.Errorf("%s: attributes = %v, want %v", test.dst, attrs, test.attrs)
+		}
+	}
+}
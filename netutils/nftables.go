@@ -0,0 +1,149 @@
+package netutils
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// NFTableName is the nftables table holding every daolinet rule.
+const NFTableName = "daolinet"
+
+// NFTables manages the nat and forward rules of the daolinet networks
+// in a dedicated nftables table.
+type NFTables struct{}
+
+func (n NFTables) run(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("nft", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func (n NFTables) exists() bool {
+	_, err := n.run("", "list", "table", "ip", NFTableName)
+	return err == nil
+}
+
+// ruleset builds an nft script replacing the daolinet table with the
+// rules of networks, indexed by network id. Creating the table before
+// deleting it keeps the script valid when the table does not exist.
+func (n NFTables) ruleset(networks map[string]string) (string, error) {
+	ids := []string{}
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var nat, filter bytes.Buffer
+	for _, id := range ids {
+		_, ipnet, err := net.ParseCIDR(networks[id])
+		if err != nil {
+			return "", fmt.Errorf("network %s: %v", id, err)
+		}
+		addr := ipnet.String()
+		comment := fmt.Sprintf("comment \"%s%s\"", commentPrefix, id)
+		fmt.Fprintf(&nat, "\t\tip saddr %s ip daddr != %s masquerade %s\n", addr, addr, comment)
+		fmt.Fprintf(&filter, "\t\tip saddr %s accept %s\n", addr, comment)
+		fmt.Fprintf(&filter, "\t\tip daddr %s accept %s\n", addr, comment)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table ip %s {}\ndelete table ip %s\n", NFTableName, NFTableName)
+	fmt.Fprintf(&b, "table ip %s {\n", NFTableName)
+	fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority 100; policy accept;\n%s\t}\n", nat.String())
+	fmt.Fprintf(&b, "\tchain forward {\n\t\ttype filter hook forward priority 0; policy accept;\n%s\t}\n", filter.String())
+	fmt.Fprintf(&b, "}\n")
+	return b.String(), nil
+}
+
+// Sync atomically replaces the daolinet table with the rules of
+// networks, a map of network id to cidr.
+func (n NFTables) Sync(networks map[string]string) error {
+	script, err := n.ruleset(networks)
+	if err != nil {
+		return err
+	}
+	_, err = n.run(script, "-f", "-")
+	return err
+}
+
+// Networks returns the networks, by id, whose masquerade and forward
+// rules are all present in the daolinet table.
+func (n NFTables) Networks() (map[string]string, error) {
+	if !n.exists() {
+		return map[string]string{}, nil
+	}
+	out, err := n.run("", "list", "table", "ip", NFTableName)
+	if err != nil {
+		return nil, err
+	}
+	return parseNFTNetworks(out), nil
+}
+
+// parseNFTNetworks returns the networks, by id, of the table printed by
+// nft list whose three rules are present with the same address.
+func parseNFTNetworks(out string) map[string]string {
+	networks := map[string]string{}
+	count := map[string]int{}
+	addrs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		id, addr := parseNFTRule(line)
+		if id == "" {
+			continue
+		}
+		if prev, ok := addrs[id]; ok && prev != addr {
+			continue
+		}
+		addrs[id] = addr
+		count[id]++
+	}
+	for id, c := range count {
+		// One masquerade and two forward rules.
+		if c == 3 {
+			networks[id] = addrs[id]
+		}
+	}
+	return networks
+}
+
+// parseNFTRule returns the network id and address of a rule printed
+// by nft list, or empty strings for other lines.
+func parseNFTRule(line string) (string, string) {
+	fields := strings.Fields(line)
+	var id, addr string
+	for k := 0; k < len(fields)-1; k++ {
+		switch fields[k] {
+		case "saddr", "daddr":
+			if addr == "" {
+				addr = fields[k+1]
+			}
+		case "comment":
+			comment := strings.Trim(fields[k+1], "\"")
+			if strings.HasPrefix(comment, commentPrefix) {
+				id = strings.TrimPrefix(comment, commentPrefix)
+			}
+		}
+	}
+	if id == "" || addr == "" {
+		return "", ""
+	}
+	return id, addr
+}
+
+// Flush deletes the daolinet table and every rule it holds.
+func (n NFTables) Flush() error {
+	if !n.exists() {
+		return nil
+	}
+	_, err := n.run("", "delete", "table", "ip", NFTableName)
+	return err
+}
@@ -0,0 +1,97 @@
+package netutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNFTRuleset(t *testing.T) {
+	script, err := NFTables{}.ruleset(map[string]string{
+		"net2": "10.2.0.0/16",
+		"net1": "10.1.0.5/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `table ip daolinet {}
+delete table ip daolinet
+table ip daolinet {
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip saddr 10.1.0.0/24 ip daddr != 10.1.0.0/24 masquerade comment "daolinet:net1"
+		ip saddr 10.2.0.0/16 ip daddr != 10.2.0.0/16 masquerade comment "daolinet:net2"
+	}
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		ip saddr 10.1.0.0/24 accept comment "daolinet:net1"
+		ip daddr 10.1.0.0/24 accept comment "daolinet:net1"
+		ip saddr 10.2.0.0/16 accept comment "daolinet:net2"
+		ip daddr 10.2.0.0/16 accept comment "daolinet:net2"
+	}
+}
+`
+	if script != want {
+		t.Errorf("ruleset =\n%s\nwant\n%s", script, want)
+	}
+
+	if _, err := (NFTables{}).ruleset(map[string]string{"net1": "10.1.0.0"}); err == nil {
+		t.Errorf("network without a prefix length was accepted")
+	}
+}
+
+func TestParseNFTRule(t *testing.T) {
+	tests := []struct {
+		line string
+		id   string
+		addr string
+	}{
+		{`ip saddr 10.1.0.0/24 ip daddr != 10.1.0.0/24 masquerade comment "daolinet:net1"`, "net1", "10.1.0.0/24"},
+		{`ip daddr 10.1.0.0/24 accept comment "daolinet:net1"`, "net1", "10.1.0.0/24"},
+		{`ip saddr 10.1.0.0/24 accept comment "other:net1"`, "", ""},
+		{`ip saddr 10.1.0.0/24 accept`, "", ""},
+		{`type filter hook forward priority filter; policy accept;`, "", ""},
+		{`comment "daolinet:net1"`, "", ""},
+	}
+	for _, test := range tests {
+		id, addr := parseNFTRule(test.line)
+		if id != test.id || addr != test.addr {
+			t.Errorf("%s: rule = %q %q, want %q %q", test.line, id, addr, test.id, test.addr)
+		}
+	}
+}
+
+func TestParseNFTNetworks(t *testing.T) {
+	// As printed by nft list table, with symbolic priorities.
+	out := `table ip daolinet {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.1.0.0/24 ip daddr != 10.1.0.0/24 masquerade comment "daolinet:net1"
+		ip saddr 10.2.0.0/16 ip daddr != 10.2.0.0/16 masquerade comment "daolinet:net2"
+		ip saddr 10.3.0.0/24 ip daddr != 10.3.0.0/24 masquerade comment "daolinet:net3"
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ip saddr 10.1.0.0/24 accept comment "daolinet:net1"
+		ip daddr 10.1.0.0/24 accept comment "daolinet:net1"
+		ip saddr 10.2.0.0/16 accept comment "daolinet:net2"
+		ip saddr 10.3.0.0/24 accept comment "daolinet:net3"
+		ip daddr 10.4.0.0/24 accept comment "daolinet:net3"
+	}
+}
+`
+	// net2 lacks a forward rule and a rule of net3 has another address.
+	want := map[string]string{"net1": "10.1.0.0/24"}
+	if networks := parseNFTNetworks(out); !reflect.DeepEqual(networks, want) {
+		t.Errorf("networks = %v, want %v", networks, want)
+	}
+
+	script, err := NFTables{}.ruleset(map[string]string{"net1": "10.1.0.0/24", "net2": "10.2.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"net1": "10.1.0.0/24", "net2": "10.2.0.0/16"}
+	if networks := parseNFTNetworks(script); !reflect.DeepEqual(networks, want) {
+		t.Errorf("networks of the ruleset = %v, want %v", networks, want)
+	}
+}
@@ -1,55 +1,307 @@
 package netutils
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
-	"strings"
+	"sync"
+	"time"
+)
+
+const ovsDatabase = "Open_vSwitch"
+
+// ErrBridgeNotFound is returned when the bridge does not exist in ovsdb.
+var ErrBridgeNotFound = errors.New("ovs bridge not found")
+
+type (
+	Bridge struct {
+		UUID       string
+		Name       string
+		DatapathID string
+		Ports      []string
+	}
+
+	Port struct {
+		UUID       string
+		Name       string
+		Interfaces []string
+	}
+
+	Interface struct {
+		UUID string
+		Name string
+		Type string
+	}
 )
 
 type OVS struct {
-	br      string
-	timeout int
+	br   string
+	dial func() (*OVSDBClient, error)
+
+	lock   sync.Mutex
+	client *OVSDBClient
+}
+
+// conn returns the connection to ovsdb-server, dialing again
+// if it was lost.
+func (o *OVS) conn() (*OVSDBClient, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.client != nil {
+		select {
+		case <-o.client.Done():
+			o.client = nil
+		default:
+			return o.client, nil
+		}
+	}
+
+	client, err := o.dial()
+	if err != nil {
+		return nil, err
+	}
+	o.client = client
+	return client, nil
+}
+
+func (o *OVS) transact(ops ...Operation) ([]OperationResult, error) {
+	client, err := o.conn()
+	if err != nil {
+		return nil, err
+	}
+	return client.Transact(ovsDatabase, ops...)
+}
+
+func (o *OVS) selectRows(table string, where []Condition, columns ...string) ([]Row, error) {
+	if where == nil {
+		where = []Condition{}
+	}
+	results, err := o.transact(Operation{
+		Op:      "select",
+		Table:   table,
+		Where:   where,
+		Columns: append([]string{"_uuid"}, columns...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results[0].Rows, nil
+}
+
+func decodeBridge(row Row) (b Bridge, err error) {
+	if b.UUID, err = row.UUID(); err != nil {
+		return
+	}
+	if b.Name, err = row.String("name"); err != nil {
+		return
+	}
+	if b.DatapathID, err = row.String("datapath_id"); err != nil {
+		return
+	}
+	b.Ports, err = row.UUIDs("ports")
+	return
+}
+
+func decodePort(row Row) (p Port, err error) {
+	if p.UUID, err = row.UUID(); err != nil {
+		return
+	}
+	if p.Name, err = row.String("name"); err != nil {
+		return
+	}
+	p.Interfaces, err = row.UUIDs("interfaces")
+	return
+}
+
+func decodeInterface(row Row) (i Interface, err error) {
+	if i.UUID, err = row.UUID(); err != nil {
+		return
+	}
+	if i.Name, err = row.String("name"); err != nil {
+		return
+	}
+	i.Type, err = row.String("type")
+	return
+}
+
+// Bridges returns the bridges matching where, or all of them.
+func (o *OVS) Bridges(where ...Condition) ([]Bridge, error) {
+	rows, err := o.selectRows("Bridge", where, "name", "datapath_id", "ports")
+	if err != nil {
+		return nil, err
+	}
+	bridges := []Bridge{}
+	for _, row := range rows {
+		b, err := decodeBridge(row)
+		if err != nil {
+			return nil, err
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+// Ports returns the ports matching where, or all of them.
+func (o *OVS) Ports(where ...Condition) ([]Port, error) {
+	rows, err := o.selectRows("Port", where, "name", "interfaces")
+	if err != nil {
+		return nil, err
+	}
+	ports := []Port{}
+	for _, row := range rows {
+		p, err := decodePort(row)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// Interfaces returns the interfaces matching where, or all of them.
+func (o *OVS) Interfaces(where ...Condition) ([]Interface, error) {
+	rows, err := o.selectRows("Interface", where, "name", "type")
+	if err != nil {
+		return nil, err
+	}
+	ifaces := []Interface{}
+	for _, row := range rows {
+		i, err := decodeInterface(row)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, i)
+	}
+	return ifaces, nil
 }
 
-func (o *OVS) run(args ...string) (string, error) {
-	timeout := fmt.Sprintf("--timeout=%d", o.timeout)
-	format := fmt.Sprintf("--format=%s", "json")
-	cmd := append([]string{timeout, format, "--no-heading", "--"}, args...)
-	out, err := exec.Command("ovs-vsctl", cmd...).Output()
-	//out, err := exec.Command("ovs-vsctl", args...).Output()
-	return string(out), err
+// detachPort returns the operation removing the ports named dev
+// from every bridge, ovsdb garbage collects the unreferenced rows.
+func (o *OVS) detachPort(dev string) (*Operation, error) {
+	ports, err := o.Ports(NewCondition("name", "==", dev))
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) == 0 {
+		return nil, nil
+	}
+
+	uuids := OvsSet{}
+	for _, p := range ports {
+		uuids = append(uuids, UUID(p.UUID))
+	}
+	return &Operation{
+		Op:        "mutate",
+		Table:     "Bridge",
+		Where:     []Condition{},
+		Mutations: []Mutation{NewMutation("ports", "delete", uuids)},
+	}, nil
 }
 
+// CreateNetwork adds dev as an internal port of the bridge,
+// replacing any existing port with the same name.
 func (o *OVS) CreateNetwork(dev string) error {
-	_, err := o.run("--if-exists", "del-port", dev,
-		"--", "add-port", o.br, dev,
-		"--", "set", "Interface", dev,
-		"type=internal")
-	return err
+	ops := []Operation{}
+	detach, err := o.detachPort(dev)
+	if err != nil {
+		return err
+	}
+	if detach != nil {
+		ops = append(ops, *detach)
+	}
+
+	ops = append(ops,
+		Operation{
+			Op:       "insert",
+			Table:    "Interface",
+			Row:      map[string]interface{}{"name": dev, "type": "internal"},
+			UUIDName: "iface",
+		},
+		Operation{
+			Op:       "insert",
+			Table:    "Port",
+			Row:      map[string]interface{}{"name": dev, "interfaces": NamedUUID("iface")},
+			UUIDName: "port",
+		},
+		Operation{
+			Op:        "mutate",
+			Table:     "Bridge",
+			Where:     []Condition{NewCondition("name", "==", o.br)},
+			Mutations: []Mutation{NewMutation("ports", "insert", OvsSet{NamedUUID("port")})},
+		},
+	)
+
+	results, err := o.transact(ops...)
+	if err != nil {
+		return err
+	}
+	if results[len(ops)-1].Count == 0 {
+		return fmt.Errorf("%v: %s", ErrBridgeNotFound, o.br)
+	}
+	return nil
 }
 
+// DeleteNetwork removes the port dev from the bridge if it exists.
 func (o *OVS) DeleteNetwork(dev string) error {
-	_, err := o.run("--if-exists", "del-port", o.br, dev)
+	ports, err := o.Ports(NewCondition("name", "==", dev))
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	uuids := OvsSet{}
+	for _, p := range ports {
+		uuids = append(uuids, UUID(p.UUID))
+	}
+	_, err = o.transact(Operation{
+		Op:        "mutate",
+		Table:     "Bridge",
+		Where:     []Condition{NewCondition("name", "==", o.br)},
+		Mutations: []Mutation{NewMutation("ports", "delete", uuids)},
+	})
 	return err
 }
 
 func (o *OVS) GetDatapath() (string, error) {
-	out, err := o.run("get", "bridge", o.br, "datapath_id")
+	bridges, err := o.Bridges(NewCondition("name", "==", o.br))
 	if err != nil {
-		return out, err
+		return "", err
 	}
-	out = strings.Trim(string(out), "\"\n")
-	return out, nil
+	if len(bridges) == 0 {
+		return "", fmt.Errorf("%v: %s", ErrBridgeNotFound, o.br)
+	}
+	return bridges[0].DatapathID, nil
 }
 
-func (o *OVS) FindInternal() (string, error) {
-	out, err := o.run("--columns=name", "find", "interface", "type=internal")
-	return strings.TrimRight(out, "\n "), err
+// FindInternal returns every interface of type internal.
+func (o *OVS) FindInternal() ([]Interface, error) {
+	return o.Interfaces(NewCondition("type", "==", "internal"))
 }
 
-func NewOVS(br string) *OVS {
-	return &OVS{
-		br:      br,
-		timeout: 5,
+// Close the connection to ovsdb-server.
+func (o *OVS) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.client != nil {
+		o.client.Close()
+		o.client = nil
 	}
 }
+
+// NewOVS returns an OVS managing bridge br through the ovsdb-server
+// at endpoint, "unix:<path>" or "tcp:<host>:<port>".
+func NewOVS(br, endpoint string) *OVS {
+	if endpoint == "" {
+		endpoint = DefaultOVSDBEndpoint
+	}
+	return NewOVSWithDial(br, func() (*OVSDBClient, error) {
+		return DialOVSDB(endpoint, 5*time.Second)
+	})
+}
+
+// NewOVSWithDial returns an OVS managing bridge br through the clients
+// dial returns, it is called again once the connection is lost.
+func NewOVSWithDial(br string, dial func() (*OVSDBClient, error)) *OVS {
+	return &OVS{br: br, dial: dial}
+}
@@ -0,0 +1,169 @@
+package netutils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeBridge answers the transactions of an OVS managing br0 with one
+// port eth1.
+func fakeBridge(t *testing.T, transactions *[][]map[string]interface{}) func(string, []json.RawMessage) (interface{}, interface{}) {
+	return func(method string, params []json.RawMessage) (interface{}, interface{}) {
+		ops := decodeOps(t, params)
+		*transactions = append(*transactions, ops)
+
+		results := []interface{}{}
+		for _, op := range ops {
+			switch {
+			case op["op"] == "select" && op["table"] == "Bridge":
+				rows := []interface{}{}
+				if where, _ := json.Marshal(op["where"]); string(where) == `[["name","==","br0"]]` {
+					rows = append(rows, map[string]interface{}{
+						"_uuid":       []string{"uuid", "b0"},
+						"name":        "br0",
+						"datapath_id": "0000aabbccddeeff",
+						"ports":       []interface{}{"set", []interface{}{[]string{"uuid", "p0"}}},
+					})
+				}
+				results = append(results, map[string]interface{}{"rows": rows})
+			case op["op"] == "select" && op["table"] == "Port":
+				rows := []interface{}{}
+				if where, _ := json.Marshal(op["where"]); string(where) == `[["name","==","eth1"]]` {
+					rows = append(rows, map[string]interface{}{
+						"_uuid":      []string{"uuid", "p0"},
+						"name":       "eth1",
+						"interfaces": []string{"uuid", "i0"},
+					})
+				}
+				results = append(results, map[string]interface{}{"rows": rows})
+			case op["op"] == "mutate":
+				count := 1
+				if where, _ := json.Marshal(op["where"]); strings.Contains(string(where), "missing") {
+					count = 0
+				}
+				results = append(results, map[string]interface{}{"count": count})
+			default:
+				results = append(results, map[string]interface{}{"uuid": []string{"uuid", "new"}})
+			}
+		}
+		return results, nil
+	}
+}
+
+func newTestOVS(t *testing.T, br string) (*OVS, *[][]map[string]interface{}, *int) {
+	transactions := &[][]map[string]interface{}{}
+	dials := 0
+	o := NewOVSWithDial(br, func() (*OVSDBClient, error) {
+		dials++
+		_, c := newFakeOVSDB(t, fakeBridge(t, transactions))
+		return c, nil
+	})
+	return o, transactions, &dials
+}
+
+func opsOf(transaction []map[string]interface{}) []string {
+	ops := []string{}
+	for _, op := range transaction {
+		ops = append(ops, op["op"].(string)+" "+op["table"].(string))
+	}
+	return ops
+}
+
+func TestGetDatapath(t *testing.T) {
+	o, _, _ := newTestOVS(t, "br0")
+	defer o.Close()
+	if dpid, err := o.GetDatapath(); err != nil || dpid != "0000aabbccddeeff" {
+		t.Errorf("datapath = %q, %v", dpid, err)
+	}
+
+	missing, _, _ := newTestOVS(t, "missing")
+	defer missing.Close()
+	if _, err := missing.GetDatapath(); err == nil || !strings.HasPrefix(err.Error(), ErrBridgeNotFound.Error()) {
+		t.Errorf("datapath of a missing bridge error = %v", err)
+	}
+}
+
+func TestCreateNetwork(t *testing.T) {
+	tests := []struct {
+		dev  string
+		br   string
+		ops  []string
+		fail bool
+	}{
+		{
+			dev: "eth2",
+			br:  "br0",
+			ops: []string{"insert Interface", "insert Port", "mutate Bridge"},
+		},
+		{
+			dev: "eth1",
+			br:  "br0",
+			ops: []string{"mutate Bridge", "insert Interface", "insert Port", "mutate Bridge"},
+		},
+		{
+			dev:  "eth2",
+			br:   "missing",
+			ops:  []string{"insert Interface", "insert Port", "mutate Bridge"},
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		o, transactions, _ := newTestOVS(t, test.br)
+		err := o.CreateNetwork(test.dev)
+		o.Close()
+		if (err != nil) != test.fail {
+			t.Errorf("create %s on %s error = %v", test.dev, test.br, err)
+		}
+		if len(*transactions) != 2 {
+			t.Fatalf("create %s on %s ran %d transactions", test.dev, test.br, len(*transactions))
+		}
+		if ops := opsOf((*transactions)[1]); !reflect.DeepEqual(ops, test.ops) {
+			t.Errorf("create %s on %s ops = %v, want %v", test.dev, test.br, ops, test.ops)
+		}
+	}
+}
+
+func TestDeleteNetwork(t *testing.T) {
+	o, transactions, _ := newTestOVS(t, "br0")
+	defer o.Close()
+
+	if err := o.DeleteNetwork("eth2"); err != nil {
+		t.Fatalf("delete missing port: %v", err)
+	}
+	if err := o.DeleteNetwork("eth1"); err != nil {
+		t.Fatalf("delete port: %v", err)
+	}
+	if len(*transactions) != 3 {
+		t.Fatalf("ran %d transactions, want 3", len(*transactions))
+	}
+	mutate, _ := json.Marshal((*transactions)[2][0]["mutations"])
+	if string(mutate) != `[["ports","delete",["set",[["uuid","p0"]]]]]` {
+		t.Errorf("delete mutations = %s", mutate)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	o, _, dials := newTestOVS(t, "br0")
+	defer o.Close()
+
+	if _, err := o.GetDatapath(); err != nil {
+		t.Fatalf("datapath: %v", err)
+	}
+	if _, err := o.GetDatapath(); err != nil {
+		t.Fatalf("datapath: %v", err)
+	}
+	if *dials != 1 {
+		t.Errorf("dialed %d times for one connection", *dials)
+	}
+
+	o.client.Close()
+	<-o.client.Done()
+	if _, err := o.GetDatapath(); err != nil {
+		t.Fatalf("datapath after the connection was lost: %v", err)
+	}
+	if *dials != 2 {
+		t.Errorf("dialed %d times, want a new connection", *dials)
+	}
+}
@@ -0,0 +1,480 @@
+package netutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOVSDBEndpoint is the socket ovsdb-server listens on by default.
+const DefaultOVSDBEndpoint = "unix:/var/run/openvswitch/db.sock"
+
+var (
+	// ErrOVSDBClosed is returned when the connection to ovsdb-server is lost.
+	ErrOVSDBClosed = errors.New("ovsdb connection closed")
+	// ErrOVSDBTimeout is returned when ovsdb-server does not answer in time.
+	ErrOVSDBTimeout = errors.New("ovsdb request timed out")
+)
+
+type (
+	// UUID is a row reference, encoded as ["uuid", "<uuid>"].
+	UUID string
+
+	// NamedUUID references a row inserted earlier in the same
+	// transaction, encoded as ["named-uuid", "<name>"].
+	NamedUUID string
+
+	// OvsSet is a set of atoms, encoded as ["set", [...]].
+	OvsSet []interface{}
+
+	// OvsMap is a map of atoms, encoded as ["map", [[k, v], ...]].
+	OvsMap map[string]string
+
+	// Condition is a where clause element: [column, function, value].
+	Condition []interface{}
+
+	// Mutation is a mutate element: [column, mutator, value].
+	Mutation []interface{}
+
+	// Row is a set of column values as returned by ovsdb-server.
+	Row map[string]json.RawMessage
+
+	// Operation is one operation of a transaction, as described in
+	// RFC 7047 section 5.2.
+	Operation struct {
+		Op        string
+		Table     string
+		Row       map[string]interface{}
+		Where     []Condition
+		Columns   []string
+		Mutations []Mutation
+		UUIDName  string
+	}
+
+	// OperationResult is the result of one operation of a transaction.
+	OperationResult struct {
+		Count   int    `json:"count,omitempty"`
+		Error   string `json:"error,omitempty"`
+		Details string `json:"details,omitempty"`
+		UUID    UUID   `json:"uuid,omitempty"`
+		Rows    []Row  `json:"rows,omitempty"`
+	}
+
+	// MonitorRequest selects the columns of a table to monitor.
+	MonitorRequest struct {
+		Columns []string `json:"columns,omitempty"`
+	}
+
+	// RowUpdate holds the old and new values of a modified row.
+	RowUpdate struct {
+		Old Row `json:"old,omitempty"`
+		New Row `json:"new,omitempty"`
+	}
+
+	// TableUpdates maps table name to row uuid to row update.
+	TableUpdates map[string]map[string]RowUpdate
+
+	rpcMessage struct {
+		Method string          `json:"method,omitempty"`
+		Params json.RawMessage `json:"params,omitempty"`
+		Result json.RawMessage `json:"result,omitempty"`
+		Error  json.RawMessage `json:"error,omitempty"`
+		ID     json.RawMessage `json:"id,omitempty"`
+	}
+
+	// OVSDBClient is a JSON-RPC client for the OVSDB management
+	// protocol (RFC 7047).
+	OVSDBClient struct {
+		conn     net.Conn
+		enc      *json.Encoder
+		encLock  sync.Mutex
+		lock     sync.Mutex
+		nextID   uint64
+		pending  map[uint64]chan *rpcMessage
+		monitors map[string]func(TableUpdates)
+		timeout  time.Duration
+		closed   chan struct{}
+		err      error
+	}
+)
+
+// NewCondition returns a where clause element.
+func NewCondition(column, function string, value interface{}) Condition {
+	return Condition{column, function, value}
+}
+
+// NewMutation returns a mutate element.
+func NewMutation(column, mutator string, value interface{}) Mutation {
+	return Mutation{column, mutator, value}
+}
+
+func (u UUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{"uuid", string(u)})
+}
+
+func (u *UUID) UnmarshalJSON(b []byte) error {
+	var pair []string
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 || pair[0] != "uuid" {
+		return fmt.Errorf("invalid ovsdb uuid: %s", string(b))
+	}
+	*u = UUID(pair[1])
+	return nil
+}
+
+func (u NamedUUID) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]string{"named-uuid", string(u)})
+}
+
+func (s OvsSet) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		s = OvsSet{}
+	}
+	return json.Marshal([]interface{}{"set", []interface{}(s)})
+}
+
+func (m OvsMap) MarshalJSON() ([]byte, error) {
+	pairs := [][]string{}
+	for k, v := range m {
+		pairs = append(pairs, []string{k, v})
+	}
+	return json.Marshal([]interface{}{"map", pairs})
+}
+
+func (o Operation) MarshalJSON() ([]byte, error) {
+	op := map[string]interface{}{"op": o.Op}
+	if o.Table != "" {
+		op["table"] = o.Table
+	}
+	if o.Row != nil {
+		op["row"] = o.Row
+	}
+	if o.Where != nil {
+		op["where"] = o.Where
+	}
+	if o.Columns != nil {
+		op["columns"] = o.Columns
+	}
+	if o.Mutations != nil {
+		op["mutations"] = o.Mutations
+	}
+	if o.UUIDName != "" {
+		op["uuid-name"] = o.UUIDName
+	}
+	return json.Marshal(op)
+}
+
+// String decodes a string column. Optional columns that are
+// not set are encoded as an empty set and decode to "".
+func (r Row) String(column string) (string, error) {
+	raw, ok := r[column]
+	if !ok {
+		return "", nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+
+	var set []json.RawMessage
+	if err := json.Unmarshal(raw, &set); err != nil || len(set) != 2 {
+		return "", fmt.Errorf("invalid ovsdb string column %s: %s", column, string(raw))
+	}
+	var elems []string
+	if err := json.Unmarshal(set[1], &elems); err != nil || len(elems) > 1 {
+		return "", fmt.Errorf("invalid ovsdb string column %s: %s", column, string(raw))
+	}
+	if len(elems) == 0 {
+		return "", nil
+	}
+	return elems[0], nil
+}
+
+// UUIDs decodes a column holding one uuid or a set of uuids.
+func (r Row) UUIDs(column string) ([]string, error) {
+	raw, ok := r[column]
+	if !ok {
+		return nil, nil
+	}
+
+	var u UUID
+	if err := json.Unmarshal(raw, &u); err == nil {
+		return []string{string(u)}, nil
+	}
+
+	var set []json.RawMessage
+	if err := json.Unmarshal(raw, &set); err != nil || len(set) != 2 {
+		return nil, fmt.Errorf("invalid ovsdb uuid column %s: %s", column, string(raw))
+	}
+	var elems []UUID
+	if err := json.Unmarshal(set[1], &elems); err != nil {
+		return nil, fmt.Errorf("invalid ovsdb uuid column %s: %v", column, err)
+	}
+	uuids := []string{}
+	for _, elem := range elems {
+		uuids = append(uuids, string(elem))
+	}
+	return uuids, nil
+}
+
+// UUID decodes the _uuid column of the row.
+func (r Row) UUID() (string, error) {
+	uuids, err := r.UUIDs("_uuid")
+	if err != nil {
+		return "", err
+	}
+	if len(uuids) != 1 {
+		return "", errors.New("row has no _uuid column")
+	}
+	return uuids[0], nil
+}
+
+// parseEndpoint splits an ovs style endpoint, "unix:<path>" or
+// "tcp:<host>:<port>", into a network and an address.
+func parseEndpoint(endpoint string) (string, string, error) {
+	parts := strings.SplitN(endpoint, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid ovsdb endpoint: %s", endpoint)
+	}
+	switch parts[0] {
+	case "unix", "tcp":
+		return parts[0], parts[1], nil
+	default:
+		return "", "", fmt.Errorf("unsupported ovsdb endpoint: %s", endpoint)
+	}
+}
+
+// DialOVSDB connects to the ovsdb-server at endpoint.
+func DialOVSDB(endpoint string, timeout time.Duration) (*OVSDBClient, error) {
+	network, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewOVSDBClient(conn, timeout), nil
+}
+
+// NewOVSDBClient returns a client speaking to ovsdb-server over conn.
+// Requests that get no answer within timeout fail with ErrOVSDBTimeout.
+func NewOVSDBClient(conn net.Conn, timeout time.Duration) *OVSDBClient {
+	c := &OVSDBClient{
+		conn:     conn,
+		enc:      json.NewEncoder(conn),
+		pending:  map[uint64]chan *rpcMessage{},
+		monitors: map[string]func(TableUpdates){},
+		timeout:  timeout,
+		closed:   make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// Done is closed when the connection is lost.
+func (c *OVSDBClient) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Close the connection.
+func (c *OVSDBClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *OVSDBClient) send(msg interface{}) error {
+	c.encLock.Lock()
+	defer c.encLock.Unlock()
+	return c.enc.Encode(msg)
+}
+
+func (c *OVSDBClient) loop() {
+	dec := json.NewDecoder(c.conn)
+	for {
+		var msg rpcMessage
+		if err := dec.Decode(&msg); err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch msg.Method {
+		case "":
+			c.response(&msg)
+		case "echo":
+			c.send(map[string]interface{}{
+				"result": msg.Params,
+				"error":  nil,
+				"id":     msg.ID,
+			})
+		case "update":
+			c.update(&msg)
+		}
+	}
+}
+
+func (c *OVSDBClient) shutdown(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	close(c.closed)
+	c.conn.Close()
+}
+
+func (c *OVSDBClient) response(msg *rpcMessage) {
+	id, err := strconv.ParseUint(string(msg.ID), 10, 64)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+	if ok {
+		ch <- msg
+	}
+}
+
+func (c *OVSDBClient) update(msg *rpcMessage) {
+	var params []json.RawMessage
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) != 2 {
+		return
+	}
+	var id string
+	if err := json.Unmarshal(params[0], &id); err != nil {
+		return
+	}
+	var updates TableUpdates
+	if err := json.Unmarshal(params[1], &updates); err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	handler, ok := c.monitors[id]
+	c.lock.Unlock()
+	if ok {
+		handler(updates)
+	}
+}
+
+// call sends a request and decodes its result into result.
+func (c *OVSDBClient) call(method string, params []interface{}, result interface{}) error {
+	ch := make(chan *rpcMessage, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return ErrOVSDBClosed
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.lock.Unlock()
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	req := map[string]interface{}{
+		"method": method,
+		"params": params,
+		"id":     id,
+	}
+	if err := c.send(req); err != nil {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return ErrOVSDBClosed
+		}
+		if len(msg.Error) > 0 && string(msg.Error) != "null" {
+			return fmt.Errorf("ovsdb %s error: %s", method, string(msg.Error))
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, result)
+	case <-timer.C:
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return ErrOVSDBTimeout
+	}
+}
+
+// ListDbs returns the databases served by ovsdb-server.
+func (c *OVSDBClient) ListDbs() ([]string, error) {
+	var dbs []string
+	err := c.call("list_dbs", nil, &dbs)
+	return dbs, err
+}
+
+// Transact runs ops atomically in database db. An error is returned
+// if any operation failed, in which case nothing was committed.
+func (c *OVSDBClient) Transact(db string, ops ...Operation) ([]OperationResult, error) {
+	params := []interface{}{db}
+	for _, op := range ops {
+		params = append(params, op)
+	}
+
+	var results []OperationResult
+	if err := c.call("transact", params, &results); err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		if result.Error != "" {
+			if i < len(ops) {
+				return results, fmt.Errorf("ovsdb %s on %s: %s: %s", ops[i].Op, ops[i].Table, result.Error, result.Details)
+			}
+			return results, fmt.Errorf("ovsdb transaction: %s: %s", result.Error, result.Details)
+		}
+	}
+	if len(results) < len(ops) {
+		return results, errors.New("ovsdb transaction: missing operation results")
+	}
+	return results, nil
+}
+
+// Monitor starts monitoring the tables in requests. The current content
+// is returned, later changes are passed to handler from the connection
+// goroutine, so handler must not block on other requests of this client.
+func (c *OVSDBClient) Monitor(db, id string, requests map[string]MonitorRequest, handler func(TableUpdates)) (TableUpdates, error) {
+	c.lock.Lock()
+	c.monitors[id] = handler
+	c.lock.Unlock()
+
+	var updates TableUpdates
+	if err := c.call("monitor", []interface{}{db, id, requests}, &updates); err != nil {
+		c.lock.Lock()
+		delete(c.monitors, id)
+		c.lock.Unlock()
+		return nil, err
+	}
+	return updates, nil
+}
+
+// MonitorCancel stops the monitor started with id.
+func (c *OVSDBClient) MonitorCancel(id string) error {
+	c.lock.Lock()
+	delete(c.monitors, id)
+	c.lock.Unlock()
+	return c.call("monitor_cancel", []interface{}{id}, nil)
+}
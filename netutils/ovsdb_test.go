@@ -0,0 +1,291 @@
+package netutils
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOVSDB is an in-process ovsdb-server answering the requests of a
+// client with handle.
+type fakeOVSDB struct {
+	t      *testing.T
+	conn   net.Conn
+	handle func(method string, params []json.RawMessage) (interface{}, interface{})
+
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newFakeOVSDB(t *testing.T, handle func(string, []json.RawMessage) (interface{}, interface{})) (*fakeOVSDB, *OVSDBClient) {
+	server, client := net.Pipe()
+	f := &fakeOVSDB{t: t, conn: server, handle: handle, enc: json.NewEncoder(server)}
+	go f.serve()
+	return f, NewOVSDBClient(client, time.Second)
+}
+
+func (f *fakeOVSDB) send(msg interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.enc.Encode(msg)
+}
+
+func (f *fakeOVSDB) serve() {
+	dec := json.NewDecoder(f.conn)
+	for {
+		var msg rpcMessage
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		var params []json.RawMessage
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			f.t.Errorf("invalid params of %s: %s", msg.Method, msg.Params)
+			return
+		}
+		result, rpcErr := f.handle(msg.Method, params)
+		if result == nil && rpcErr == nil {
+			continue
+		}
+		f.send(map[string]interface{}{"id": msg.ID, "result": result, "error": rpcErr})
+	}
+}
+
+// update sends a monitor notification.
+func (f *fakeOVSDB) update(id string, updates interface{}) error {
+	return f.send(map[string]interface{}{
+		"id":     nil,
+		"method": "update",
+		"params": []interface{}{id, updates},
+	})
+}
+
+func (f *fakeOVSDB) Close() {
+	f.conn.Close()
+}
+
+// decodeOps decodes the operations of transact params.
+func decodeOps(t *testing.T, params []json.RawMessage) []map[string]interface{} {
+	var db string
+	if err := json.Unmarshal(params[0], &db); err != nil || db != ovsDatabase {
+		t.Errorf("transact on database %s", params[0])
+	}
+	ops := []map[string]interface{}{}
+	for _, raw := range params[1:] {
+		var op map[string]interface{}
+		if err := json.Unmarshal(raw, &op); err != nil {
+			t.Fatalf("invalid operation %s: %v", raw, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func TestOperationMarshal(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		want string
+	}{
+		{
+			Operation{Op: "select", Table: "Bridge", Where: []Condition{}, Columns: []string{"_uuid"}},
+			`{"columns":["_uuid"],"op":"select","table":"Bridge","where":[]}`,
+		},
+		{
+			Operation{Op: "insert", Table: "Port", Row: map[string]interface{}{"interfaces": NamedUUID("iface")}, UUIDName: "port"},
+			`{"op":"insert","row":{"interfaces":["named-uuid","iface"]},"table":"Port","uuid-name":"port"}`,
+		},
+		{
+			Operation{Op: "mutate", Table: "Bridge", Where: []Condition{NewCondition("name", "==", "br0")},
+				Mutations: []Mutation{NewMutation("ports", "delete", OvsSet{UUID("u1")})}},
+			`{"mutations":[["ports","delete",["set",[["uuid","u1"]]]]],"op":"mutate","table":"Bridge","where":[["name","==","br0"]]}`,
+		},
+		{
+			Operation{Op: "commit"},
+			`{"op":"commit"}`,
+		},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(test.op)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", test.op, err)
+		}
+		if string(b) != test.want {
+			t.Errorf("marshal %s = %s, want %s", test.op.Op, b, test.want)
+		}
+	}
+}
+
+func TestRowDecode(t *testing.T) {
+	row := Row{
+		"_uuid":       json.RawMessage(`["uuid","u0"]`),
+		"name":        json.RawMessage(`"br0"`),
+		"datapath_id": json.RawMessage(`["set",[]]`),
+		"ports":       json.RawMessage(`["set",[["uuid","u1"],["uuid","u2"]]]`),
+		"interfaces":  json.RawMessage(`["uuid","u3"]`),
+	}
+	if uuid, err := row.UUID(); err != nil || uuid != "u0" {
+		t.Errorf("uuid = %q, %v", uuid, err)
+	}
+	if name, err := row.String("name"); err != nil || name != "br0" {
+		t.Errorf("name = %q, %v", name, err)
+	}
+	if dpid, err := row.String("datapath_id"); err != nil || dpid != "" {
+		t.Errorf("unset datapath_id = %q, %v", dpid, err)
+	}
+	if ports, err := row.UUIDs("ports"); err != nil || !reflect.DeepEqual(ports, []string{"u1", "u2"}) {
+		t.Errorf("ports = %v, %v", ports, err)
+	}
+	if ifaces, err := row.UUIDs("interfaces"); err != nil || !reflect.DeepEqual(ifaces, []string{"u3"}) {
+		t.Errorf("interfaces = %v, %v", ifaces, err)
+	}
+	if _, err := (Row{"name": json.RawMessage(`["set",["a","b"]]`)}).String("name"); err == nil {
+		t.Errorf("string column holding a set of two was decoded")
+	}
+}
+
+func TestTransact(t *testing.T) {
+	f, c := newFakeOVSDB(t, func(method string, params []json.RawMessage) (interface{}, interface{}) {
+		ops := decodeOps(t, params)
+		if ops[0]["table"] == "Missing" {
+			return []interface{}{map[string]interface{}{"error": "unknown table", "details": "no table Missing"}}, nil
+		}
+		return []interface{}{map[string]interface{}{"count": 1}}, nil
+	})
+	defer f.Close()
+
+	results, err := c.Transact(ovsDatabase, Operation{Op: "delete", Table: "Port", Where: []Condition{}})
+	if err != nil {
+		t.Fatalf("transact: %v", err)
+	}
+	if len(results) != 1 || results[0].Count != 1 {
+		t.Errorf("results = %v", results)
+	}
+
+	_, err = c.Transact(ovsDatabase, Operation{Op: "delete", Table: "Missing", Where: []Condition{}})
+	if err == nil || err.Error() != "ovsdb delete on Missing: unknown table: no table Missing" {
+		t.Errorf("failed operation error = %v", err)
+	}
+
+	_, err = c.Transact(ovsDatabase, Operation{Op: "delete", Table: "Port"}, Operation{Op: "commit"})
+	if err == nil {
+		t.Errorf("missing operation results were accepted")
+	}
+}
+
+func TestTransactRPCError(t *testing.T) {
+	f, c := newFakeOVSDB(t, func(method string, params []json.RawMessage) (interface{}, interface{}) {
+		return nil, "unknown database"
+	})
+	defer f.Close()
+
+	if _, err := c.Transact("Missing", Operation{Op: "commit"}); err == nil {
+		t.Errorf("rpc error was accepted")
+	}
+}
+
+func TestTransactTimeoutAndClose(t *testing.T) {
+	server, conn := net.Pipe()
+	go json.NewDecoder(server).Decode(&rpcMessage{})
+	c := NewOVSDBClient(conn, 50*time.Millisecond)
+
+	if _, err := c.Transact(ovsDatabase, Operation{Op: "commit"}); err != ErrOVSDBTimeout {
+		t.Errorf("unanswered request error = %v", err)
+	}
+
+	server.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("client not done after the server closed")
+	}
+	if _, err := c.Transact(ovsDatabase, Operation{Op: "commit"}); err != ErrOVSDBClosed {
+		t.Errorf("request on a closed client error = %v", err)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	server, conn := net.Pipe()
+	defer server.Close()
+	NewOVSDBClient(conn, time.Second)
+
+	enc, dec := json.NewEncoder(server), json.NewDecoder(server)
+	if err := enc.Encode(map[string]interface{}{"method": "echo", "params": []string{"ping"}, "id": "echo"}); err != nil {
+		t.Fatalf("send echo: %v", err)
+	}
+	var reply rpcMessage
+	if err := dec.Decode(&reply); err != nil {
+		t.Fatalf("read echo reply: %v", err)
+	}
+	if string(reply.ID) != `"echo"` || string(reply.Result) != `["ping"]` {
+		t.Errorf("echo reply = %s %s", reply.ID, reply.Result)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	f, c := newFakeOVSDB(t, func(method string, params []json.RawMessage) (interface{}, interface{}) {
+		switch method {
+		case "monitor":
+			var requests map[string]MonitorRequest
+			if err := json.Unmarshal(params[2], &requests); err != nil {
+				t.Errorf("invalid monitor requests %s", params[2])
+			}
+			if !reflect.DeepEqual(requests["Bridge"].Columns, []string{"name"}) {
+				t.Errorf("monitor requests = %v", requests)
+			}
+			return map[string]interface{}{
+				"Bridge": map[string]interface{}{
+					"u0": map[string]interface{}{"new": map[string]interface{}{"name": "br0"}},
+				},
+			}, nil
+		case "monitor_cancel":
+			return map[string]interface{}{}, nil
+		case "list_dbs":
+			return []string{ovsDatabase}, nil
+		}
+		t.Errorf("unexpected method %s", method)
+		return nil, "unexpected"
+	})
+	defer f.Close()
+
+	updates := make(chan TableUpdates, 1)
+	initial, err := c.Monitor(ovsDatabase, "m1", map[string]MonitorRequest{"Bridge": {Columns: []string{"name"}}},
+		func(u TableUpdates) { updates <- u })
+	if err != nil {
+		t.Fatalf("monitor: %v", err)
+	}
+	if name, _ := initial["Bridge"]["u0"].New.String("name"); name != "br0" {
+		t.Errorf("initial content = %v", initial)
+	}
+
+	if err := f.update("m1", map[string]interface{}{
+		"Bridge": map[string]interface{}{
+			"u0": map[string]interface{}{"old": map[string]interface{}{"name": "br0"}},
+		},
+	}); err != nil {
+		t.Fatalf("send update: %v", err)
+	}
+	select {
+	case u := <-updates:
+		if row := u["Bridge"]["u0"]; row.Old == nil || row.New != nil {
+			t.Errorf("update = %v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no update received")
+	}
+
+	if err := c.MonitorCancel("m1"); err != nil {
+		t.Fatalf("monitor cancel: %v", err)
+	}
+	// Updates of a canceled monitor are dropped.
+	f.update("m1", map[string]interface{}{})
+	if dbs, err := c.ListDbs(); err != nil || !reflect.DeepEqual(dbs, []string{ovsDatabase}) {
+		t.Errorf("list_dbs = %v, %v", dbs, err)
+	}
+	select {
+	case u := <-updates:
+		t.Errorf("update received after cancel: %v", u)
+	default:
+	}
+}
@@ -0,0 +1,46 @@
+package netutils
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const (
+	RuleBackendAuto     = "auto"
+	RuleBackendIPtables = "iptables"
+	RuleBackendNFTables = "nftables"
+)
+
+// RuleManager manages the per network masquerade and forward accept
+// rules of the gateway. Networks are given as a map of network id to
+// cidr.
+type RuleManager interface {
+	// Sync atomically replaces every daolinet rule with the rules of networks.
+	Sync(networks map[string]string) error
+	// Networks returns the networks whose rules are all in place.
+	Networks() (map[string]string, error)
+	// Flush removes every daolinet rule.
+	Flush() error
+}
+
+// NewRuleManager returns the RuleManager of backend. With auto,
+// iptables is used when iptables-restore is installed, nftables
+// otherwise.
+func NewRuleManager(backend string) (RuleManager, error) {
+	switch backend {
+	case RuleBackendIPtables:
+		return IPtable{}, nil
+	case RuleBackendNFTables:
+		return NFTables{}, nil
+	case RuleBackendAuto, "":
+		if _, err := exec.LookPath("iptables-restore"); err == nil {
+			return IPtable{}, nil
+		}
+		if _, err := exec.LookPath("nft"); err == nil {
+			return NFTables{}, nil
+		}
+		return nil, fmt.Errorf("neither iptables-restore nor nft could be found")
+	default:
+		return nil, fmt.Errorf("unsupported firewall backend: %s", backend)
+	}
+}